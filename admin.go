@@ -0,0 +1,319 @@
+package hotstuff
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// logHub fans the log entries of a replica or client out to the readers
+// of the admin log stream. A reader that falls behind loses entries.
+type logHub struct {
+	mu   *sync.Mutex
+	subs map[chan interface{}]bool
+}
+
+func (h *logHub) run(ch chan interface{}) {
+	for msg := range ch {
+		h.mu.Lock()
+		for sub := range h.subs {
+			select {
+			case sub <- msg:
+			default:
+			}
+		}
+		h.mu.Unlock()
+	}
+}
+
+func (h *logHub) subscribe() chan interface{} {
+	sub := make(chan interface{}, 256)
+	h.mu.Lock()
+	h.subs[sub] = true
+	h.mu.Unlock()
+	return sub
+}
+
+func (h *logHub) unsubscribe(sub chan interface{}) {
+	h.mu.Lock()
+	delete(h.subs, sub)
+	h.mu.Unlock()
+}
+
+func makeLogHub(ch chan interface{}) *logHub {
+	h := &logHub{}
+	h.mu = &sync.Mutex{}
+	h.subs = make(map[chan interface{}]bool)
+	go h.run(ch)
+	return h
+}
+
+// AdminServerBase serves the operations of the debug console as an HTTP
+// JSON API, plus the log as a stream of server-sent events at /log:
+//
+//	GET  /status            state of the replica or client (print)
+//	GET  /log[?level=info]  log entries as they happen
+//	POST /kill              stop serving (kill)
+//
+// Errors are answered as {"error": "..."}.
+type AdminServerBase struct {
+	mu     *sync.Mutex
+	addr   string
+	l      net.Listener
+	srv    *http.Server
+	mux    *http.ServeMux
+	hub    *logHub
+	onKill func()
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, err string) {
+	writeJSON(w, status, map[string]string{"error": err})
+}
+
+// handle registers f for path, answering other methods than method with
+// 405.
+func (as *AdminServerBase) handle(path, method string, f http.HandlerFunc) {
+	as.mux.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != method {
+			w.Header().Set("Allow", method)
+			writeError(w, http.StatusMethodNotAllowed, "use "+method)
+			return
+		}
+		f(w, r)
+	})
+}
+
+func (as *AdminServerBase) handleLog(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, "streaming unsupported")
+		return
+	}
+	level := DebugLevel
+	if s := r.URL.Query().Get("level"); s != "" {
+		var err error
+		if level, err = ParseLevel(s); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+
+	sub := as.hub.subscribe()
+	defer as.hub.unsubscribe(sub)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	format := &JSONFormatter{}
+	for {
+		select {
+		case msg := <-sub:
+			entry, ok := msg.(*LogEntry)
+			if !ok || entry.Level < level {
+				continue
+			}
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", entry.Event, strings.TrimSpace(format.Format(entry)))
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+func (as *AdminServerBase) handleKill(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]bool{"killed": true})
+	go as.kill()
+}
+
+// kill closes the server, which ends serve, and lets the owner stop the
+// rest.
+func (as *AdminServerBase) kill() {
+	as.close()
+	as.mu.Lock()
+	onKill := as.onKill
+	as.mu.Unlock()
+	if onKill != nil {
+		onKill()
+	}
+}
+
+func (as *AdminServerBase) setOnKill(f func()) {
+	as.mu.Lock()
+	as.onKill = f
+	as.mu.Unlock()
+}
+
+// close hangs up on every connection too, log streams included.
+func (as *AdminServerBase) close() {
+	as.srv.Close()
+}
+
+func (as *AdminServerBase) serve(wg *sync.WaitGroup) {
+	as.srv.Serve(as.l)
+	wg.Done()
+}
+
+func (as *AdminServerBase) init(addr string, logCh chan interface{}) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	as.mu = &sync.Mutex{}
+	as.addr = addr
+	as.l = l
+	as.mux = http.NewServeMux()
+	as.srv = &http.Server{Handler: as.mux}
+	as.hub = makeLogHub(logCh)
+	as.handle("/log", http.MethodGet, as.handleLog)
+	as.handle("/kill", http.MethodPost, as.handleKill)
+	return nil
+}
+
+// HotStuffAdminServer adds to the base
+//
+//	GET  /nodes  the chain back from the generic QC (nodes)
+//	POST /mb     {"args": ["fork", "partial"]} sets the adversary (mb)
+//	GET  /chain/committed?from=1&to=10        committed nodes by height
+//	GET  /chain/node/<id>                     a node and its QC
+//	GET  /chain/ancestors/<id>?limit=10       its ancestors, nearest first
+//	GET  /chain/descendants/<id>?limit=10     its descendants
+//	GET  /chain/forks                         abandoned branches
+//	GET  /chain/dot                           the block tree for Graphviz
+type HotStuffAdminServer struct {
+	AdminServerBase
+	hotStuffServer *HotStuff
+}
+
+type adminArgs struct {
+	Args []string `json:"args"`
+	Op   string   `json:"op"`
+}
+
+func readAdminArgs(w http.ResponseWriter, r *http.Request) (*adminArgs, error) {
+	data, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+	args := &adminArgs{}
+	if err := json.Unmarshal(data, args); err != nil {
+		return nil, fmt.Errorf("invalid body: %s", err)
+	}
+	return args, nil
+}
+
+func (has *HotStuffAdminServer) handleStatus(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, has.hotStuffServer.getServerInfo())
+}
+
+func (has *HotStuffAdminServer) handleNodes(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, has.hotStuffServer.getRecentNodes())
+}
+
+// handleChain maps /chain/<command>[/<id>] and the query parameters from,
+// to and limit onto the chain explorer.
+func (has *HotStuffAdminServer) handleChain(w http.ResponseWriter, r *http.Request) {
+	args := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/chain"), "/"), "/")
+	q := r.URL.Query()
+	if args[0] == "committed" {
+		from, to := q.Get("from"), q.Get("to")
+		if from == "" {
+			from = "1"
+		}
+		if to == "" {
+			to = "0"
+		}
+		args = append(args, from, to)
+	} else if limit := q.Get("limit"); limit != "" {
+		args = append(args, limit)
+	}
+	v, err := has.hotStuffServer.exploreChain(args)
+	if err != nil {
+		writeError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	if dot, ok := v.(string); ok {
+		w.Header().Set("Content-Type", "text/vnd.graphviz")
+		w.Write([]byte(dot))
+		return
+	}
+	writeJSON(w, http.StatusOK, v)
+}
+
+func (has *HotStuffAdminServer) handleMaliciousBehavior(w http.ResponseWriter, r *http.Request) {
+	args, err := readAdminArgs(w, r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	name, err := has.hotStuffServer.setAdversary(args.Args)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"adversary": name})
+}
+
+func MakeHotStuffAdminServer(addr string, ch chan interface{}, hotStuff *HotStuff, wg *sync.WaitGroup) (*HotStuffAdminServer, error) {
+	has := &HotStuffAdminServer{}
+	if err := has.init(addr, ch); err != nil {
+		return nil, err
+	}
+	has.hotStuffServer = hotStuff
+	has.handle("/status", http.MethodGet, has.handleStatus)
+	has.handle("/nodes", http.MethodGet, has.handleNodes)
+	has.handle("/mb", http.MethodPost, has.handleMaliciousBehavior)
+	has.handle("/chain/", http.MethodGet, has.handleChain)
+	wg.Add(1)
+	go has.serve(wg)
+	return has, nil
+}
+
+// ClientAdminServer adds to the base
+//
+//	POST /req  {"op": "x"} sends a request (req)
+type ClientAdminServer struct {
+	AdminServerBase
+	clientServer *Client
+}
+
+func (cas *ClientAdminServer) handleStatus(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, cas.clientServer.getClientInfo())
+}
+
+func (cas *ClientAdminServer) handleRequest(w http.ResponseWriter, r *http.Request) {
+	args, err := readAdminArgs(w, r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if args.Op == "" {
+		writeError(w, http.StatusBadRequest, "missing op")
+		return
+	}
+	cas.clientServer.newRequest(args.Op)
+	writeJSON(w, http.StatusAccepted, map[string]string{"op": args.Op})
+}
+
+func MakeClientAdminServer(addr string, ch chan interface{}, client *Client, wg *sync.WaitGroup) (*ClientAdminServer, error) {
+	cas := &ClientAdminServer{}
+	if err := cas.init(addr, ch); err != nil {
+		return nil, err
+	}
+	cas.clientServer = client
+	cas.handle("/status", http.MethodGet, cas.handleStatus)
+	cas.handle("/req", http.MethodPost, cas.handleRequest)
+	wg.Add(1)
+	go cas.serve(wg)
+	return cas, nil
+}
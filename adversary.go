@@ -0,0 +1,193 @@
+package hotstuff
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// Adversary decides what a replica really sends in place of each honest
+// message the core emits. It runs on the event loop, so it may read the
+// core state, and it delivers messages through rawSendMsg. Forged messages
+// are signed with the replica's own key like honest ones.
+type Adversary interface {
+	Name() string
+	Send(hs *HotStuff, to int, rpcname string, args interface{})
+}
+
+type honestAdversary struct{}
+
+func (a *honestAdversary) Name() string { return "honest" }
+
+func (a *honestAdversary) Send(hs *HotStuff, to int, rpcname string, args interface{}) {
+	hs.rawSendMsg(to, rpcname, args)
+}
+
+// crashAdversary sends nothing at all.
+type crashAdversary struct{}
+
+func (a *crashAdversary) Name() string { return "crash" }
+
+func (a *crashAdversary) Send(hs *HotStuff, to int, rpcname string, args interface{}) {}
+
+// forkAdversary is the original malicious mode: as leader it proposes a
+// node extending the parent of the locked node, as replica it votes for a
+// node nobody proposed. In partial mode only the votes are forged.
+type forkAdversary struct {
+	partial bool
+}
+
+func (a *forkAdversary) Name() string {
+	if a.partial {
+		return "fork partial"
+	}
+	return "fork"
+}
+
+func (a *forkAdversary) Send(hs *HotStuff, to int, rpcname string, args interface{}) {
+	switch args := args.(type) {
+	case *ProposalArgs:
+		if !a.partial {
+			hs.rawSendMsg(to, rpcname, hs.forkProposal(args))
+			return
+		}
+	case *VoteArgs:
+		hs.rawSendMsg(to, rpcname, hs.fakeVote(args))
+		return
+	}
+	hs.rawSendMsg(to, rpcname, args)
+}
+
+// withholdAdversary never votes and never sends new-view messages, but
+// still proposes when it leads.
+type withholdAdversary struct{}
+
+func (a *withholdAdversary) Name() string { return "withhold" }
+
+func (a *withholdAdversary) Send(hs *HotStuff, to int, rpcname string, args interface{}) {
+	switch args.(type) {
+	case *VoteArgs, *NewViewArgs:
+		return
+	}
+	hs.rawSendMsg(to, rpcname, args)
+}
+
+// selectiveAdversary only talks to the given peers.
+type selectiveAdversary struct {
+	peers map[int]bool
+}
+
+func (a *selectiveAdversary) Name() string {
+	return fmt.Sprintf("selective %s", formatIdSet(a.peers))
+}
+
+func (a *selectiveAdversary) Send(hs *HotStuff, to int, rpcname string, args interface{}) {
+	if a.peers[to] {
+		hs.rawSendMsg(to, rpcname, args)
+	}
+}
+
+// equivocateAdversary sends its real proposal to everyone and a conflicting
+// one to the odd replicas, and backs every vote with a conflicting vote.
+// The conflicting proposal only renames the node, keeping the request as
+// its client signed it, so it gets past authentication to the detection.
+type equivocateAdversary struct{}
+
+func (a *equivocateAdversary) Name() string { return "equivocate" }
+
+func (a *equivocateAdversary) Send(hs *HotStuff, to int, rpcname string, args interface{}) {
+	hs.rawSendMsg(to, rpcname, args)
+	switch args := args.(type) {
+	case *ProposalArgs:
+		if to%2 == 1 {
+			fakeArgs := *args
+			fakeArgs.Node.Id = hs.fakeNodeId()
+			hs.core.keys.sign(&fakeArgs)
+			hs.rawSendMsg(to, rpcname, &fakeArgs)
+		}
+	case *VoteArgs:
+		hs.rawSendMsg(to, rpcname, hs.fakeVote(args))
+	}
+}
+
+// replayAdversary justifies its proposals and new-view messages with the
+// locked QC instead of the highest one it knows.
+type replayAdversary struct{}
+
+func (a *replayAdversary) Name() string { return "replay" }
+
+func (a *replayAdversary) Send(hs *HotStuff, to int, rpcname string, args interface{}) {
+	staleQC := hs.core.lockedQC
+	switch args := args.(type) {
+	case *ProposalArgs:
+		fakeArgs := *args
+		fakeArgs.Node.Justify = staleQC
+		hs.core.keys.sign(&fakeArgs)
+		hs.rawSendMsg(to, rpcname, &fakeArgs)
+		return
+	case *NewViewArgs:
+		fakeArgs := *args
+		fakeArgs.QC = staleQC
+		hs.core.keys.sign(&fakeArgs)
+		hs.rawSendMsg(to, rpcname, &fakeArgs)
+		return
+	}
+	hs.rawSendMsg(to, rpcname, args)
+}
+
+// delayAdversary holds every message back for a fixed time.
+type delayAdversary struct {
+	d time.Duration
+}
+
+func (a *delayAdversary) Name() string {
+	return fmt.Sprintf("delay %d", a.d/time.Millisecond)
+}
+
+func (a *delayAdversary) Send(hs *HotStuff, to int, rpcname string, args interface{}) {
+	time.AfterFunc(a.d, func() {
+		hs.rawSendMsg(to, rpcname, args)
+	})
+}
+
+// staleParentAdversary proposes on an ancestor of the real parent, depth
+// nodes up the chain, while keeping the honest justify.
+type staleParentAdversary struct {
+	depth int
+}
+
+func (a *staleParentAdversary) Name() string {
+	return fmt.Sprintf("stale-parent %d", a.depth)
+}
+
+func (a *staleParentAdversary) Send(hs *HotStuff, to int, rpcname string, args interface{}) {
+	proposal, ok := args.(*ProposalArgs)
+	if !ok {
+		hs.rawSendMsg(to, rpcname, args)
+		return
+	}
+
+	fakeArgs := *proposal
+	parent := fakeArgs.Node.Parent
+	for i := 0; i < a.depth; i++ {
+		node, ok := hs.core.nodeMap[parent]
+		if !ok || node.Parent == "" {
+			break
+		}
+		parent = node.Parent
+	}
+	fakeArgs.Node.Parent = parent
+	hs.core.keys.sign(&fakeArgs)
+	hs.rawSendMsg(to, rpcname, &fakeArgs)
+}
+
+func formatIdSet(ids map[int]bool) string {
+	s := ""
+	for id := range ids {
+		if s != "" {
+			s += ","
+		}
+		s += strconv.Itoa(id)
+	}
+	return s
+}
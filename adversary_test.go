@@ -0,0 +1,81 @@
+package hotstuff
+
+import (
+	"testing"
+)
+
+// The conflicting proposal of an equivocating leader must pass
+// authentication when it carries a client request, so the replicas get to
+// detect the equivocation.
+func TestEquivocateClientRequest(t *testing.T) {
+	keys, clientKeys, err := GenerateSigningKeys(4, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	peers := make([]caller, 4)
+	clients := make([]caller, 1)
+	leader := makeHotStuff(2, peers, clients, ThreeChainMode, keys[2], makeLogger(ErrorLevel+1))
+	replica := makeHotStuff(1, peers, clients, ThreeChainMode, keys[1], makeLogger(ErrorLevel+1))
+
+	request := RequestArgs{Operation: "x", Timestamp: 100, ClientId: 0}
+	clientKeys[0].sign(&request)
+	args := proposal(2, request, "", nil).msg
+	keys[2].sign(args)
+	(&equivocateAdversary{}).Send(leader, 1, "Propose", args)
+
+	calls := leader.servers[1].calls
+	if len(calls) != 2 {
+		t.Fatalf("sent %d proposals, want 2", len(calls))
+	}
+	for i := 0; i < 2; i++ {
+		call := <-calls
+		reply := &DefaultReply{}
+		replica.Propose(call.args.(*ProposalArgs), reply)
+		if reply.Err != "" {
+			t.Fatalf("proposal %d rejected: %s", i, reply.Err)
+		}
+		replica.core.step(<-replica.eventCh)
+	}
+	if len(replica.core.evidence) != 1 {
+		t.Errorf("%d pieces of evidence, want 1", len(replica.core.evidence))
+	}
+}
+
+// A leader proposing the same node id on another parent, as the
+// stale-parent adversary does, equivocates as much as one renaming it.
+func TestEquivocateSameNodeId(t *testing.T) {
+	keys, _, err := GenerateSigningKeys(4, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := proposal(2, noop(), "1_noop", nil).msg
+	keys[2].sign(first)
+	resent := *first
+	staleParent := proposal(2, noop(), "", nil).msg
+	keys[2].sign(staleParent)
+
+	tests := []struct {
+		name     string
+		second   *ProposalArgs
+		evidence int
+	}{
+		{"same node sent again", &resent, 0},
+		{"same id on another parent", staleParent, 1},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			hc := makeHotStuffCore(1, 4, ThreeChainMode, keys[1])
+			hc.start()
+			hc.step(proposalEvent{first})
+			hc.step(proposalEvent{test.second})
+			if len(hc.evidence) != test.evidence {
+				t.Fatalf("%d pieces of evidence, want %d", len(hc.evidence), test.evidence)
+			}
+			for _, ev := range hc.evidence {
+				if err := ev.verify(4, keys[1]); err != nil {
+					t.Errorf("evidence rejected: %s", err)
+				}
+			}
+		})
+	}
+}
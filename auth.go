@@ -0,0 +1,265 @@
+package hotstuff
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+)
+
+// SigningKeys holds the key a node signs its messages with and the public
+// keys of every replica and client, indexed by id. Operators are the
+// clients allowed to change the replica set. Replicas may also hold a
+// share of a group threshold key from a DKG, which nothing uses yet.
+type SigningKeys struct {
+	Private   ed25519.PrivateKey
+	Replicas  []ed25519.PublicKey
+	Clients   []ed25519.PublicKey
+	Operators []int
+	Threshold *ThresholdKey
+}
+
+// isOperator reports whether client may reconfigure the cluster. Without
+// keys nobody can prove who sent a request, so nobody may.
+func (keys *SigningKeys) isOperator(client int) bool {
+	if keys == nil {
+		return false
+	}
+	for _, id := range keys.Operators {
+		if id == client {
+			return true
+		}
+	}
+	return false
+}
+
+// signable is a message carrying the signature of the node that sent it.
+type signable interface {
+	digest() []byte
+	signer() peerIdentity
+	signature() []byte
+	setSignature(sig []byte)
+}
+
+type digestWriter struct {
+	h hash.Hash
+}
+
+func newDigest(kind string) *digestWriter {
+	d := &digestWriter{sha256.New()}
+	d.str(kind)
+	return d
+}
+
+func (d *digestWriter) int(v int) {
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], uint64(int64(v)))
+	d.h.Write(buf[:])
+}
+
+func (d *digestWriter) str(s string) {
+	d.int(len(s))
+	d.h.Write([]byte(s))
+}
+
+func (d *digestWriter) qc(qc QC) {
+	d.int(qc.Epoch)
+	d.int(qc.ViewId)
+	d.str(qc.NodeId)
+	d.str(string(qc.NodeHash))
+}
+
+// request covers the client signature too, so a node commits to exactly
+// the request the client signed.
+func (d *digestWriter) request(r *RequestArgs) {
+	d.str(fmt.Sprint(r.Operation))
+	d.int(int(r.Timestamp))
+	d.int(r.ClientId)
+	d.str(string(r.Sig))
+}
+
+func (d *digestWriter) node(n *LogNode) {
+	d.str(n.Id)
+	d.str(n.Parent)
+	d.int(n.Epoch)
+	d.int(n.ViewId)
+	d.request(&n.Request)
+	d.qc(n.Justify)
+}
+
+// newView covers a new-view message a certificate carries, signature
+// included.
+func (d *digestWriter) newView(args *NewViewArgs) {
+	d.int(args.RepId)
+	d.int(args.Epoch)
+	d.int(args.ViewId)
+	d.qc(args.QC)
+	d.str(string(args.Sig))
+}
+
+// hash is the digest of the whole node, which tells apart nodes a leader
+// gave the same id.
+func (n *LogNode) hash() []byte {
+	d := newDigest("node")
+	d.node(n)
+	return d.sum()
+}
+
+func (d *digestWriter) sum() []byte {
+	return d.h.Sum(nil)
+}
+
+func (args *ProposalArgs) digest() []byte {
+	d := newDigest("proposal")
+	d.int(args.RepId)
+	d.int(args.Epoch)
+	d.int(args.ViewId)
+	d.node(&args.Node)
+	d.int(args.TC.ViewId)
+	d.int(len(args.TC.NewViews))
+	for i := range args.TC.NewViews {
+		d.newView(&args.TC.NewViews[i])
+	}
+	d.int(args.AggQC.ViewId)
+	d.int(len(args.AggQC.NewViews))
+	for i := range args.AggQC.NewViews {
+		d.newView(&args.AggQC.NewViews[i])
+	}
+	return d.sum()
+}
+
+func (args *RequestArgs) digest() []byte {
+	d := newDigest("request")
+	d.str(fmt.Sprint(args.Operation))
+	d.int(int(args.Timestamp))
+	d.int(args.ClientId)
+	return d.sum()
+}
+
+func (args *RequestArgs) signer() peerIdentity    { return peerIdentity{true, args.ClientId} }
+func (args *RequestArgs) signature() []byte       { return args.Sig }
+func (args *RequestArgs) setSignature(sig []byte) { args.Sig = sig }
+
+func (args *ProposalArgs) signer() peerIdentity    { return peerIdentity{false, args.RepId} }
+func (args *ProposalArgs) signature() []byte       { return args.Sig }
+func (args *ProposalArgs) setSignature(sig []byte) { args.Sig = sig }
+
+func (args *VoteArgs) digest() []byte {
+	d := newDigest("vote")
+	d.int(args.RepId)
+	d.int(args.Epoch)
+	d.int(args.ViewId)
+	d.str(args.NodeId)
+	d.int(args.NodeView)
+	d.str(string(args.NodeHash))
+	return d.sum()
+}
+
+func (args *VoteArgs) signer() peerIdentity    { return peerIdentity{false, args.RepId} }
+func (args *VoteArgs) signature() []byte       { return args.Sig }
+func (args *VoteArgs) setSignature(sig []byte) { args.Sig = sig }
+
+func (args *NewViewArgs) digest() []byte {
+	d := newDigest("newview")
+	d.int(args.RepId)
+	d.int(args.Epoch)
+	d.int(args.ViewId)
+	d.qc(args.QC)
+	return d.sum()
+}
+
+func (args *NewViewArgs) signer() peerIdentity    { return peerIdentity{false, args.RepId} }
+func (args *NewViewArgs) signature() []byte       { return args.Sig }
+func (args *NewViewArgs) setSignature(sig []byte) { args.Sig = sig }
+
+func (args *ReplyArgs) digest() []byte {
+	d := newDigest("reply")
+	d.int(args.ViewId)
+	d.int(int(args.Timestamp))
+	d.int(args.ReplicaId)
+	d.int(args.ClientId)
+	d.int(args.Epoch)
+	d.str(fmt.Sprint(args.Members))
+	d.str(fmt.Sprint(args.Weights))
+	d.str(fmt.Sprint(args.Result))
+	return d.sum()
+}
+
+func (args *ReplyArgs) signer() peerIdentity    { return peerIdentity{false, args.ReplicaId} }
+func (args *ReplyArgs) signature() []byte       { return args.Sig }
+func (args *ReplyArgs) setSignature(sig []byte) { args.Sig = sig }
+
+// sign does nothing when the node runs without keys.
+func (keys *SigningKeys) sign(msg signable) {
+	if keys == nil {
+		return
+	}
+	msg.setSignature(ed25519.Sign(keys.Private, msg.digest()))
+}
+
+func (keys *SigningKeys) verify(msg signable) error {
+	if keys == nil {
+		return nil
+	}
+
+	signer := msg.signer()
+	name := identityName(signer.client, signer.id)
+	pubs := keys.Replicas
+	if signer.client {
+		pubs = keys.Clients
+	}
+	if signer.id < 0 || signer.id >= len(pubs) || len(pubs[signer.id]) != ed25519.PublicKeySize {
+		return fmt.Errorf("auth: no key for %s", name)
+	}
+	if len(msg.signature()) != ed25519.SignatureSize {
+		return fmt.Errorf("auth: unsigned message from %s", name)
+	}
+	if !ed25519.Verify(pubs[signer.id], msg.digest(), msg.signature()) {
+		return fmt.Errorf("auth: bad signature from %s", name)
+	}
+	return nil
+}
+
+func generateKeyPairs(n int) ([]ed25519.PrivateKey, []ed25519.PublicKey, error) {
+	privates := make([]ed25519.PrivateKey, n)
+	publics := make([]ed25519.PublicKey, n)
+	for i := 0; i < n; i++ {
+		pub, priv, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, nil, err
+		}
+		privates[i] = priv
+		publics[i] = pub
+	}
+	return privates, publics, nil
+}
+
+// GenerateSigningKeys creates a fresh key pair for each replica and client
+// and returns the keys every replica and every client should run with.
+func GenerateSigningKeys(replicas, clients int) ([]*SigningKeys, []*SigningKeys, error) {
+	if replicas < 1 {
+		return nil, nil, errors.New("auth: need at least one replica")
+	}
+
+	replicaPrivates, replicaPublics, err := generateKeyPairs(replicas)
+	if err != nil {
+		return nil, nil, err
+	}
+	clientPrivates, clientPublics, err := generateKeyPairs(clients)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	replicaKeys := make([]*SigningKeys, replicas)
+	for i := range replicaKeys {
+		replicaKeys[i] = &SigningKeys{replicaPrivates[i], replicaPublics, clientPublics, nil, nil}
+	}
+	clientKeys := make([]*SigningKeys, clients)
+	for i := range clientKeys {
+		clientKeys[i] = &SigningKeys{clientPrivates[i], replicaPublics, clientPublics, nil, nil}
+	}
+	return replicaKeys, clientKeys, nil
+}
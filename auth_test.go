@@ -0,0 +1,78 @@
+package hotstuff
+
+import (
+	"testing"
+)
+
+// A message counts only with the signature of the node it names, over
+// exactly the fields it carries; the HotStuff endpoints drop the rest and
+// count them.
+func TestVerifySignature(t *testing.T) {
+	keys, clientKeys, err := GenerateSigningKeys(4, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	vote := func(repId int, signer *SigningKeys) *VoteArgs {
+		args := &VoteArgs{}
+		args.RepId = repId
+		args.ViewId = 3
+		args.NodeId = "n"
+		args.NodeView = 2
+		signer.sign(args)
+		return args
+	}
+	tampered := vote(1, keys[1])
+	tampered.NodeId = "m"
+	unsigned := vote(1, keys[1])
+	unsigned.Sig = nil
+	request := &RequestArgs{Operation: "x", Timestamp: 100, ClientId: 0}
+	clientKeys[0].sign(request)
+
+	tests := []struct {
+		name string
+		msg  signable
+		ok   bool
+	}{
+		{"valid vote", vote(1, keys[1]), true},
+		{"valid request", request, true},
+		{"tampered field", tampered, false},
+		{"signed by another replica", vote(1, keys[2]), false},
+		{"signed by a client", vote(0, clientKeys[0]), false},
+		{"unsigned", unsigned, false},
+		{"unknown replica", vote(4, keys[1]), false},
+		{"negative id", vote(-1, keys[1]), false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if err := keys[0].verify(test.msg); (err == nil) != test.ok {
+				t.Errorf("error %v, want ok %v", err, test.ok)
+			}
+			if test.ok {
+				return
+			}
+			args, ok := test.msg.(*VoteArgs)
+			if !ok {
+				return
+			}
+			hs := makeHotStuff(0, make([]caller, 4), make([]caller, 1), ThreeChainMode, keys[0], makeLogger(ErrorLevel+1))
+			reply := &DefaultReply{}
+			hs.Vote(args, reply)
+			if reply.Err == "" || hs.authFailures != 1 {
+				t.Errorf("vote accepted with %d auth failures", hs.authFailures)
+			}
+		})
+	}
+}
+
+// Without keys the cluster only tolerates crashes and takes every message.
+func TestVerifyWithoutKeys(t *testing.T) {
+	var keys *SigningKeys
+	args := &VoteArgs{RepId: 1}
+	keys.sign(args)
+	if args.Sig != nil {
+		t.Errorf("signed without keys")
+	}
+	if err := keys.verify(args); err != nil {
+		t.Errorf("unsigned vote rejected without keys: %v", err)
+	}
+}
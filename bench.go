@@ -0,0 +1,233 @@
+package hotstuff
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Bench is a load of requests sent by virtual clients. With a Rate the
+// clients take turns sending Rate requests a second between them, whether
+// earlier ones were answered or not; without one every client sends its
+// next request once the last was accepted or timed out.
+//
+// A request commits a few views after it is proposed, and a leader with no
+// request waiting fills its view with a noop only once its noop timeout
+// expires. Under a light load the latency is thus mostly noop timeouts,
+// and a bench of protocol speed needs a short one.
+type Bench struct {
+	Rate     float64
+	Duration time.Duration
+	Timeout  time.Duration
+}
+
+// BenchReport counts the requests sent during a run and how they ended.
+// Seconds run until the last request ended, and throughput is over them.
+// Latencies are in milliseconds, from sending a request to accepting its
+// result.
+type BenchReport struct {
+	Clients    int          `json:"clients"`
+	Rate       float64      `json:"rate"`
+	Seconds    float64      `json:"seconds"`
+	Sent       int          `json:"sent"`
+	Committed  int          `json:"committed"`
+	Timeouts   int          `json:"timeouts"`
+	Throughput float64      `json:"throughput"`
+	Latency    BenchLatency `json:"latency"`
+}
+
+type BenchLatency struct {
+	Mean float64 `json:"mean"`
+	P50  float64 `json:"p50"`
+	P95  float64 `json:"p95"`
+	P99  float64 `json:"p99"`
+	Max  float64 `json:"max"`
+}
+
+func (r *BenchReport) String() string {
+	load := "closed loop"
+	if r.Rate > 0 {
+		load = fmt.Sprintf("%.1f req/s", r.Rate)
+	}
+	msg := fmt.Sprintf("Bench: %d clients, %s, %.1fs\n", r.Clients, load, r.Seconds)
+	msg += fmt.Sprintf("    sent:       %d\n", r.Sent)
+	msg += fmt.Sprintf("    committed:  %d\n", r.Committed)
+	msg += fmt.Sprintf("    timeouts:   %d\n", r.Timeouts)
+	msg += fmt.Sprintf("    throughput: %.1f req/s\n", r.Throughput)
+	l := r.Latency
+	msg += fmt.Sprintf("    latency:    mean %.1fms p50 %.1fms p95 %.1fms p99 %.1fms max %.1fms\n", l.Mean, l.P50, l.P95, l.P99, l.Max)
+	return msg
+}
+
+// percentile is the nearest-rank percentile p of the sorted latencies.
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	i := int(math.Ceil(p*float64(len(sorted)))) - 1
+	if i < 0 {
+		i = 0
+	}
+	return sorted[i]
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// benchClient waits for the results of the requests of one virtual
+// client.
+type benchClient struct {
+	mu      *sync.Mutex
+	client  *Client
+	waiting map[int64]chan time.Duration
+}
+
+func (bc *benchClient) accepted(timestamp int64, latency time.Duration) {
+	bc.mu.Lock()
+	defer bc.mu.Unlock()
+	if ch := bc.waiting[timestamp]; ch != nil {
+		ch <- latency
+		delete(bc.waiting, timestamp)
+	}
+}
+
+// do sends op and returns the latency of its result, or false when none
+// was accepted within timeout.
+func (bc *benchClient) do(op string, timeout time.Duration) (time.Duration, bool) {
+	args := bc.client.makeRequest(op)
+	ch := make(chan time.Duration, 1)
+	bc.mu.Lock()
+	bc.waiting[args.Timestamp] = ch
+	bc.mu.Unlock()
+	bc.client.sendRequest(args)
+
+	select {
+	case latency := <-ch:
+		return latency, true
+	case <-time.After(timeout):
+		bc.mu.Lock()
+		delete(bc.waiting, args.Timestamp)
+		bc.mu.Unlock()
+		return 0, false
+	}
+}
+
+func makeBenchClient(c *Client) *benchClient {
+	bc := &benchClient{}
+	bc.mu = &sync.Mutex{}
+	bc.client = c
+	bc.waiting = make(map[int64]chan time.Duration)
+	c.mu.Lock()
+	c.onAccept = bc.accepted
+	c.mu.Unlock()
+	return bc
+}
+
+// benchResults collects the outcome of every request.
+type benchResults struct {
+	mu        *sync.Mutex
+	latencies []time.Duration
+	timeouts  int
+}
+
+func (br *benchResults) add(latency time.Duration, ok bool) {
+	br.mu.Lock()
+	defer br.mu.Unlock()
+	if ok {
+		br.latencies = append(br.latencies, latency)
+	} else {
+		br.timeouts++
+	}
+}
+
+// RunBench sends the load of b through clients, already connected to a
+// cluster, and waits for the last requests to end before reporting.
+func RunBench(b *Bench, clients []*Client) (*BenchReport, error) {
+	if len(clients) == 0 {
+		return nil, errors.New("no clients to send requests")
+	}
+	if b.Duration <= 0 || b.Timeout <= 0 {
+		return nil, errors.New("duration and timeout must be positive")
+	}
+	if b.Rate < 0 {
+		return nil, errors.New("rate must not be negative")
+	}
+
+	bcs := make([]*benchClient, len(clients))
+	for i, c := range clients {
+		bcs[i] = makeBenchClient(c)
+	}
+	results := &benchResults{}
+	results.mu = &sync.Mutex{}
+	wg := &sync.WaitGroup{}
+	start := time.Now()
+	end := start.Add(b.Duration)
+	if b.Rate > 0 {
+		interval := time.Duration(float64(time.Second) / b.Rate)
+		for seq := 0; time.Now().Before(end); seq++ {
+			bc := bcs[seq%len(bcs)]
+			op := fmt.Sprintf("bench-%d-%d", bc.client.me, seq)
+			wg.Add(1)
+			go func() {
+				results.add(bc.do(op, b.Timeout))
+				wg.Done()
+			}()
+			time.Sleep(time.Until(start.Add(time.Duration(seq+1) * interval)))
+		}
+	} else {
+		for _, bc := range bcs {
+			wg.Add(1)
+			go func(bc *benchClient) {
+				for seq := 0; time.Now().Before(end); seq++ {
+					results.add(bc.do(fmt.Sprintf("bench-%d-%d", bc.client.me, seq), b.Timeout))
+				}
+				wg.Done()
+			}(bc)
+		}
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+
+	sorted := results.latencies
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	var total time.Duration
+	for _, latency := range sorted {
+		total += latency
+	}
+
+	report := &BenchReport{}
+	report.Clients = len(clients)
+	report.Rate = b.Rate
+	report.Seconds = elapsed.Seconds()
+	report.Committed = len(sorted)
+	report.Timeouts = results.timeouts
+	report.Sent = report.Committed + report.Timeouts
+	report.Throughput = float64(report.Committed) / elapsed.Seconds()
+	if len(sorted) > 0 {
+		report.Latency.Mean = milliseconds(total / time.Duration(len(sorted)))
+		report.Latency.P50 = milliseconds(percentile(sorted, 0.50))
+		report.Latency.P95 = milliseconds(percentile(sorted, 0.95))
+		report.Latency.P99 = milliseconds(percentile(sorted, 0.99))
+		report.Latency.Max = milliseconds(sorted[len(sorted)-1])
+	}
+	return report, nil
+}
+
+// RunLocalBench runs b against an in-process cluster of replicas, one
+// virtual client for each of clients. The replicas use the given view and
+// noop timeouts, ViewTimeOut and NoopTimeOut when zero.
+func RunLocalBench(b *Bench, replicas, clients int, protocol ProtocolMode, viewTimeout, noopTimeout time.Duration) (*BenchReport, error) {
+	if replicas < 1 || clients < 1 {
+		return nil, errors.New("replicas and clients must be positive")
+	}
+	lc, err := makeLocalCluster(replicas, clients, protocol, viewTimeout, noopTimeout, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer lc.stop()
+	return RunBench(b, lc.clients)
+}
@@ -1,43 +1,111 @@
 package hotstuff
 
 import (
+	"context"
 	"fmt"
 	"sync"
 	"time"
 )
 
+// clientReply is what a replica answered and in which epoch.
+type clientReply struct {
+	epoch  int
+	result string
+}
+
 // save operation as string
 type Client struct {
-	mu       *sync.Mutex
-	me       int
-	n        int
-	f        int
-	peers    []peerWrapper
-	requests map[int64]string
-	replies  map[int64]map[int]string
+	mu *sync.Mutex
+	me int
+	// validators of the latest epoch the client knows of; requests still
+	// go to the replicas it started with
+	validators *validatorSet
+	// the last reply of each member of validators telling of a later epoch
+	epochReports map[int]*ReplyArgs
+	peers        []*outbox
+	requests     map[int64]string
+	replies      map[int64]map[int]clientReply
+	keys         *SigningKeys
+	authFailures int
+	metrics      *metricsRegistry
+
+	logger *Logger
+	tracer *Tracer
+	// the span of each traced request until its result is accepted
+	spans map[int64]*Span
+	// onAccept, when set, learns the latency of every accepted request
+	onAccept func(timestamp int64, latency time.Duration)
 
-	debugCh chan interface{}
+	life *lifecycle
+}
+
+// Start runs the outboxes, which send the requests made so far and those
+// to come.
+func (c *Client) Start() error {
+	return c.life.start(func() {
+		for _, o := range c.peers {
+			o.start(c.life)
+		}
+	})
+}
+
+// Stop closes the listeners of the client and ends its outboxes, then
+// writes out its log and trace. It returns when all that is done or ctx
+// is, whichever comes first.
+func (c *Client) Stop(ctx context.Context) error {
+	return c.life.stop(ctx)
+}
+
+// flush ends the spans of the requests still waiting for a result, then
+// the log and trace.
+func (c *Client) flush() error {
+	c.mu.Lock()
+	for timestamp, span := range c.spans {
+		span.set("stopped", true)
+		span.end()
+		delete(c.spans, timestamp)
+	}
+	c.mu.Unlock()
+	c.logger.close()
+	return c.tracer.close()
 }
 
 func (c *Client) broadcast(rpcname string, rpcargs interface{}) {
-	reply := &DefaultReply{}
 	for _, peer := range c.peers {
-		p := peer
-		go p.Call("HotStuff."+rpcname, rpcargs, reply)
+		peer.send("HotStuff."+rpcname, rpcargs)
 	}
 }
 
 func (c *Client) newRequest(command string) {
+	c.sendRequest(c.makeRequest(command))
+}
+
+// makeRequest and sendRequest are newRequest in two steps, so the caller
+// knows the timestamp of a request before a reply to it can arrive.
+func (c *Client) makeRequest(command string) *RequestArgs {
 	requestArgs := &RequestArgs{}
 	requestArgs.ClientId = c.me
 	requestArgs.Operation = command
-	requestArgs.Timestamp = time.Now().Unix()
+	requestArgs.Timestamp = time.Now().UnixNano()
+	c.keys.sign(requestArgs)
+	return requestArgs
+}
 
+func (c *Client) sendRequest(requestArgs *RequestArgs) {
+	command := requestArgs.Operation.(string)
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
-	c.replies[requestArgs.Timestamp] = make(map[int]string)
+	if c.tracer != nil {
+		requestArgs.Trace = newTraceContext()
+		span := c.tracer.start("request", SpanKindClient, requestArgs.Trace, SpanContext{}, "command", command)
+		span.Start = time.Unix(0, requestArgs.Timestamp)
+		c.spans[requestArgs.Timestamp] = span
+	}
+
+	c.replies[requestArgs.Timestamp] = make(map[int]clientReply)
 	c.requests[requestArgs.Timestamp] = command
+	c.metrics.add("hotstuff_client_requests_total", 1)
 	c.broadcast("Request", requestArgs)
 }
 
@@ -47,29 +115,70 @@ func (c *Client) saveReply(replyArgs *ReplyArgs) {
 		return
 	}
 
-	c.replies[timestamp][replyArgs.ReplicaId] = replyArgs.Result.(string)
+	result, ok := replyArgs.Result.(string)
+	if !ok {
+		return
+	}
+	c.replies[timestamp][replyArgs.ReplicaId] = clientReply{replyArgs.Epoch, result}
 }
 
+// learnEpoch moves the client on to the validators of a later epoch once
+// members of its epoch holding more than a third of the weight, one of
+// them at least honest, reported the same ones. It reports whether the
+// client moved.
+func (c *Client) learnEpoch(args *ReplyArgs) bool {
+	if args.Epoch <= c.validators.epoch || !c.validators.contains(args.ReplicaId) || len(args.Members) == 0 || len(args.Members) != len(args.Weights) {
+		return false
+	}
+	c.epochReports[args.ReplicaId] = args
+
+	key := func(r *ReplyArgs) string { return fmt.Sprint(r.Epoch, r.Members, r.Weights) }
+	var agreed []int
+	for repId, r := range c.epochReports {
+		if key(r) == key(args) {
+			agreed = append(agreed, repId)
+		}
+	}
+	if !c.validators.hasSupport(agreed) {
+		return false
+	}
+
+	maxId := 0
+	for _, member := range args.Members {
+		if member > maxId {
+			maxId = member
+		}
+	}
+	weights := make([]int, maxId+1)
+	for i, member := range args.Members {
+		weights[member] = args.Weights[i]
+	}
+	c.validators = makeValidatorSet(args.Epoch, 0, args.Members, weights, false)
+	c.epochReports = make(map[int]*ReplyArgs)
+	c.logger.log(InfoLevel, "epoch_change", "Epoch change", "validators", c.validators.String())
+	return true
+}
+
+// processReplies accepts a result once members of the client's epoch
+// holding more than a third of the weight returned it, so at least one of
+// them is honest. Replies of other epochs do not count.
 func (c *Client) processReplies(timestamp int64) {
 	replies := c.replies[timestamp]
-	if replies == nil || len(replies) <= c.f {
+	if replies == nil {
 		return
 	}
 
-	resultMap := make(map[string]int)
-	maxCnt := 0
-	maxResult := ""
-	for _, result := range replies {
-		resultMap[result]++
-		if resultMap[result] > maxCnt {
-			maxCnt = resultMap[result]
-			maxResult = result
+	byResult := make(map[string][]int)
+	for replicaId, reply := range replies {
+		if reply.epoch == c.validators.epoch {
+			byResult[reply.result] = append(byResult[reply.result], replicaId)
 		}
 	}
-
-	if maxCnt > c.f {
-		// accept Reply
-		c.acceptReply(timestamp, maxResult)
+	for result, ids := range byResult {
+		if c.validators.hasSupport(ids) {
+			c.acceptReply(timestamp, result)
+			return
+		}
 	}
 }
 
@@ -78,29 +187,71 @@ func (c *Client) acceptReply(timestamp int64, result string) {
 		return
 	}
 
-	// output the result
+	// the timestamp is the time the request was sent
+	latency := time.Since(time.Unix(0, timestamp))
 	command := c.requests[timestamp]
-	msg := fmt.Sprintf("Client [%d]: Command[%s] got Result[%s]\n", c.me, command, result)
-	c.debugPrint(msg)
+	c.logger.log(InfoLevel, "result_accepted", "Command got Result", "command", command, "result", result, "latency", latency)
+	c.metrics.add("hotstuff_client_accepted_total", 1)
+	c.metrics.observe("hotstuff_client_request_latency_seconds", latency.Seconds())
+	if span := c.spans[timestamp]; span != nil {
+		span.set("result", result)
+		span.end()
+		delete(c.spans, timestamp)
+	}
+	if c.onAccept != nil {
+		c.onAccept(timestamp, latency)
+	}
 
 	delete(c.requests, timestamp)
 	delete(c.replies, timestamp)
 }
 
-func (c *Client) debugPrint(msg string) {
-	c.debugCh <- msg
+func (c *Client) getClientInfo() map[string]interface{} {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	info := make(map[string]interface{})
+	info["id"] = c.me
+	info["replicas"] = len(c.peers)
+	info["epoch"] = c.validators.epoch
+	info["pending"] = len(c.requests)
+	info["authFailures"] = c.authFailures
+	info["logDropped"] = int(c.logger.Dropped())
+	return info
+}
+
+func (c *Client) observeCall(id int, method string, err error) {
+	peer := identityName(false, id)
+	c.metrics.add("hotstuff_client_messages_sent_total", 1, "peer", peer, "method", methodName(method))
+	if err != nil {
+		c.metrics.add("hotstuff_client_rpc_errors_total", 1, "peer", peer)
+	}
 }
 
-func MakeClient(id int, peers []peerWrapper, ch chan interface{}) *Client {
+// MakeClient starts a client that logs every entry to ch.
+func MakeClient(id int, peers []caller, keys *SigningKeys, ch chan interface{}) *Client {
+	c := makeClient(id, peers, keys, makeLogger(DebugLevel, ch).with("client", id))
+	c.Start()
+	return c
+}
+
+func makeClient(id int, peers []caller, keys *SigningKeys, logger *Logger) *Client {
 	c := &Client{}
 	c.mu = &sync.Mutex{}
 	c.me = id
-	c.peers = peers
+	c.metrics = makeClientMetrics()
+	c.peers = makeOutboxes(peers, c.observeCall)
+	members := make([]int, len(peers))
+	for i := range members {
+		members[i] = i
+	}
+	c.validators = makeValidatorSet(0, 0, members, nil, false)
+	c.epochReports = make(map[int]*ReplyArgs)
 	c.requests = make(map[int64]string)
-	c.replies = make(map[int64]map[int]string)
-	c.debugCh = ch
-	c.n = len(c.peers)
-	c.f = (c.n - 1) / 3
+	c.replies = make(map[int64]map[int]clientReply)
+	c.spans = make(map[int64]*Span)
+	c.keys = keys
+	c.logger = logger
+	c.life = makeLifecycle(c.flush)
 
 	return c
 }
@@ -0,0 +1,101 @@
+package hotstuff
+
+import (
+	"testing"
+)
+
+// A client takes only replies signed for itself, and drops results that
+// are not strings instead of failing on them.
+func TestClientReply(t *testing.T) {
+	keys, clientKeys, err := GenerateSigningKeys(4, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reply := func(clientId int, result interface{}) *ReplyArgs {
+		args := &ReplyArgs{}
+		args.Timestamp = 100
+		args.ReplicaId = 1
+		args.ClientId = clientId
+		args.Result = result
+		keys[1].sign(args)
+		return args
+	}
+
+	tests := []struct {
+		name         string
+		args         *ReplyArgs
+		saved        bool
+		authFailures int
+	}{
+		{"reply for the client", reply(0, "x"), true, 0},
+		{"reply for another client", reply(1, "x"), false, 1},
+		{"result not a string", reply(0, 42), false, 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c := makeClient(0, make([]caller, 4), clientKeys[0], makeLogger(ErrorLevel+1))
+			c.replies[100] = make(map[int]clientReply)
+			c.requests[100] = "x"
+			c.Reply(test.args, &DefaultReply{})
+			if _, saved := c.replies[100][1]; saved != test.saved {
+				t.Errorf("reply saved %v, want %v", saved, test.saved)
+			}
+			if c.authFailures != test.authFailures {
+				t.Errorf("%d auth failures, want %d", c.authFailures, test.authFailures)
+			}
+		})
+	}
+}
+
+// A client takes the validators of a later epoch from members of its own
+// epoch, and counts only the replies of its epoch.
+func TestClientEpoch(t *testing.T) {
+	keys, clientKeys, err := GenerateSigningKeys(4, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reply := func(replicaId, epoch int, members []int) *ReplyArgs {
+		args := &ReplyArgs{}
+		args.Timestamp = 100
+		args.ReplicaId = replicaId
+		args.Epoch = epoch
+		args.Members = members
+		args.Weights = make([]int, len(members))
+		for i := range args.Weights {
+			args.Weights[i] = 1
+		}
+		args.Result = "x"
+		keys[replicaId].sign(args)
+		return args
+	}
+	removed := []int{0, 1, 2}
+
+	tests := []struct {
+		name     string
+		replies  []*ReplyArgs
+		epoch    int
+		accepted bool
+	}{
+		{"same epoch", []*ReplyArgs{reply(0, 0, []int{0, 1, 2, 3}), reply(1, 0, []int{0, 1, 2, 3})}, 0, true},
+		{"one member reports an epoch", []*ReplyArgs{reply(0, 1, removed)}, 0, false},
+		{"members agree on an epoch", []*ReplyArgs{reply(0, 1, removed), reply(1, 1, removed)}, 1, true},
+		{"members disagree on an epoch", []*ReplyArgs{reply(0, 1, removed), reply(1, 1, []int{0, 1, 3})}, 0, false},
+		{"replies of a later epoch do not count", []*ReplyArgs{reply(0, 1, removed), reply(2, 0, []int{0, 1, 2, 3})}, 0, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c := makeClient(0, make([]caller, 4), clientKeys[0], makeLogger(ErrorLevel+1))
+			c.replies[100] = make(map[int]clientReply)
+			c.requests[100] = "x"
+			for _, args := range test.replies {
+				c.Reply(args, &DefaultReply{})
+			}
+			if c.validators.epoch != test.epoch {
+				t.Errorf("epoch %d, want %d", c.validators.epoch, test.epoch)
+			}
+			if accepted := c.requests[100] == ""; accepted != test.accepted {
+				t.Errorf("accepted %v, want %v", accepted, test.accepted)
+			}
+		})
+	}
+}
@@ -1,46 +1,15 @@
 package hotstuff
 
 import (
+	"errors"
+	"fmt"
 	"strconv"
-	"time"
 )
 
-type TimerWithCancel struct {
-	d time.Duration
-	t *time.Timer
-	c chan interface{}
-	f func()
-}
-
-func NewTimerWithCancel(d time.Duration) *TimerWithCancel {
-	t := &TimerWithCancel{}
-	t.d = d
-	t.c = make(chan interface{})
-	return t
-}
-
-func (t *TimerWithCancel) Start() {
-	t.t = time.NewTimer(t.d)
-	go func() {
-		select {
-		case <-t.t.C:
-			t.f()
-		case <-t.c:
-		}
-	}()
-}
-
-func (t *TimerWithCancel) SetTimeout(f func()) {
-	t.f = f
-}
-
-func (t *TimerWithCancel) Cancel() {
-	t.c <- nil
-}
-
 type LogNode struct {
 	Id      string
 	Parent  string
+	Epoch   int
 	ViewId  int
 	Request RequestArgs
 	Justify QC
@@ -56,37 +25,162 @@ func getLogNodeId(viewId int, request *RequestArgs) string {
 	return s
 }
 
+// QC certifies NodeId with votes of the members of Epoch. It counts for
+// nothing once the epoch has changed. Votes are the signed votes of a
+// quorum for the node with digest NodeHash, so replicas can check a QC
+// they did not form; without signing keys they prove nothing.
 type QC struct {
-	ViewId int
-	NodeId string
-	//TODO: threshold signatures
+	Epoch    int
+	ViewId   int
+	NodeId   string
+	NodeHash []byte
+	Votes    []VoteArgs
+}
+
+// TC is a timeout certificate: n-f replicas gave up on ViewId. It carries
+// their signed new-view messages, each with the highest QC its sender had
+// seen, so the leader forming it cannot make up what they reported.
+type TC struct {
+	ViewId   int
+	NewViews []NewViewArgs
+}
+
+func (tc *TC) maxHighQCView() int {
+	max := 0
+	for _, msg := range tc.NewViews {
+		if msg.QC.ViewId > max {
+			max = msg.QC.ViewId
+		}
+	}
+	return max
+}
+
+// AggQC carries the n-f signed new-view messages a leader collected, so
+// replicas can check that a proposal extends the highest QC in them.
+type AggQC struct {
+	ViewId   int
+	NewViews []NewViewArgs
+}
+
+func (aggQC *AggQC) highQC() QC {
+	highQC := QC{}
+	for _, msg := range aggQC.NewViews {
+		if msg.QC.ViewId > highQC.ViewId {
+			highQC = msg.QC
+		}
+	}
+	return highQC
 }
 
 type DefaultReply struct {
 	Err string
 }
 
+// RequestArgs with a zero Timestamp are made up by the replicas themselves
+// (noop and dummy nodes) and belong to no client. Trace, when set, is the
+// span of the request at the client; the spans of every replica hang off
+// it.
 type RequestArgs struct {
 	Operation interface{}
 	Timestamp int64
 	ClientId  int
+	Sig       []byte
+	Trace     SpanContext
+}
+
+// requestKey identifies a client request. The requests of the replicas
+// themselves all share the zero key.
+type requestKey struct {
+	clientId  int
+	timestamp int64
 }
 
+func (args *RequestArgs) key() requestKey {
+	return requestKey{args.ClientId, args.Timestamp}
+}
+
+// ReplyArgs answers the request ClientId sent at Timestamp. Epoch is the
+// epoch the replica executed it in, Members and Weights the validators of
+// that epoch and their weights, so clients follow reconfigurations.
 type ReplyArgs struct {
 	ViewId    int
 	Timestamp int64
 	ReplicaId int
+	ClientId  int
+	Epoch     int
+	Members   []int
+	Weights   []int
 	Result    interface{}
+	Sig       []byte
+	Trace     SpanContext
 }
 
-type MsgArgs struct {
+// ProposalArgs is sent by the leader of ViewId to every replica.
+type ProposalArgs struct {
 	RepId  int
+	Epoch  int
 	ViewId int
 	Node   LogNode
+	TC     TC
+	AggQC  AggQC
+	Sig    []byte
+	Trace  SpanContext
+}
+
+func (args *ProposalArgs) validate(n int) error {
+	if args.RepId < 0 || args.RepId >= n {
+		return fmt.Errorf("Proposal from unknown replica[%d]", args.RepId)
+	}
+	if args.Node.Id == "" || args.Node.ViewId != args.ViewId || args.Node.Epoch != args.Epoch {
+		return fmt.Errorf("Proposal with invalid node[%s] view[%d]", args.Node.Id, args.Node.ViewId)
+	}
+	if args.Node.Justify.ViewId >= args.ViewId || args.Node.Justify.Epoch > args.Epoch {
+		return fmt.Errorf("Proposal justified by future qc view[%d]", args.Node.Justify.ViewId)
+	}
+	return nil
+}
+
+// VoteArgs is sent to the next leader by a replica that accepted a proposal.
+// NodeHash is the digest of the whole node, as node ids only name the view
+// and operation.
+type VoteArgs struct {
+	RepId    int
+	Epoch    int
+	ViewId   int
+	NodeId   string
+	NodeView int
+	NodeHash []byte
+	Sig      []byte
+	Trace    SpanContext
+}
+
+func (args *VoteArgs) validate(n int) error {
+	if args.RepId < 0 || args.RepId >= n {
+		return fmt.Errorf("Vote from unknown replica[%d]", args.RepId)
+	}
+	if args.NodeId == "" || args.NodeView > args.ViewId || len(args.NodeHash) == 0 {
+		return fmt.Errorf("Vote for invalid node[%s] view[%d]", args.NodeId, args.NodeView)
+	}
+	return nil
+}
+
+// NewViewArgs is sent to the next leader by a replica whose view timed out.
+type NewViewArgs struct {
+	RepId  int
+	Epoch  int
+	ViewId int
 	QC     QC
-	// just a mark for partial signature
-	// TODO: implement partial signature
-	ParSig bool
+	Sig    []byte
+}
+
+func (args *NewViewArgs) validate(n int) error {
+	if args.RepId < 0 || args.RepId >= n {
+		return fmt.Errorf("NewView from unknown replica[%d]", args.RepId)
+	}
+	if args.QC.ViewId > args.ViewId || args.QC.Epoch > args.Epoch {
+		return fmt.Errorf("NewView with future qc view[%d]", args.QC.ViewId)
+	}
+	return nil
 }
 
 type MaliciousBehaviorMode int
@@ -97,3 +191,33 @@ const (
 	MaliciousMode
 	PartialMaliciousMode
 )
+
+type ProtocolMode int
+
+const (
+	ThreeChainMode = iota
+	TwoChainMode
+	FastHotStuffMode
+)
+
+func ParseProtocolMode(name string) (ProtocolMode, error) {
+	switch name {
+	case "", "three-chain":
+		return ThreeChainMode, nil
+	case "two-chain":
+		return TwoChainMode, nil
+	case "fast-hotstuff":
+		return FastHotStuffMode, nil
+	}
+	return ThreeChainMode, errors.New("Invalid protocol mode: " + name)
+}
+
+func (m ProtocolMode) String() string {
+	switch m {
+	case TwoChainMode:
+		return "two-chain"
+	case FastHotStuffMode:
+		return "fast-hotstuff"
+	}
+	return "three-chain"
+}
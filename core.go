@@ -0,0 +1,941 @@
+package hotstuff
+
+import (
+	"bytes"
+	"fmt"
+	"time"
+)
+
+const ViewTimeOut = 15000
+const NoopTimeOut = 4000
+
+// Events consumed by hotStuffCore.step.
+type requestEvent struct {
+	request *RequestArgs
+}
+
+type proposalEvent struct {
+	msg *ProposalArgs
+}
+
+type voteEvent struct {
+	msg *VoteArgs
+}
+
+type newViewEvent struct {
+	msg *NewViewArgs
+}
+
+type evidenceEvent struct {
+	evidence *Evidence
+}
+
+// timeoutEvent fires when the view timer of viewId expires.
+type timeoutEvent struct {
+	viewId int
+}
+
+// tickEvent fires when the leader of viewId has been idle for NoopTimeOut.
+type tickEvent struct {
+	viewId int
+}
+
+type timerKind int
+
+const (
+	viewTimer timerKind = iota
+	noopTimer
+)
+
+// Actions emitted by hotStuffCore.step and carried out by the driver.
+type sendAction struct {
+	to     int
+	method string
+	args   interface{}
+}
+
+type replyAction struct {
+	clientId int
+	reply    *ReplyArgs
+}
+
+// timerAction (re)arms the timer of the given kind. A timer that fires
+// for a view the core has already left is ignored, so timers never need
+// to be cancelled explicitly.
+type timerAction struct {
+	kind   timerKind
+	viewId int
+	d      time.Duration
+}
+
+// logAction carries an entry for the driver's logger, which stamps it.
+type logAction struct {
+	entry *LogEntry
+}
+
+type protocolEvent int
+
+const (
+	viewStarted protocolEvent = iota
+	viewTimedOut
+	qcFormed
+	// a node moves through the phases prepare (voted for), precommit (it
+	// has a QC) and commit (its QC has a QC) until it is committed
+	nodeVoted
+	nodePrepared
+	nodeLocked
+	nodeCommitted
+)
+
+// metricAction reports a protocol event for the driver to count and trace.
+type metricAction struct {
+	event  protocolEvent
+	viewId int
+	nodeId string
+}
+
+// hotStuffCore holds the protocol state. It never touches the network, the
+// clock or a lock: it is driven one event at a time and answers with the
+// actions the driver has to perform.
+type hotStuffCore struct {
+	// validators of every epoch so far, the current one last
+	epochs     []*validatorSet
+	validators *validatorSet
+	replicas   int
+	me         int
+	viewId     int
+	nodeMap    map[string]*LogNode
+	lastNode   *LogNode
+	genericQC  QC
+	lockedQC   QC
+	// QC the chain of the current epoch starts from, the only one
+	// without votes
+	genesis       QC
+	votes         *voteCollector
+	savedNewViews map[int]*NewViewArgs
+	protocol      ProtocolMode
+	proposedView  int
+	pending       []*RequestArgs
+	// client requests executed so far, never proposed again
+	executed      map[requestKey]bool
+	lastVotedView int
+	timeoutMsgs   map[int]map[int]*NewViewArgs
+	highTC        TC
+	highAggQC     AggQC
+	viewTimeout   time.Duration
+	noopTimeout   time.Duration
+	// the log of executed nodes, the ledger of the replica: it grows with
+	// every commit, while nodeMap is pruned
+	committed []*LogNode
+	keys      *SigningKeys
+	// view of the last node executed, to spot reconfigurations in flight
+	lastExecutedView int
+	// nodes from views before prunedView are dropped from nodeMap
+	prunedView   int
+	epochChanges map[string]map[int]*EpochChangeArgs
+	proposals    map[int]*ProposalArgs
+	evidence     map[string]*Evidence
+
+	actions []interface{}
+}
+
+func (hc *hotStuffCore) step(e interface{}) []interface{} {
+	hc.actions = nil
+	switch e := e.(type) {
+	case requestEvent:
+		hc.onRequest(e.request)
+	case proposalEvent:
+		hc.onProposal(e.msg)
+	case voteEvent:
+		hc.onVote(e.msg)
+	case newViewEvent:
+		hc.onNewView(e.msg)
+	case evidenceEvent:
+		hc.addEvidence(e.evidence)
+	case epochChangeEvent:
+		hc.onEpochChange(e.msg)
+	case timeoutEvent:
+		hc.onTimeout(e.viewId)
+	case tickEvent:
+		hc.onTick(e.viewId)
+	}
+	actions := hc.actions
+	hc.actions = nil
+	return actions
+}
+
+func (hc *hotStuffCore) start() []interface{} {
+	hc.actions = nil
+	hc.newView(1)
+	actions := hc.actions
+	hc.actions = nil
+	return actions
+}
+
+func (hc *hotStuffCore) emit(action interface{}) {
+	hc.actions = append(hc.actions, action)
+}
+
+// log reports an event with the current view and the given key, value
+// pairs as fields.
+func (hc *hotStuffCore) log(level Level, event, msg string, kv ...interface{}) {
+	kv = append([]interface{}{"view", hc.viewId}, kv...)
+	hc.emit(logAction{makeLogEntry(level, event, msg, kv)})
+}
+
+func (hc *hotStuffCore) sendMsg(id int, rpcname string, rpcargs interface{}) {
+	hc.emit(sendAction{id, rpcname, rpcargs})
+}
+
+// broadcast reaches every replica we know of, members or not, so replicas
+// waiting to join can follow the chain.
+func (hc *hotStuffCore) broadcast(rpcname string, rpcargs interface{}) {
+	for id := 0; id < hc.replicas; id++ {
+		hc.sendMsg(id, rpcname, rpcargs)
+	}
+}
+
+func (hc *hotStuffCore) isLeader() bool {
+	return hc.me == hc.validators.leader(hc.viewId)
+}
+
+func (hc *hotStuffCore) isNextLeader() bool {
+	return hc.me == hc.validators.leader(hc.viewId+1)
+}
+
+func (hc *hotStuffCore) onRequest(request *RequestArgs) {
+	hc.log(DebugLevel, "request_received", "Receive Request", "client", request.ClientId, "op", request.Operation, "time", request.Timestamp)
+	if !hc.isLeader() || hc.proposed(hc.genericQC.NodeId, request) {
+		return
+	}
+	for _, r := range hc.pending {
+		if r.key() == request.key() {
+			return
+		}
+	}
+
+	// one proposal per view, later requests wait for our next view
+	if hc.proposedView == hc.viewId {
+		hc.pending = append(hc.pending, request)
+		return
+	}
+	if hc.reconfigInFlight() {
+		hc.pending = append(hc.pending, request)
+		hc.proposeNoop()
+		return
+	}
+	hc.processClientRequest(request)
+}
+
+func (hc *hotStuffCore) onProposal(args *ProposalArgs) {
+	hc.log(DebugLevel, "proposal_received", "Receive Proposal", "from", args.RepId, "msgView", args.ViewId, "node", args.Node.Id)
+
+	if !hc.checkEpoch("Proposal", args.RepId, args.Epoch) {
+		return
+	}
+	if args.RepId != hc.validators.leader(args.ViewId) {
+		hc.log(WarnLevel, "proposal_rejected", "Proposal from invalid leader", "from", args.RepId, "msgView", args.ViewId)
+		return
+	}
+	if !hc.checkProposal(args) {
+		return
+	}
+	if !hc.checkQC(args.Node.Justify) {
+		hc.log(WarnLevel, "proposal_rejected", "Proposal with an invalid QC", "from", args.RepId, "qc", args.Node.Justify.NodeId, "qcView", args.Node.Justify.ViewId)
+		return
+	}
+
+	if args.ViewId > hc.viewId {
+		hc.newView(args.ViewId)
+	}
+
+	if args.ViewId != hc.viewId {
+		hc.log(WarnLevel, "proposal_rejected", "Proposal from invalid view", "from", args.RepId, "msgView", args.ViewId)
+		return
+	}
+
+	if hc.protocol == ThreeChainMode {
+		hc.update(&args.Node)
+	} else {
+		hc.updateTwoChain(&args.Node, args.TC, args.AggQC)
+	}
+}
+
+func (hc *hotStuffCore) onVote(args *VoteArgs) {
+	hc.log(DebugLevel, "vote_received", "Receive Vote", "from", args.RepId, "msgView", args.ViewId, "node", args.NodeId)
+
+	if !hc.checkEpoch("Vote", args.RepId, args.Epoch) {
+		return
+	}
+	if hc.me != hc.validators.leader(args.ViewId+1) || !hc.validators.contains(args.RepId) {
+		return
+	}
+
+	qc, ok, err := hc.votes.add(args)
+	if eqErr, isEq := err.(*equivocationError); isEq {
+		hc.addEvidence(makeVoteEvidence(eqErr.prev, eqErr.vote))
+	}
+	if err != nil {
+		hc.log(WarnLevel, "vote_rejected", "Vote rejected", "from", args.RepId, "error", err.Error())
+		return
+	}
+	if ok && args.ViewId == hc.viewId {
+		hc.onQC(qc)
+	}
+}
+
+func (hc *hotStuffCore) onQC(qc QC) {
+	hc.log(InfoLevel, "qc_formed", "QC formed", "qcView", qc.ViewId, "node", qc.NodeId)
+	hc.emit(metricAction{qcFormed, qc.ViewId, qc.NodeId})
+	if qc.ViewId > hc.genericQC.ViewId {
+		hc.genericQC = qc
+		hc.emit(metricAction{nodePrepared, qc.ViewId, qc.NodeId})
+	}
+	hc.newView(hc.viewId + 1)
+}
+
+func (hc *hotStuffCore) onNewView(args *NewViewArgs) {
+	hc.log(DebugLevel, "newview_received", "Receive NewView", "from", args.RepId, "msgView", args.ViewId, "qc", args.QC.NodeId)
+
+	if !hc.checkEpoch("NewView", args.RepId, args.Epoch) || !hc.validators.contains(args.RepId) {
+		return
+	}
+	if args.QC.Epoch != hc.validators.epoch {
+		hc.log(WarnLevel, "newview_rejected", "NewView with qc of old epoch", "from", args.RepId, "qcEpoch", args.QC.Epoch)
+		return
+	}
+	if !hc.checkQC(args.QC) {
+		hc.log(WarnLevel, "newview_rejected", "NewView with an invalid QC", "from", args.RepId, "qc", args.QC.NodeId, "qcView", args.QC.ViewId)
+		return
+	}
+	if hc.protocol != ThreeChainMode {
+		if hc.me == hc.validators.leader(args.ViewId+1) {
+			hc.processTimeoutMsg(args)
+		}
+		return
+	}
+
+	if hc.isNextLeader() {
+		hc.savedNewViews[args.RepId] = args
+		hc.processSavedNewViews()
+	}
+}
+
+func (hc *hotStuffCore) onTimeout(viewId int) {
+	if viewId != hc.viewId {
+		return
+	}
+
+	hc.log(InfoLevel, "view_timeout", "NewView timeout")
+	hc.emit(metricAction{viewTimedOut, hc.viewId, ""})
+
+	if hc.validators.contains(hc.me) {
+		newViewMsg := &NewViewArgs{}
+		newViewMsg.ViewId = hc.viewId
+		newViewMsg.RepId = hc.me
+		newViewMsg.Epoch = hc.validators.epoch
+		newViewMsg.QC = hc.genericQC
+		hc.keys.sign(newViewMsg)
+		hc.sendMsg(hc.validators.leader(hc.viewId+1), "NewView", newViewMsg)
+	}
+	hc.newView(hc.viewId + 1)
+}
+
+func (hc *hotStuffCore) onTick(viewId int) {
+	if viewId != hc.viewId || !hc.isLeader() || hc.proposedView == hc.viewId {
+		return
+	}
+	hc.proposeNoop()
+}
+
+// proposed reports whether the client request was executed already or is
+// on the uncommitted branch ending in nodeId, so proposing it on top of
+// that branch would execute it twice.
+func (hc *hotStuffCore) proposed(nodeId string, request *RequestArgs) bool {
+	if request.Timestamp == 0 {
+		return false
+	}
+	key := request.key()
+	if hc.executed[key] {
+		return true
+	}
+	for node := hc.nodeMap[nodeId]; node != nil && node.ViewId > hc.lastExecutedView; node = hc.parentOf(node) {
+		if node.Request.key() == key {
+			return true
+		}
+	}
+	return false
+}
+
+// parentOf returns the parent of n. Only the leader that skipped a view
+// knows the dummy node filling it, the others go on at the QC of n, where
+// the dummy nodes start. A parent is from an earlier view, so a proposer
+// choosing node ids cannot make the chain loop.
+func (hc *hotStuffCore) parentOf(n *LogNode) *LogNode {
+	parent := hc.nodeMap[n.Parent]
+	if parent == nil && n.Parent != "" {
+		parent = hc.nodeMap[n.Justify.NodeId]
+	}
+	if parent == nil || parent.ViewId >= n.ViewId {
+		return nil
+	}
+	return parent
+}
+
+func (hc *hotStuffCore) proposeNoop() {
+	noopRequset := &RequestArgs{}
+	noopRequset.Operation = "noop"
+	hc.processClientRequest(noopRequset)
+}
+
+func (hc *hotStuffCore) processClientRequest(request *RequestArgs) {
+	curProposal := hc.createLeaf(hc.genericQC.NodeId, request, hc.genericQC)
+	genericMsg := &ProposalArgs{}
+	genericMsg.RepId = hc.me
+	genericMsg.Epoch = hc.validators.epoch
+	genericMsg.ViewId = hc.viewId
+	genericMsg.Node = *curProposal
+	genericMsg.Trace = phaseContext(curProposal, "propose", hc.me)
+	if hc.protocol == TwoChainMode && hc.highTC.ViewId == hc.viewId-1 {
+		genericMsg.TC = hc.highTC
+	}
+	if hc.protocol == FastHotStuffMode && hc.highAggQC.ViewId == hc.viewId-1 {
+		genericMsg.AggQC = hc.highAggQC
+	}
+	hc.keys.sign(genericMsg)
+	hc.proposedView = hc.viewId
+	hc.broadcast("Propose", genericMsg)
+}
+
+func (hc *hotStuffCore) createLeaf(parent string, request *RequestArgs, qc QC) *LogNode {
+	if request == nil {
+		return nil
+	}
+
+	parentNode, ok := hc.nodeMap[parent]
+	if ok {
+		tmpView := parentNode.ViewId + 1
+		if tmpView < hc.validators.startView {
+			tmpView = hc.validators.startView
+		}
+		for tmpView < hc.viewId {
+			dummyNode := &LogNode{}
+			dummyNode.Epoch = hc.validators.epoch
+			dummyNode.ViewId = tmpView
+			dummyNode.Parent = parent
+			dummyNode.Request = RequestArgs{}
+			dummyNode.Request.Operation = "dummy"
+			dummyNode.Id = getLogNodeId(dummyNode.ViewId, &dummyNode.Request)
+			dummyNode.Justify = QC{}
+			hc.nodeMap[dummyNode.Id] = dummyNode
+			parent = dummyNode.Id
+			tmpView++
+		}
+	}
+
+	node := &LogNode{}
+	node.Epoch = hc.validators.epoch
+	node.ViewId = hc.viewId
+	node.Parent = parent
+	node.Request = *request
+	node.Id = getLogNodeId(hc.viewId, request)
+	node.Justify = qc
+
+	hc.saveNode(node)
+	hc.log(DebugLevel, "leaf_created", "Create Leaf", "node", node.Id, "parent", node.Parent, "op", node.Request.Operation)
+	return node
+}
+
+func (hc *hotStuffCore) safeNode(n *LogNode, qc QC) bool {
+	if qc.Epoch != hc.validators.epoch {
+		return false
+	}
+	for n != nil {
+		if n.Parent == hc.lockedQC.NodeId {
+			return true
+		}
+		n = hc.nodeMap[n.Parent]
+	}
+	if qc.ViewId > hc.lockedQC.ViewId {
+		return true
+	}
+	return false
+}
+
+func (hc *hotStuffCore) saveNode(n *LogNode) {
+	hc.lastNode = n
+	hc.nodeMap[n.Id] = n
+}
+
+// nodeRetention is how many views of nodes before the last executed one
+// are kept, for the explorer and late messages.
+const nodeRetention = 1000
+
+// pruneNodes drops the nodes more than nodeRetention views older than the
+// last executed one. It sweeps nodeMap once every nodeRetention views.
+func (hc *hotStuffCore) pruneNodes() {
+	if hc.lastExecutedView-nodeRetention < hc.prunedView+nodeRetention {
+		return
+	}
+	hc.prunedView = hc.lastExecutedView - nodeRetention
+	for id, node := range hc.nodeMap {
+		if node.ViewId < hc.prunedView {
+			delete(hc.nodeMap, id)
+		}
+	}
+}
+
+func (hc *hotStuffCore) update(n *LogNode) {
+	var prepare, precommit, commit, decide *LogNode
+	var nodeId string
+	prepare = n
+	if prepare != nil {
+		nodeId = prepare.Justify.NodeId
+		precommit = hc.getNode(nodeId)
+	}
+	if precommit != nil {
+		nodeId = precommit.Justify.NodeId
+		commit = hc.getNode(nodeId)
+	}
+	if commit != nil {
+		nodeId = commit.Justify.NodeId
+		decide = hc.getNode(nodeId)
+	}
+
+	if hc.proposed(prepare.Parent, &prepare.Request) {
+		hc.log(WarnLevel, "proposal_rejected", "Proposal repeats a request", "node", prepare.Id, "client", prepare.Request.ClientId, "time", prepare.Request.Timestamp)
+		return
+	}
+	if hc.safeNode(prepare, prepare.Justify) {
+		// node saved
+		hc.log(DebugLevel, "node_saved", "LogNode saved", "node", n.Id, "qc", n.Justify.NodeId, "qcView", n.Justify.ViewId)
+
+		hc.saveNode(n)
+		hc.vote(prepare)
+	} else {
+		return
+	}
+
+	if prepare != nil && precommit != nil && prepare.Parent == precommit.Id {
+		hc.genericQC = prepare.Justify
+		hc.emit(metricAction{nodePrepared, precommit.ViewId, precommit.Id})
+		if precommit != nil && commit != nil && precommit.Parent == commit.Id {
+			hc.lockedQC = precommit.Justify
+			hc.emit(metricAction{nodeLocked, commit.ViewId, commit.Id})
+			if commit != nil && decide != nil && commit.Parent == decide.Id {
+				hc.commit(decide)
+			}
+		}
+	}
+}
+
+func (hc *hotStuffCore) vote(n *LogNode) {
+	if !hc.validators.contains(hc.me) {
+		return
+	}
+
+	voteMsg := &VoteArgs{}
+	voteMsg.RepId = hc.me
+	voteMsg.Epoch = n.Epoch
+	voteMsg.ViewId = hc.viewId
+	voteMsg.NodeId = n.Id
+	voteMsg.NodeView = n.ViewId
+	voteMsg.NodeHash = n.hash()
+	voteMsg.Trace = phaseContext(n, "prepare", hc.me)
+	hc.keys.sign(voteMsg)
+	hc.emit(metricAction{nodeVoted, n.ViewId, n.Id})
+	hc.sendMsg(hc.validators.leader(hc.viewId+1), "Vote", voteMsg)
+}
+
+// commit executes n after the ancestors of n not executed yet, oldest
+// first, so a replica that missed the node deciding one of them still
+// executes it. Dummy nodes are passed over, as only their leader has them.
+func (hc *hotStuffCore) commit(n *LogNode) {
+	var chain []*LogNode
+	for node := n; node != nil && node.ViewId > hc.lastExecutedView; node = hc.parentOf(node) {
+		chain = append(chain, node)
+	}
+	for i := len(chain) - 1; i >= 0; i-- {
+		if !isDummy(chain[i]) {
+			hc.execute(chain[i])
+		}
+	}
+	hc.pruneNodes()
+}
+
+func (hc *hotStuffCore) execute(n *LogNode) {
+	hc.log(InfoLevel, "node_executed", "Execute Request", "node", n.Id, "op", n.Request.Operation)
+	hc.committed = append(hc.committed, n)
+	hc.lastExecutedView = n.ViewId
+	hc.emit(metricAction{nodeCommitted, n.ViewId, n.Id})
+	request := n.Request
+	if request.Timestamp != 0 {
+		hc.executed[request.key()] = true
+		pending := hc.pending[:0]
+		for _, r := range hc.pending {
+			if r.key() != request.key() {
+				pending = append(pending, r)
+			}
+		}
+		hc.pending = pending
+
+		reply := &ReplyArgs{}
+		reply.ViewId = hc.viewId
+		reply.Timestamp = request.Timestamp
+		reply.ReplicaId = hc.me
+		reply.ClientId = request.ClientId
+		reply.Epoch = hc.validators.epoch
+		reply.Members = hc.validators.members
+		reply.Weights = hc.validators.memberWeights()
+		reply.Result = request.Operation
+		reply.Trace = phaseContext(n, "commit", hc.me)
+		hc.keys.sign(reply)
+		hc.emit(replyAction{request.ClientId, reply})
+	}
+	if isReconfig(request.Operation) {
+		if request.Timestamp == 0 || !hc.keys.isOperator(request.ClientId) {
+			hc.log(WarnLevel, "reconfig_rejected", "Reconfiguration from no operator", "node", n.Id, "client", request.ClientId)
+			return
+		}
+		hc.reconfigure(n, hc.viewId+1)
+	}
+}
+
+// checkNewViews reports whether msgs are new-view messages for viewId,
+// each signed by a different member of the current epoch and with a valid
+// QC, from a quorum of the members.
+func (hc *hotStuffCore) checkNewViews(viewId int, msgs []NewViewArgs) bool {
+	var senders []int
+	seen := make(map[int]bool)
+	for i := range msgs {
+		msg := &msgs[i]
+		if msg.ViewId != viewId || msg.Epoch != hc.validators.epoch || seen[msg.RepId] || !hc.validators.contains(msg.RepId) {
+			return false
+		}
+		if err := hc.keys.verify(msg); err != nil {
+			hc.log(WarnLevel, "certificate_rejected", "Certificate with a forged NewView", "from", msg.RepId, "error", err.Error())
+			return false
+		}
+		if !hc.checkQC(msg.QC) {
+			hc.log(WarnLevel, "certificate_rejected", "Certificate with an invalid QC", "from", msg.RepId, "qc", msg.QC.NodeId, "qcView", msg.QC.ViewId)
+			return false
+		}
+		seen[msg.RepId] = true
+		senders = append(senders, msg.RepId)
+	}
+	return hc.validators.hasQuorum(senders)
+}
+
+// checkQC reports whether qc is the genesis QC of the current epoch or
+// carries the signed votes of a quorum of its members, all cast in one
+// view for the node of the QC.
+func (hc *hotStuffCore) checkQC(qc QC) bool {
+	if qc.Epoch != hc.validators.epoch {
+		return false
+	}
+	if len(qc.Votes) == 0 {
+		return qc.ViewId == hc.genesis.ViewId && qc.NodeId == hc.genesis.NodeId && len(qc.NodeHash) == 0
+	}
+
+	var voters []int
+	seen := make(map[int]bool)
+	for i := range qc.Votes {
+		vote := &qc.Votes[i]
+		if vote.Epoch != qc.Epoch || vote.ViewId != qc.Votes[0].ViewId || vote.NodeView != qc.ViewId || vote.NodeId != qc.NodeId || !bytes.Equal(vote.NodeHash, qc.NodeHash) {
+			return false
+		}
+		if seen[vote.RepId] || !hc.validators.contains(vote.RepId) {
+			return false
+		}
+		if err := hc.keys.verify(vote); err != nil {
+			hc.log(WarnLevel, "qc_rejected", "QC with a forged vote", "from", vote.RepId, "error", err.Error())
+			return false
+		}
+		seen[vote.RepId] = true
+		voters = append(voters, vote.RepId)
+	}
+	return hc.validators.hasQuorum(voters)
+}
+
+// safeNodeTwoChain replaces the lock check in two-chain mode: a node is
+// voted for if it directly extends the QC of the previous view, or if a TC
+// for the previous view shows that no replica has seen a higher QC.
+func (hc *hotStuffCore) safeNodeTwoChain(n *LogNode, tc TC) bool {
+	if n.ViewId <= hc.lastVotedView || n.Justify.Epoch != hc.validators.epoch {
+		return false
+	}
+	if n.Justify.ViewId+1 == n.ViewId {
+		return true
+	}
+	return tc.ViewId+1 == n.ViewId && hc.checkNewViews(tc.ViewId, tc.NewViews) && n.Justify.ViewId >= tc.maxHighQCView()
+}
+
+// safeNodeFast is the Fast-HotStuff voting rule: no lock is consulted.
+// After a view change the proposal must carry an AggQC for the previous
+// view and justify itself with the highest QC in it. The AggQC holds the
+// new-view messages as their senders signed them, which rules out a
+// leader forking away from a QC that honest replicas already hold.
+func (hc *hotStuffCore) safeNodeFast(n *LogNode, aggQC AggQC) bool {
+	if n.ViewId <= hc.lastVotedView || n.Justify.Epoch != hc.validators.epoch {
+		return false
+	}
+	if n.Justify.ViewId+1 == n.ViewId {
+		return n.Parent == n.Justify.NodeId
+	}
+	if aggQC.ViewId+1 != n.ViewId || !hc.checkNewViews(aggQC.ViewId, aggQC.NewViews) {
+		return false
+	}
+
+	highQC := aggQC.highQC()
+	return n.Justify.ViewId == highQC.ViewId && n.Justify.NodeId == highQC.NodeId
+}
+
+// updateTwoChain commits a node as soon as it heads a chain of two QCs
+// whose nodes are direct children of each other.
+func (hc *hotStuffCore) updateTwoChain(n *LogNode, tc TC, aggQC AggQC) {
+	var safe bool
+	if hc.protocol == FastHotStuffMode {
+		safe = hc.safeNodeFast(n, aggQC)
+	} else {
+		safe = hc.safeNodeTwoChain(n, tc)
+	}
+	if !safe {
+		return
+	}
+	if hc.proposed(n.Parent, &n.Request) {
+		hc.log(WarnLevel, "proposal_rejected", "Proposal repeats a request", "node", n.Id, "client", n.Request.ClientId, "time", n.Request.Timestamp)
+		return
+	}
+
+	hc.log(DebugLevel, "node_saved", "LogNode saved", "node", n.Id, "qc", n.Justify.NodeId, "qcView", n.Justify.ViewId)
+	hc.saveNode(n)
+	hc.lastVotedView = n.ViewId
+	hc.vote(n)
+
+	b1 := hc.getNode(n.Justify.NodeId)
+	if b1 == nil {
+		return
+	}
+	if n.Justify.ViewId > hc.genericQC.ViewId {
+		hc.genericQC = n.Justify
+		hc.emit(metricAction{nodePrepared, b1.ViewId, b1.Id})
+	}
+
+	b0 := hc.getNode(b1.Justify.NodeId)
+	if b0 == nil {
+		return
+	}
+	if b1.Justify.ViewId > hc.lockedQC.ViewId {
+		hc.lockedQC = b1.Justify
+		hc.emit(metricAction{nodeLocked, b0.ViewId, b0.Id})
+	}
+
+	if b1.Parent == b0.Id && b1.ViewId == b0.ViewId+1 {
+		hc.commit(b0)
+	}
+}
+
+// processTimeoutMsg collects new-view messages sent on view timeout and
+// forms a TC (or an AggQC in fast-hotstuff mode) once n-f replicas have
+// timed out on the same view.
+func (hc *hotStuffCore) processTimeoutMsg(args *NewViewArgs) {
+	if args.ViewId < hc.highTC.ViewId {
+		return
+	}
+
+	msgs := hc.timeoutMsgs[args.ViewId]
+	if msgs == nil {
+		msgs = make(map[int]*NewViewArgs)
+		hc.timeoutMsgs[args.ViewId] = msgs
+	}
+	msgs[args.RepId] = args
+	senders := make([]int, 0, len(msgs))
+	for repId := range msgs {
+		senders = append(senders, repId)
+	}
+	if !hc.validators.hasQuorum(senders) {
+		return
+	}
+
+	tc := TC{}
+	tc.ViewId = args.ViewId
+	for _, msg := range msgs {
+		tc.NewViews = append(tc.NewViews, *msg)
+		if msg.QC.ViewId > hc.genericQC.ViewId {
+			if _, ok := hc.nodeMap[msg.QC.NodeId]; ok {
+				hc.genericQC = msg.QC
+			}
+		}
+	}
+	hc.highTC = tc
+	if hc.protocol == FastHotStuffMode {
+		aggQC := AggQC{}
+		aggQC.ViewId = tc.ViewId
+		aggQC.NewViews = tc.NewViews
+		highQC := aggQC.highQC()
+		if highQC.ViewId > hc.genericQC.ViewId {
+			hc.genericQC = highQC
+		}
+		hc.highAggQC = aggQC
+	}
+	for viewId := range hc.timeoutMsgs {
+		if viewId <= tc.ViewId {
+			delete(hc.timeoutMsgs, viewId)
+		}
+	}
+
+	hc.log(InfoLevel, "tc_formed", "TC formed", "tcView", tc.ViewId, "highQCView", tc.maxHighQCView())
+	hc.newView(tc.ViewId + 1)
+}
+
+func (hc *hotStuffCore) processSavedNewViews() {
+	var senders []int
+	for repId, msg := range hc.savedNewViews {
+		if msg.ViewId == hc.viewId {
+			senders = append(senders, repId)
+		}
+	}
+
+	if hc.validators.hasQuorum(senders) {
+		// no QC for this view, the next proposal extends a dummy node
+		hc.newView(hc.viewId + 1)
+	}
+}
+
+func (hc *hotStuffCore) newView(viewId int) {
+	if hc.viewId >= viewId {
+		return
+	}
+
+	var chain []string
+	for _, node := range hc.recentNodes() {
+		chain = append(chain, node.Id)
+	}
+	hc.log(DebugLevel, "recent_nodes", "Recent valid nodes", "chain", chain)
+
+	hc.viewId = viewId
+	hc.log(InfoLevel, "view_change", "Change to NewView")
+	hc.emit(metricAction{viewStarted, viewId, ""})
+	hc.votes.reset(viewId)
+	hc.pruneProposals()
+	if hc.isLeader() {
+		var highNode *LogNode
+		for _, msg := range hc.savedNewViews {
+			if msg.QC.NodeId != "" {
+				node, ok := hc.nodeMap[msg.QC.NodeId]
+				if ok {
+					if highNode == nil || node.ViewId > highNode.ViewId {
+						highNode = node
+					}
+				}
+			}
+		}
+
+		if highNode != nil {
+			highQC := highNode.Justify
+			if highQC.ViewId > hc.genericQC.ViewId {
+				hc.genericQC = highQC
+			}
+		}
+
+		hc.emit(timerAction{noopTimer, hc.viewId, hc.noopTimeout})
+	}
+
+	hc.emit(timerAction{viewTimer, hc.viewId, hc.viewTimeout})
+
+	for repId, msg := range hc.savedNewViews {
+		if msg.ViewId < hc.viewId-1 {
+			delete(hc.savedNewViews, repId)
+		}
+	}
+
+	// votes for this view may have arrived before its proposal
+	if qc, ok := hc.votes.certified(hc.viewId); ok {
+		hc.onQC(qc)
+		return
+	}
+
+	// requests another leader proposed meanwhile are dropped
+	for len(hc.pending) > 0 && hc.proposed(hc.genericQC.NodeId, hc.pending[0]) {
+		hc.pending = hc.pending[1:]
+	}
+	if hc.isLeader() && len(hc.pending) > 0 {
+		if hc.reconfigInFlight() {
+			hc.proposeNoop()
+			return
+		}
+		request := hc.pending[0]
+		hc.pending = hc.pending[1:]
+		hc.processClientRequest(request)
+	}
+}
+
+func (hc *hotStuffCore) getServerInfo() map[string]interface{} {
+	info := make(map[string]interface{})
+	info["id"] = hc.me
+	info["viewId"] = hc.viewId
+	info["n"] = hc.validators.n()
+	info["f"] = hc.validators.f()
+	info["epoch"] = hc.validators.epoch
+	info["weight"] = hc.validators.totalWeight()
+	info["members"] = fmt.Sprint(hc.validators.members)
+	info["genericQCId"] = hc.genericQC.NodeId
+	info["genericQCView"] = hc.genericQC.ViewId
+	info["lockedQCId"] = hc.lockedQC.NodeId
+	info["lockedQCView"] = hc.lockedQC.ViewId
+	info["protocol"] = hc.protocol.String()
+	info["evidence"] = len(hc.evidence)
+	return info
+}
+
+// recentNodes follows the QCs back from the generic QC, newest first.
+func (hc *hotStuffCore) recentNodes() []*LogNode {
+	var nodes []*LogNode
+	node := hc.nodeMap[hc.genericQC.NodeId]
+	for i := 0; i < 5 && node != nil; i++ {
+		nodes = append(nodes, node)
+		node = hc.nodeMap[node.Justify.NodeId]
+	}
+	return nodes
+}
+
+func (hc *hotStuffCore) getRecentNodes() string {
+	msg := "Recent valid nodes: \n"
+	for _, node := range hc.recentNodes() {
+		msg += fmt.Sprintf("    nodeId[%s] view[%d] parent[%s] qc[%s]\n", node.Id, node.ViewId, node.Parent, node.Justify.NodeId)
+	}
+	return msg
+}
+
+// setValidators replaces the validators of epoch 0 before the replica
+// starts.
+func (hc *hotStuffCore) setValidators(vs *validatorSet) {
+	hc.validators = vs
+	hc.epochs = []*validatorSet{vs}
+	hc.votes = makeVoteCollector(vs)
+}
+
+// makeHotStuffCore starts out with all n replicas as members of epoch 0.
+func makeHotStuffCore(id, n int, protocol ProtocolMode, keys *SigningKeys) *hotStuffCore {
+	hc := &hotStuffCore{}
+	hc.me = id
+	hc.viewId = 0
+	hc.nodeMap = make(map[string]*LogNode)
+	hc.replicas = n
+	members := make([]int, n)
+	for i := range members {
+		members[i] = i
+	}
+	hc.setValidators(makeValidatorSet(0, 0, members, nil, false))
+	hc.savedNewViews = make(map[int]*NewViewArgs)
+	hc.protocol = protocol
+	hc.keys = keys
+	hc.viewTimeout = time.Duration(ViewTimeOut * time.Millisecond)
+	hc.noopTimeout = time.Duration(NoopTimeOut * time.Millisecond)
+	hc.timeoutMsgs = make(map[int]map[int]*NewViewArgs)
+	hc.proposals = make(map[int]*ProposalArgs)
+	hc.evidence = make(map[string]*Evidence)
+	hc.executed = make(map[requestKey]bool)
+	hc.epochChanges = make(map[string]map[int]*EpochChangeArgs)
+	return hc
+}
@@ -0,0 +1,334 @@
+package hotstuff
+
+import (
+	"reflect"
+	"testing"
+)
+
+var requestX = RequestArgs{Operation: "x", Timestamp: 100, ClientId: 0}
+
+// proposal is justified by the unsigned votes of replicas 0 to 2 for
+// justify, or by the genesis QC when justify is nil.
+func proposal(viewId int, request RequestArgs, parent string, justify *LogNode) proposalEvent {
+	args := &ProposalArgs{}
+	args.RepId = viewId % 4
+	args.ViewId = viewId
+	args.Node.Id = getLogNodeId(viewId, &request)
+	args.Node.Parent = parent
+	args.Node.ViewId = viewId
+	args.Node.Request = request
+	args.Node.Justify = certify(nil, justify, 0, 1, 2)
+	return proposalEvent{args}
+}
+
+// certify forms the QC of n from the votes of voters, signed when keys
+// are given.
+func certify(keys []*SigningKeys, n *LogNode, voters ...int) QC {
+	qc := QC{}
+	if n == nil {
+		return qc
+	}
+	qc.Epoch = n.Epoch
+	qc.ViewId = n.ViewId
+	qc.NodeId = n.Id
+	qc.NodeHash = n.hash()
+	for _, repId := range voters {
+		args := vote(repId, n.ViewId, n.Id).msg
+		args.Epoch = n.Epoch
+		args.NodeHash = qc.NodeHash
+		if keys != nil {
+			keys[repId].sign(args)
+		}
+		qc.Votes = append(qc.Votes, *args)
+	}
+	return qc
+}
+
+func vote(repId, viewId int, nodeId string) voteEvent {
+	args := &VoteArgs{}
+	args.RepId = repId
+	args.ViewId = viewId
+	args.NodeId = nodeId
+	args.NodeView = viewId
+	return voteEvent{args}
+}
+
+func noop() RequestArgs {
+	return RequestArgs{Operation: "noop"}
+}
+
+// chain proposes noop nodes for views from to to, each extending the one
+// before and justified by it, starting on parent of view from-1.
+func chain(from, to int, parent *LogNode) []interface{} {
+	var events []interface{}
+	for v := from; v <= to; v++ {
+		parentId := ""
+		if parent != nil {
+			parentId = parent.Id
+		}
+		e := proposal(v, noop(), parentId, parent)
+		events = append(events, e)
+		parent = &e.msg.Node
+	}
+	return events
+}
+
+// last is the node of the last proposal in events.
+func last(events []interface{}) *LogNode {
+	return &events[len(events)-1].(proposalEvent).msg.Node
+}
+
+func concat(parts ...[]interface{}) []interface{} {
+	var events []interface{}
+	for _, part := range parts {
+		events = append(events, part...)
+	}
+	return events
+}
+
+func TestStep(t *testing.T) {
+	x1 := []interface{}{proposal(1, requestX, "", nil)}
+	x5 := []interface{}{proposal(5, requestX, "", nil)}
+	after1 := chain(2, 4, last(x1))
+	noops := chain(1, 3, nil)
+	skipped := []interface{}{proposal(5, noop(), "4_dummy", last(noops))}
+
+	tests := []struct {
+		name      string
+		me        int
+		events    []interface{}
+		proposed  []string
+		voted     []string
+		committed []string
+	}{
+		{
+			name:     "leader proposes a request at once",
+			me:       1,
+			events:   []interface{}{requestEvent{&requestX}},
+			proposed: []string{"1_x"},
+		},
+		{
+			// the request waits for our next view, but another leader
+			// proposes it first
+			name: "leader drops a queued request already on the chain",
+			me:   0,
+			events: concat(
+				[]interface{}{
+					timeoutEvent{1}, timeoutEvent{2}, timeoutEvent{3},
+					tickEvent{4},
+					requestEvent{&requestX},
+				},
+				x5,
+				chain(6, 7, last(x5)),
+				[]interface{}{vote(1, 7, "7_noop"), vote(2, 7, "7_noop"), vote(3, 7, "7_noop")},
+			),
+			proposed: []string{"4_noop"},
+			voted:    []string{"5_x", "6_noop", "7_noop"},
+		},
+		{
+			name: "replica refuses a request repeated on the branch",
+			me:   3,
+			events: concat(
+				x1,
+				[]interface{}{proposal(2, requestX, "1_x", last(x1))},
+			),
+			voted: []string{"1_x"},
+		},
+		{
+			name: "replica refuses a request executed before",
+			me:   3,
+			events: concat(
+				x1,
+				after1,
+				[]interface{}{proposal(5, requestX, "4_noop", last(after1))},
+			),
+			voted:     []string{"1_x", "2_noop", "3_noop", "4_noop"},
+			committed: []string{"1_x"},
+		},
+		{
+			// the proposal of view 4, which decides 1_noop, never arrives
+			// and the leader of view 5 fills view 4 with a dummy node
+			name: "replica executes the ancestors it did not decide",
+			me:   3,
+			events: concat(
+				noops,
+				skipped,
+				chain(6, 8, last(skipped)),
+			),
+			voted:     []string{"1_noop", "2_noop", "3_noop", "5_noop", "6_noop", "7_noop", "8_noop"},
+			committed: []string{"1_noop", "2_noop", "3_noop", "5_noop"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			hc := makeHotStuffCore(test.me, 4, ThreeChainMode, nil)
+			actions := hc.start()
+			for _, e := range test.events {
+				actions = append(actions, hc.step(e)...)
+			}
+
+			var proposed, voted, committed []string
+			for _, action := range actions {
+				send, ok := action.(sendAction)
+				if !ok {
+					continue
+				}
+				switch args := send.args.(type) {
+				case *ProposalArgs:
+					if send.to == test.me {
+						proposed = append(proposed, args.Node.Id)
+					}
+				case *VoteArgs:
+					voted = append(voted, args.NodeId)
+				}
+			}
+			for _, node := range hc.committed {
+				committed = append(committed, node.Id)
+			}
+
+			if !reflect.DeepEqual(proposed, test.proposed) {
+				t.Errorf("proposed %v, want %v", proposed, test.proposed)
+			}
+			if !reflect.DeepEqual(voted, test.voted) {
+				t.Errorf("voted %v, want %v", voted, test.voted)
+			}
+			if !reflect.DeepEqual(committed, test.committed) {
+				t.Errorf("committed %v, want %v", committed, test.committed)
+			}
+		})
+	}
+}
+
+func signedNewViews(keys []*SigningKeys, viewId int, qcs map[int]QC) []NewViewArgs {
+	var msgs []NewViewArgs
+	for repId, qc := range qcs {
+		msg := NewViewArgs{}
+		msg.RepId = repId
+		msg.ViewId = viewId
+		msg.QC = qc
+		keys[repId].sign(&msg)
+		msgs = append(msgs, msg)
+	}
+	return msgs
+}
+
+// A proposal after a view change carries a TC in two-chain mode and an
+// AggQC in fast-hotstuff mode, both holding the new views they rely on.
+func TestStepTimeoutCertificate(t *testing.T) {
+	keys, _, err := GenerateSigningKeys(4, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n3 := &LogNode{Id: "3_noop", ViewId: 3, Request: noop()}
+	certified := certify(keys, n3, 0, 1, 3)
+	fabricated := QC{ViewId: 2, NodeId: "2_noop"}
+	unsigned := certify(nil, n3, 0, 1, 3)
+
+	// replicas 0 and 1 hold a QC for view 3, which the leader hides
+	lowered := signedNewViews(keys, 4, map[int]QC{0: certified, 1: certified, 3: {}})
+	for i := range lowered {
+		if lowered[i].RepId != 3 {
+			lowered[i].QC = QC{}
+		}
+	}
+
+	tests := []struct {
+		name     string
+		newViews []NewViewArgs
+		justify  QC
+		voted    bool
+	}{
+		{"signed new views", signedNewViews(keys, 4, map[int]QC{0: {}, 1: {}, 3: {}}), QC{}, true},
+		{"too few new views", signedNewViews(keys, 4, map[int]QC{0: {}, 1: {}}), QC{}, false},
+		{"new views for another view", signedNewViews(keys, 3, map[int]QC{0: {}, 1: {}, 3: {}}), QC{}, false},
+		{"new views with hidden high QCs", lowered, QC{}, false},
+		{"new views with a certified high QC", signedNewViews(keys, 4, map[int]QC{0: {}, 1: certified, 3: {}}), certified, true},
+		{"new view with a fabricated QC", signedNewViews(keys, 4, map[int]QC{0: {}, 1: certified, 3: fabricated}), certified, false},
+		{"justified by unsigned votes", signedNewViews(keys, 4, map[int]QC{0: {}, 1: unsigned, 3: {}}), unsigned, false},
+	}
+
+	for _, protocol := range []ProtocolMode{TwoChainMode, FastHotStuffMode} {
+		for _, test := range tests {
+			t.Run(protocol.String()+"/"+test.name, func(t *testing.T) {
+				hc := makeHotStuffCore(2, 4, protocol, keys[2])
+				hc.start()
+				e := proposal(5, noop(), test.justify.NodeId, nil)
+				e.msg.Node.Justify = test.justify
+				if protocol == TwoChainMode {
+					e.msg.TC = TC{4, test.newViews}
+				} else {
+					e.msg.AggQC = AggQC{4, test.newViews}
+				}
+				voted := false
+				for _, action := range hc.step(e) {
+					if send, ok := action.(sendAction); ok && send.method == "Vote" {
+						voted = true
+					}
+				}
+				if voted != test.voted {
+					t.Errorf("voted %v, want %v", voted, test.voted)
+				}
+			})
+		}
+	}
+}
+
+// The leader of a fast-hotstuff view change drops a new view whose QC
+// has no votes, rather than extending the QC it claims.
+func TestStepFabricatedHighQC(t *testing.T) {
+	keys, _, err := GenerateSigningKeys(4, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fabricated := QC{ViewId: 3, NodeId: "3_noop"}
+	msgs := signedNewViews(keys, 4, map[int]QC{3: fabricated})
+	msgs = append(msgs, signedNewViews(keys, 4, map[int]QC{0: {}, 1: {}, 2: {}})...)
+
+	hc := makeHotStuffCore(1, 4, FastHotStuffMode, keys[1])
+	hc.start()
+	var actions []interface{}
+	for i := range msgs {
+		actions = append(actions, hc.step(newViewEvent{&msgs[i]})...)
+	}
+	actions = append(actions, hc.step(tickEvent{5})...)
+
+	var justify []string
+	for _, action := range actions {
+		if send, ok := action.(sendAction); ok && send.method == "Propose" && send.to == 1 {
+			justify = append(justify, send.args.(*ProposalArgs).Node.Justify.NodeId)
+		}
+	}
+	if !reflect.DeepEqual(justify, []string{""}) {
+		t.Errorf("proposed with QCs for %q, want the genesis QC", justify)
+	}
+}
+
+// Nodes far enough below the last executed one are dropped, in sweeps
+// nodeRetention views apart.
+func TestPruneNodes(t *testing.T) {
+	const views = 4 * nodeRetention
+	hc := makeHotStuffCore(0, 4, ThreeChainMode, nil)
+	for v := 1; v <= views; v++ {
+		id := getLogNodeId(v, &RequestArgs{Operation: "noop"})
+		hc.nodeMap[id] = &LogNode{Id: id, ViewId: v}
+	}
+
+	tests := []struct {
+		executed int
+		// first view still kept
+		kept int
+	}{
+		{nodeRetention, 1},
+		{2*nodeRetention + 10, nodeRetention + 10},
+		{2*nodeRetention + 20, nodeRetention + 10},
+		{3*nodeRetention + 10, 2*nodeRetention + 10},
+	}
+	for _, test := range tests {
+		hc.lastExecutedView = test.executed
+		hc.pruneNodes()
+		if want := views - test.kept + 1; len(hc.nodeMap) != want {
+			t.Errorf("executed view %d: kept %d nodes, want %d", test.executed, len(hc.nodeMap), want)
+		}
+	}
+}
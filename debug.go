@@ -1,10 +1,10 @@
 package hotstuff
 
 import (
+	"crypto/ed25519"
 	"fmt"
 	"log"
 	"net"
-	"strconv"
 	"strings"
 	"sync"
 )
@@ -16,16 +16,23 @@ type IDebugServer interface {
 type DebugServerBase struct {
 	addr     string
 	tcpl     net.Listener
+	mu       sync.Mutex
 	clients  map[string]net.Conn
 	notifyCh chan interface{}
+	// onKill stops what else serves the same replica or client
+	onKill func()
 }
 
+// getNotifyMsg forwards the log entries, colored, to every connection.
 func (ds *DebugServerBase) getNotifyMsg() {
-	for true {
-		msg := <-ds.notifyCh
+	format := &TextFormatter{true}
+	for msg := range ds.notifyCh {
+		text := []byte(formatLog(msg, format))
+		ds.mu.Lock()
 		for _, conn := range ds.clients {
-			conn.Write([]byte(msg.(string)))
+			conn.Write(text)
 		}
+		ds.mu.Unlock()
 	}
 }
 
@@ -44,6 +51,34 @@ func (ds *DebugServerBase) readConnData(ids IDebugServer, conn net.Conn) {
 	}
 }
 
+func (ds *DebugServerBase) kill(conn net.Conn) {
+	conn.Write([]byte("Kill Server...\n"))
+	conn.Close()
+	ds.tcpl.Close()
+	ds.mu.Lock()
+	onKill := ds.onKill
+	ds.mu.Unlock()
+	if onKill != nil {
+		onKill()
+	}
+}
+
+// close stops accepting and hangs up on every connection.
+func (ds *DebugServerBase) close() {
+	ds.tcpl.Close()
+	ds.mu.Lock()
+	for _, conn := range ds.clients {
+		conn.Close()
+	}
+	ds.mu.Unlock()
+}
+
+func (ds *DebugServerBase) setOnKill(f func()) {
+	ds.mu.Lock()
+	ds.onKill = f
+	ds.mu.Unlock()
+}
+
 func (ds *DebugServerBase) run(ids IDebugServer, wg *sync.WaitGroup) {
 	go ds.getNotifyMsg()
 	for true {
@@ -51,7 +86,9 @@ func (ds *DebugServerBase) run(ids IDebugServer, wg *sync.WaitGroup) {
 		if err != nil {
 			break
 		}
+		ds.mu.Lock()
 		ds.clients[tcpConn.RemoteAddr().String()] = tcpConn
+		ds.mu.Unlock()
 		go ds.readConnData(ids, tcpConn)
 	}
 	wg.Done()
@@ -67,15 +104,26 @@ func (hds *HotStuffDebugServer) handlePrint(conn net.Conn) {
 	msg := fmt.Sprintf(`
 HotStuff Server State:
 id:             %d
+protocol:       %s
 n:              %d
+epoch:          %d
+members:        %s
 viewId          %d
 gQC             %d
 	%s
 lQC             %d
     %s
-`, info["id"].(int), info["n"].(int), info["viewId"].(int),
+evidence        %d
+adversary       %s
+authFailures    %d
+logDropped      %d
+threshold       %s
+`, info["id"].(int), info["protocol"].(string), info["n"].(int),
+		info["epoch"].(int), info["members"].(string), info["viewId"].(int),
 		info["genericQCView"].(int), info["genericQCId"].(string),
-		info["lockedQCView"].(int), info["lockedQCId"].(string))
+		info["lockedQCView"].(int), info["lockedQCId"].(string),
+		info["evidence"].(int), info["adversary"].(string),
+		info["authFailures"].(int), info["logDropped"].(int), info["threshold"].(string))
 	conn.Write([]byte(msg))
 }
 
@@ -85,38 +133,78 @@ func (hds *HotStuffDebugServer) handleMaliciousBehavior(conn net.Conn, args []st
 		return
 	}
 
-	mbmode, err := strconv.Atoi(args[1])
+	name, err := hds.hotStuffServer.setAdversary(args[1:])
 	if err != nil {
-		conn.Write([]byte("Invalid malicious mode\n"))
+		conn.Write([]byte(err.Error() + "\n"))
 		return
 	}
 
-	err = hds.hotStuffServer.setMaliciousMode(mbmode)
+	conn.Write([]byte(fmt.Sprintf("malicious behavior set. mode[%s]\n", name)))
+}
+
+func (hds *HotStuffDebugServer) handleNodes(conn net.Conn) {
+	msg := hds.hotStuffServer.getRecentNodesWithLock()
+	conn.Write([]byte(msg))
+}
+
+func (hds *HotStuffDebugServer) handleChain(conn net.Conn, args []string) {
+	v, err := hds.hotStuffServer.exploreChain(args[1:])
 	if err != nil {
 		conn.Write([]byte(err.Error() + "\n"))
 		return
 	}
-
-	conn.Write([]byte(fmt.Sprintf("malicious behavior set. mode[%d]\n", mbmode)))
+	conn.Write([]byte(formatChain(v)))
 }
 
-func (hds *HotStuffDebugServer) handleNodes(conn net.Conn) {
-	msg := hds.hotStuffServer.getRecentNodesWithLock()
+func (hds *HotStuffDebugServer) handleEvidence(conn net.Conn) {
+	msg := hds.hotStuffServer.getEvidence()
 	conn.Write([]byte(msg))
 }
 
+func (hds *HotStuffDebugServer) handleDKG(conn net.Conn) {
+	id, err := hds.hotStuffServer.startDKG()
+	if err != nil {
+		conn.Write([]byte(err.Error() + "\n"))
+		return
+	}
+	conn.Write([]byte(fmt.Sprintf("DKG session[%s] started.\n", id)))
+}
+
+// handleStageKey reads the key to stage from a file of the replica's host,
+// so the key never crosses the console connection.
+func (hds *HotStuffDebugServer) handleStageKey(conn net.Conn, args []string) {
+	if len(args) < 2 {
+		conn.Write([]byte("Arguments not enough\n"))
+		return
+	}
+
+	priv, err := readHexFile(args[1])
+	if err != nil || len(priv) != ed25519.PrivateKeySize {
+		conn.Write([]byte(fmt.Sprintf("No private key in %s\n", args[1])))
+		return
+	}
+	hds.hotStuffServer.stageKey(priv)
+	conn.Write([]byte(fmt.Sprintf("Key staged, public key %x.\n", ed25519.PrivateKey(priv).Public())))
+}
+
 func (hds *HotStuffDebugServer) handleConnArgs(conn net.Conn, args []string) {
 	switch args[0] {
 	case "mb":
 		hds.handleMaliciousBehavior(conn, args)
 	case "kill":
-		conn.Write([]byte("Kill Server...\n"))
-		conn.Close()
-		hds.tcpl.Close()
+		hds.kill(conn)
 	case "print":
 		hds.handlePrint(conn)
 	case "nodes":
 		hds.handleNodes(conn)
+	case "chain":
+		hds.handleChain(conn, args)
+	case "evidence":
+		hds.handleEvidence(conn)
+	case "dkg":
+		hds.handleDKG(conn)
+	case "stagekey":
+		hds.handleStageKey(conn, args)
 	case "quit":
 		conn.Write([]byte("Bye!\n"))
 	case "echo":
@@ -159,9 +247,7 @@ func (cds *ClientDebugServer) handleConnArgs(conn net.Conn, args []string) {
 	case "req":
 		cds.handleRequest(conn, args)
 	case "kill":
-		conn.Write([]byte("Kill Server...\n"))
-		conn.Close()
-		cds.tcpl.Close()
+		cds.kill(conn)
 	case "print":
 		// handlePrint()
 	case "quit":
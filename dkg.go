@@ -0,0 +1,587 @@
+package hotstuff
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"sync"
+	"time"
+)
+
+// DKGRound is how long, in milliseconds, each step of a key generation
+// waits for the messages of the other replicas.
+const DKGRound = 2000
+
+const (
+	dkgAnnounce = iota
+	dkgDeal
+	dkgComplaint
+	dkgJustify
+	dkgEcho
+)
+
+// DKGArgs is one message of a distributed key generation. Key is the
+// sender's exchange key (announce, deal); Shares are the shares a dealer
+// hands out, each sealed to its recipient, and Commitment the dealer's
+// signed hash of its Commitments (deal); Target is the accused dealer
+// (complaint) or the complaining replica (justify), and Share the disputed
+// share in the clear (justify); Echoes are the signed hashes the sender got
+// from every dealer (echo).
+type DKGArgs struct {
+	RepId       int
+	Session     string
+	Phase       int
+	Key         []byte
+	Commitments [][]byte
+	Commitment  DKGCommitment
+	Shares      [][]byte
+	Target      int
+	Share       []byte
+	Echoes      []DKGCommitment
+	Sig         []byte
+}
+
+// DKGCommitment is a dealer's signed hash of the commitments it dealt.
+// Two of them with different hashes prove the dealer handed out different
+// commitments.
+type DKGCommitment struct {
+	Session string
+	Dealer  int
+	Hash    []byte
+	Sig     []byte
+}
+
+func (c *DKGCommitment) digest() []byte {
+	d := newDigest("dkg-commitment")
+	d.str(c.Session)
+	d.int(c.Dealer)
+	d.str(string(c.Hash))
+	return d.sum()
+}
+
+func (c *DKGCommitment) signer() peerIdentity    { return peerIdentity{false, c.Dealer} }
+func (c *DKGCommitment) signature() []byte       { return c.Sig }
+func (c *DKGCommitment) setSignature(sig []byte) { c.Sig = sig }
+
+func commitmentHash(commits [][]byte) []byte {
+	d := newDigest("dkg-commitments")
+	d.int(len(commits))
+	for _, commit := range commits {
+		d.str(string(commit))
+	}
+	return d.sum()
+}
+
+func (d *digestWriter) dkgCommitment(c *DKGCommitment) {
+	d.str(c.Session)
+	d.int(c.Dealer)
+	d.str(string(c.Hash))
+	d.str(string(c.Sig))
+}
+
+func (args *DKGArgs) digest() []byte {
+	d := newDigest("dkg")
+	d.int(args.RepId)
+	d.str(args.Session)
+	d.int(args.Phase)
+	d.str(string(args.Key))
+	d.int(len(args.Commitments))
+	for _, commit := range args.Commitments {
+		d.str(string(commit))
+	}
+	d.dkgCommitment(&args.Commitment)
+	d.int(len(args.Shares))
+	for _, share := range args.Shares {
+		d.str(string(share))
+	}
+	d.int(args.Target)
+	d.str(string(args.Share))
+	d.int(len(args.Echoes))
+	for i := range args.Echoes {
+		d.dkgCommitment(&args.Echoes[i])
+	}
+	return d.sum()
+}
+
+func (args *DKGArgs) signer() peerIdentity    { return peerIdentity{false, args.RepId} }
+func (args *DKGArgs) signature() []byte       { return args.Sig }
+func (args *DKGArgs) setSignature(sig []byte) { args.Sig = sig }
+
+// dkgSession is one run of a Pedersen-style key generation. Every replica
+// deals a random polynomial of degree t-1: each replica gets its share,
+// sealed to the exchange key it announced, and everyone gets Feldman
+// commitments to the coefficients. A replica with a missing or bad share
+// complains, and the dealer must answer by publishing that share; dealers
+// left with a complaint are disqualified. Every replica then echoes the
+// commitment hashes the dealers signed, and a dealer whose signed hashes
+// conflict dealt different commitments to different replicas and is
+// disqualified too, so the replicas agree on the commitments of the
+// qualified dealers. The group secret is the sum of
+// the secrets of the qualified dealers, which no replica ever learns. Like
+// any synchronous DKG it relies on messages arriving within a round.
+type dkgSession struct {
+	mu    *sync.Mutex
+	id    string
+	me    int
+	n     int
+	t     int
+	round time.Duration
+	keys  *SigningKeys
+	send  func(to int, args *DKGArgs)
+
+	exchangeKey  *ecdh.PrivateKey
+	exchangeKeys map[int]*ecdh.PublicKey
+	poly         polynomial
+	commitments  map[int][][]byte
+	dealt        map[int]DKGCommitment
+	shares       map[int]*big.Int
+	complaints   map[int]map[int]bool
+	conflicts    map[int]bool
+
+	// the timers of the rounds to come, stopped with the replica
+	timers   []*time.Timer
+	finished func(key *ThresholdKey, err error)
+	done     chan struct{}
+	result   *ThresholdKey
+	err      error
+}
+
+// shareKey derives the key a share from dealer to recipient is sealed with.
+func shareKey(priv *ecdh.PrivateKey, pub *ecdh.PublicKey, session string, dealer, recipient int) ([]byte, error) {
+	shared, err := priv.ECDH(pub)
+	if err != nil {
+		return nil, err
+	}
+	d := newDigest("dkg-share")
+	d.str(string(shared))
+	d.str(session)
+	d.int(dealer)
+	d.int(recipient)
+	return d.sum(), nil
+}
+
+func sealShare(key []byte, share *big.Int) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nonce, nonce, share.Bytes(), nil), nil
+}
+
+func openShare(key []byte, sealed []byte) (*big.Int, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return nil, errors.New("dkg: short share")
+	}
+	plain, err := gcm.Open(nil, sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():], nil)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(plain), nil
+}
+
+// validShare checks share, dealt to replica id, against the commitments.
+func validShare(commits [][]byte, id int, share *big.Int) bool {
+	expected, err := evalCommitments(commits, id+1)
+	return err == nil && string(scalarBaseMult(share)) == string(expected)
+}
+
+// broadcast signs args and sends it to every replica, handling our own
+// copy in place. It is called with the session locked.
+func (s *dkgSession) broadcast(args *DKGArgs) {
+	args.RepId = s.me
+	args.Session = s.id
+	s.keys.sign(args)
+	for i := 0; i < s.n; i++ {
+		if i != s.me {
+			s.send(i, args)
+		}
+	}
+	s.handle(args)
+}
+
+func (s *dkgSession) start() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	announce := &DKGArgs{}
+	announce.Phase = dkgAnnounce
+	announce.Key = s.exchangeKey.PublicKey().Bytes()
+	s.broadcast(announce)
+	s.timers = append(s.timers, time.AfterFunc(s.round, s.deal))
+	s.timers = append(s.timers, time.AfterFunc(2*s.round, s.echo))
+	s.timers = append(s.timers, time.AfterFunc(3*s.round, s.finish))
+}
+
+// stop ends the session before its rounds are over, so it never finishes.
+func (s *dkgSession) stop() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, timer := range s.timers {
+		timer.Stop()
+	}
+	if !s.isDone() {
+		s.err = errors.New("dkg: stopped")
+		close(s.done)
+	}
+}
+
+func (s *dkgSession) receive(args *DKGArgs) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.handle(args)
+}
+
+func (s *dkgSession) handle(args *DKGArgs) {
+	switch args.Phase {
+	case dkgAnnounce:
+		if pub, err := ecdh.X25519().NewPublicKey(args.Key); err == nil {
+			s.exchangeKeys[args.RepId] = pub
+		}
+	case dkgDeal:
+		s.onDeal(args)
+	case dkgComplaint:
+		if s.complaints[args.Target] == nil {
+			s.complaints[args.Target] = make(map[int]bool)
+		}
+		s.complaints[args.Target][args.RepId] = true
+		if args.Target == s.me && s.poly != nil {
+			justify := &DKGArgs{}
+			justify.Phase = dkgJustify
+			justify.Target = args.RepId
+			justify.Share = s.poly.eval(args.RepId + 1).Bytes()
+			s.broadcast(justify)
+		}
+	case dkgJustify:
+		commits, ok := s.commitments[args.RepId]
+		share := new(big.Int).SetBytes(args.Share)
+		if !ok || !validShare(commits, args.Target, share) {
+			return
+		}
+		delete(s.complaints[args.RepId], args.Target)
+		if args.Target == s.me {
+			s.shares[args.RepId] = share
+		}
+	case dkgEcho:
+		for i := range args.Echoes {
+			s.onEcho(&args.Echoes[i])
+		}
+	}
+}
+
+func (s *dkgSession) openDeal(args *DKGArgs) (*big.Int, error) {
+	pub, err := ecdh.X25519().NewPublicKey(args.Key)
+	if err != nil {
+		return nil, err
+	}
+	key, err := shareKey(s.exchangeKey, pub, s.id, args.RepId, s.me)
+	if err != nil {
+		return nil, err
+	}
+	return openShare(key, args.Shares[s.me])
+}
+
+func (s *dkgSession) onDeal(args *DKGArgs) {
+	if _, ok := s.commitments[args.RepId]; ok {
+		return
+	}
+	if len(args.Commitments) != s.t || len(args.Shares) != s.n {
+		return
+	}
+	c := args.Commitment
+	if c.Session != s.id || c.Dealer != args.RepId || string(c.Hash) != string(commitmentHash(args.Commitments)) || s.keys.verify(&c) != nil {
+		return
+	}
+	s.commitments[args.RepId] = args.Commitments
+	s.dealt[args.RepId] = c
+
+	share, err := s.openDeal(args)
+	if err == nil && validShare(args.Commitments, s.me, share) {
+		s.shares[args.RepId] = share
+		return
+	}
+
+	complaint := &DKGArgs{}
+	complaint.Phase = dkgComplaint
+	complaint.Target = args.RepId
+	s.broadcast(complaint)
+}
+
+// onEcho disqualifies the dealer of c when it signed another hash for us.
+func (s *dkgSession) onEcho(c *DKGCommitment) {
+	own, ok := s.dealt[c.Dealer]
+	if c.Session != s.id || !ok || string(own.Hash) == string(c.Hash) {
+		return
+	}
+	if s.keys.verify(c) != nil {
+		return
+	}
+	s.conflicts[c.Dealer] = true
+}
+
+// makeDeal seals the shares of poly to the replicas and signs the hash of
+// its commitments.
+func (s *dkgSession) makeDeal(poly polynomial) *DKGArgs {
+	deal := &DKGArgs{}
+	deal.Phase = dkgDeal
+	deal.Key = s.exchangeKey.PublicKey().Bytes()
+	deal.Commitments = poly.commitments()
+	deal.Commitment.Session = s.id
+	deal.Commitment.Dealer = s.me
+	deal.Commitment.Hash = commitmentHash(deal.Commitments)
+	s.keys.sign(&deal.Commitment)
+	deal.Shares = make([][]byte, s.n)
+	for i := 0; i < s.n; i++ {
+		// replicas we never heard from get nothing and have to complain
+		pub, ok := s.exchangeKeys[i]
+		if !ok {
+			continue
+		}
+		key, err := shareKey(s.exchangeKey, pub, s.id, s.me, i)
+		if err != nil {
+			continue
+		}
+		deal.Shares[i], _ = sealShare(key, poly.eval(i+1))
+	}
+	return deal
+}
+
+func (s *dkgSession) deal() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.isDone() {
+		return
+	}
+
+	secret, err := rand.Int(rand.Reader, thresholdCurve.Params().N)
+	if err == nil {
+		s.poly, err = randomPolynomial(secret, s.t-1)
+	}
+	if err != nil {
+		s.err = err
+		return
+	}
+	s.broadcast(s.makeDeal(s.poly))
+}
+
+// echo tells the other replicas the commitment hash we got from every
+// dealer.
+func (s *dkgSession) echo() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.isDone() {
+		return
+	}
+
+	echo := &DKGArgs{}
+	echo.Phase = dkgEcho
+	for i := 0; i < s.n; i++ {
+		if c, ok := s.dealt[i]; ok {
+			echo.Echoes = append(echo.Echoes, c)
+		}
+	}
+	s.broadcast(echo)
+}
+
+// qualified lists the dealers with commitments, no open complaint and no
+// conflicting commitment hash.
+func (s *dkgSession) qualified() []int {
+	var qual []int
+	for i := 0; i < s.n; i++ {
+		if _, ok := s.commitments[i]; ok && len(s.complaints[i]) == 0 && !s.conflicts[i] {
+			qual = append(qual, i)
+		}
+	}
+	return qual
+}
+
+func (s *dkgSession) combine() (*ThresholdKey, error) {
+	if s.err != nil {
+		return nil, s.err
+	}
+
+	// at least one qualified dealer must be honest
+	qual := s.qualified()
+	if len(qual) <= s.n-s.t {
+		return nil, fmt.Errorf("dkg: only %d qualified dealers", len(qual))
+	}
+
+	key := &ThresholdKey{}
+	key.Threshold = s.t
+	key.Index = s.me
+	key.Share = new(big.Int)
+	key.ShareKeys = make([][]byte, s.n)
+	for _, dealer := range qual {
+		share, ok := s.shares[dealer]
+		if !ok {
+			return nil, fmt.Errorf("dkg: no share from qualified dealer replica[%d]", dealer)
+		}
+		key.Share.Add(key.Share, share)
+		key.Share.Mod(key.Share, thresholdCurve.Params().N)
+
+		commits := s.commitments[dealer]
+		var err error
+		if key.GroupKey == nil {
+			key.GroupKey = commits[0]
+		} else if key.GroupKey, err = addPoints(key.GroupKey, commits[0]); err != nil {
+			return nil, err
+		}
+		for i := 0; i < s.n; i++ {
+			shareKey, err := evalCommitments(commits, i+1)
+			if err != nil {
+				return nil, err
+			}
+			if key.ShareKeys[i] != nil {
+				if shareKey, err = addPoints(key.ShareKeys[i], shareKey); err != nil {
+					return nil, err
+				}
+			}
+			key.ShareKeys[i] = shareKey
+		}
+	}
+	if err := key.check(); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+func (s *dkgSession) finish() {
+	s.mu.Lock()
+	if s.isDone() {
+		s.mu.Unlock()
+		return
+	}
+	s.result, s.err = s.combine()
+	close(s.done)
+	s.mu.Unlock()
+
+	if s.finished != nil {
+		s.finished(s.result, s.err)
+	}
+}
+
+func (s *dkgSession) isDone() bool {
+	select {
+	case <-s.done:
+		return true
+	default:
+		return false
+	}
+}
+
+func makeDKGSession(id string, me, n, t int, round time.Duration, keys *SigningKeys, send func(int, *DKGArgs)) (*dkgSession, error) {
+	exchangeKey, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &dkgSession{}
+	s.mu = &sync.Mutex{}
+	s.id = id
+	s.me = me
+	s.n = n
+	s.t = t
+	s.round = round
+	s.keys = keys
+	s.send = send
+	s.exchangeKey = exchangeKey
+	s.exchangeKeys = make(map[int]*ecdh.PublicKey)
+	s.commitments = make(map[int][][]byte)
+	s.dealt = make(map[int]DKGCommitment)
+	s.shares = make(map[int]*big.Int)
+	s.complaints = make(map[int]map[int]bool)
+	s.conflicts = make(map[int]bool)
+	s.done = make(chan struct{})
+	return s, nil
+}
+
+// joinDKG returns our part in session id, starting it when this is the
+// first we hear of the session.
+func (hs *HotStuff) joinDKG(id string) (*dkgSession, error) {
+	hs.dkgMu.Lock()
+	defer hs.dkgMu.Unlock()
+
+	if hs.dkg != nil && hs.dkg.id == id {
+		return hs.dkg, nil
+	}
+	select {
+	case <-hs.life.stopping:
+		return nil, errors.New("dkg: replica stopped")
+	default:
+	}
+	keys := hs.getKeys()
+	if keys == nil {
+		return nil, errors.New("dkg: replica runs without signing keys")
+	}
+	if hs.dkg != nil && !hs.dkg.isDone() {
+		return nil, fmt.Errorf("dkg: session %s still running", hs.dkg.id)
+	}
+
+	n := hs.replicaCount()
+	t := n - (n-1)/3
+	send := func(to int, args *DKGArgs) {
+		if o := hs.server(to); o != nil {
+			o.send("HotStuff.DKG", args)
+		}
+	}
+	s, err := makeDKGSession(id, hs.core.me, n, t, hs.dkgRound, keys, send)
+	if err != nil {
+		return nil, err
+	}
+	s.finished = func(key *ThresholdKey, err error) {
+		if err != nil {
+			hs.logger.log(ErrorLevel, "dkg_failed", "DKG failed", "session", id, "error", err.Error())
+			return
+		}
+		hs.exec(func() {
+			next := *hs.getKeys()
+			next.Threshold = key
+			hs.setKeys(&next)
+		})
+		hs.logger.log(InfoLevel, "dkg_finished", "DKG finished", "session", id, "threshold", fmt.Sprintf("%d of %d", key.Threshold, n), "groupKey", hex.EncodeToString(key.GroupKey))
+	}
+	hs.dkg = s
+	s.start()
+	return s, nil
+}
+
+// stopDKG stops the running session when the replica stops.
+func (hs *HotStuff) stopDKG() {
+	hs.dkgMu.Lock()
+	defer hs.dkgMu.Unlock()
+	if hs.dkg != nil {
+		hs.dkg.stop()
+	}
+}
+
+// startDKG begins a new key generation that the other replicas join as
+// soon as they hear of it.
+func (hs *HotStuff) startDKG() (string, error) {
+	id := fmt.Sprintf("%d-%d", hs.core.me, time.Now().UnixNano())
+	if _, err := hs.joinDKG(id); err != nil {
+		return "", err
+	}
+	return id, nil
+}
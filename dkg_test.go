@@ -0,0 +1,166 @@
+package hotstuff
+
+import (
+	"math/big"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// waitDKG waits for replica hs to join session id and returns the session
+// once it is done.
+func waitDKG(t *testing.T, hs *HotStuff, id string, deadline time.Time) *dkgSession {
+	var s *dkgSession
+	for s == nil && time.Now().Before(deadline) {
+		hs.dkgMu.Lock()
+		if hs.dkg != nil && hs.dkg.id == id {
+			s = hs.dkg
+		}
+		hs.dkgMu.Unlock()
+		time.Sleep(10 * time.Millisecond)
+	}
+	if s == nil {
+		t.Fatalf("replica[%d] never joined", hs.core.me)
+	}
+
+	select {
+	case <-s.done:
+	case <-time.After(time.Until(deadline)):
+		t.Fatalf("replica[%d] did not finish", hs.core.me)
+	}
+	return s
+}
+
+// Every replica of an in-process cluster ends up with a share of the same
+// group key.
+func TestDKG(t *testing.T) {
+	const replicas = 4
+	round := 100 * time.Millisecond
+	lc, err := makeLocalCluster(replicas, 0, ThreeChainMode, 0, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lc.stop()
+	for _, hs := range lc.servers {
+		hs.dkgRound = round
+	}
+
+	id, err := lc.servers[0].startDKG()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(10 * round)
+	keys := make([]*ThresholdKey, replicas)
+	for i, hs := range lc.servers {
+		s := waitDKG(t, hs, id, deadline)
+		if s.err != nil {
+			t.Fatalf("replica[%d]: %s", i, s.err)
+		}
+		keys[i] = s.result
+	}
+
+	for i, key := range keys {
+		if key.Threshold != replicas-(replicas-1)/3 {
+			t.Errorf("replica[%d] got threshold %d", i, key.Threshold)
+		}
+		if string(key.GroupKey) != string(keys[0].GroupKey) {
+			t.Errorf("replica[%d] got a different group key", i)
+		}
+		for j := range key.ShareKeys {
+			if string(key.ShareKeys[j]) != string(keys[0].ShareKeys[j]) {
+				t.Errorf("replica[%d] disagrees on the share key of replica[%d]", i, j)
+			}
+		}
+	}
+}
+
+// A dealer that deals other commitments to one replica is caught by the
+// echo of the commitment hashes and disqualified everywhere, so the
+// replicas still agree on the group key.
+func TestDKGEquivocatingDealer(t *testing.T) {
+	keys, _, err := GenerateSigningKeys(4, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	round := 100 * time.Millisecond
+	sessions := make([]*dkgSession, 4)
+	for i := range sessions {
+		send := func(to int, args *DKGArgs) { go sessions[to].receive(args) }
+		if sessions[i], err = makeDKGSession("test", i, 4, 3, round, keys[i], send); err != nil {
+			t.Fatal(err)
+		}
+	}
+	dealer := sessions[3]
+	send := dealer.send
+	dealer.send = func(to int, args *DKGArgs) {
+		if to == 2 && args.Phase == dkgDeal {
+			poly, err := randomPolynomial(big.NewInt(1), dealer.t-1)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			args = dealer.makeDeal(poly)
+			args.RepId = dealer.me
+			args.Session = dealer.id
+			dealer.keys.sign(args)
+		}
+		send(to, args)
+	}
+
+	for _, s := range sessions {
+		s.start()
+	}
+	for i, s := range sessions {
+		select {
+		case <-s.done:
+		case <-time.After(10 * round):
+			t.Fatalf("replica[%d] did not finish", i)
+		}
+		if s.err != nil {
+			t.Fatalf("replica[%d]: %s", i, s.err)
+		}
+		s.mu.Lock()
+		qual := s.qualified()
+		s.mu.Unlock()
+		if !reflect.DeepEqual(qual, []int{0, 1, 2}) {
+			t.Errorf("replica[%d] qualified %v, want [0 1 2]", i, qual)
+		}
+		if string(s.result.GroupKey) != string(sessions[0].result.GroupKey) {
+			t.Errorf("replica[%d] got a different group key", i)
+		}
+	}
+}
+
+// Stopping a replica stops the rounds of its key generation.
+func TestDKGStop(t *testing.T) {
+	lc, err := makeLocalCluster(4, 0, ThreeChainMode, 0, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	round := 50 * time.Millisecond
+	for _, hs := range lc.servers {
+		hs.dkgRound = round
+	}
+	hs := lc.servers[0]
+	if _, err := hs.startDKG(); err != nil {
+		t.Fatal(err)
+	}
+	lc.stop()
+	time.Sleep(4 * round)
+
+	hs.dkgMu.Lock()
+	s := hs.dkg
+	hs.dkgMu.Unlock()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.poly != nil || s.result != nil {
+		t.Error("session went on after the replica stopped")
+	}
+	if !s.isDone() || s.err == nil {
+		t.Error("session not ended by the stop")
+	}
+	if _, err := hs.startDKG(); err == nil {
+		t.Error("stopped replica started a key generation")
+	}
+}
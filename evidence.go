@@ -0,0 +1,176 @@
+package hotstuff
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+)
+
+// Evidence proves that replica RepId sent two conflicting messages in
+// ViewId: either two proposals for different nodes or two votes for
+// different nodes. Nodes are told apart by their digest, not their id,
+// which only names the view and the operation. Exactly one of Proposals
+// and Votes holds the pair.
+type Evidence struct {
+	RepId     int
+	ViewId    int
+	Proposals []ProposalArgs
+	Votes     []VoteArgs
+}
+
+func (ev *Evidence) key() string {
+	if len(ev.Proposals) > 0 {
+		return fmt.Sprintf("proposal_%d_%d", ev.RepId, ev.ViewId)
+	}
+	return fmt.Sprintf("vote_%d_%d", ev.RepId, ev.ViewId)
+}
+
+func (ev *Evidence) String() string {
+	if len(ev.Proposals) == 2 {
+		return fmt.Sprintf("rep[%d] view[%d] proposed node[%s] and node[%s]", ev.RepId, ev.ViewId, ev.Proposals[0].Node.Id, ev.Proposals[1].Node.Id)
+	}
+	if len(ev.Votes) == 2 {
+		return fmt.Sprintf("rep[%d] view[%d] voted node[%s] and node[%s]", ev.RepId, ev.ViewId, ev.Votes[0].NodeId, ev.Votes[1].NodeId)
+	}
+	return fmt.Sprintf("rep[%d] view[%d] malformed evidence", ev.RepId, ev.ViewId)
+}
+
+// verify checks that the evidence really incriminates RepId, so a replica
+// can't be framed by evidence built from messages it did not send: both
+// messages must carry valid signatures of RepId. Without keys nothing
+// proves who sent a message, and evidence is never trusted.
+func (ev *Evidence) verify(n int, keys *SigningKeys) error {
+	if keys == nil {
+		return errors.New("Evidence ignored without signing keys")
+	}
+	if ev.RepId < 0 || ev.RepId >= n {
+		return fmt.Errorf("Evidence against unknown replica[%d]", ev.RepId)
+	}
+
+	switch {
+	case len(ev.Proposals) == 2 && len(ev.Votes) == 0:
+		a, b := &ev.Proposals[0], &ev.Proposals[1]
+		for _, p := range []*ProposalArgs{a, b} {
+			if err := p.validate(n); err != nil {
+				return err
+			}
+			if p.RepId != ev.RepId || p.ViewId != ev.ViewId {
+				return errors.New("Evidence proposal from another replica or view")
+			}
+			if err := keys.verify(p); err != nil {
+				return err
+			}
+		}
+		if bytes.Equal(a.Node.hash(), b.Node.hash()) {
+			return errors.New("Evidence proposals do not conflict")
+		}
+	case len(ev.Votes) == 2 && len(ev.Proposals) == 0:
+		a, b := &ev.Votes[0], &ev.Votes[1]
+		for _, v := range []*VoteArgs{a, b} {
+			if err := v.validate(n); err != nil {
+				return err
+			}
+			if v.RepId != ev.RepId || v.ViewId != ev.ViewId {
+				return errors.New("Evidence vote from another replica or view")
+			}
+			if err := keys.verify(v); err != nil {
+				return err
+			}
+		}
+		if keyOf(a) == keyOf(b) {
+			return errors.New("Evidence votes do not conflict")
+		}
+	default:
+		return errors.New("Evidence must hold two proposals or two votes")
+	}
+	return nil
+}
+
+func makeProposalEvidence(a, b *ProposalArgs) *Evidence {
+	ev := &Evidence{}
+	ev.RepId = a.RepId
+	ev.ViewId = a.ViewId
+	ev.Proposals = []ProposalArgs{*a, *b}
+	return ev
+}
+
+func makeVoteEvidence(a, b *VoteArgs) *Evidence {
+	ev := &Evidence{}
+	ev.RepId = a.RepId
+	ev.ViewId = a.ViewId
+	ev.Votes = []VoteArgs{*a, *b}
+	return ev
+}
+
+// equivocationError is returned by the vote collector when a replica votes
+// for two different nodes in the same view.
+type equivocationError struct {
+	prev *VoteArgs
+	vote *VoteArgs
+}
+
+func (e *equivocationError) Error() string {
+	return fmt.Sprintf("Equivocating vote from rep[%d] view[%d]: node[%s] and node[%s]", e.vote.RepId, e.vote.ViewId, e.prev.NodeId, e.vote.NodeId)
+}
+
+// addEvidence records evidence the first time it is seen and gossips it to
+// every replica, so all honest replicas end up knowing the faulty one.
+// Without keys the others would ignore it, so it is kept to ourselves.
+func (hc *hotStuffCore) addEvidence(ev *Evidence) {
+	key := ev.key()
+	if _, ok := hc.evidence[key]; ok {
+		return
+	}
+	hc.evidence[key] = ev
+
+	hc.log(WarnLevel, "equivocation", "Equivocation detected", "evidence", ev.String())
+	if hc.keys == nil {
+		return
+	}
+	for id := 0; id < hc.replicas; id++ {
+		if id != hc.me {
+			hc.sendMsg(id, "Evidence", ev)
+		}
+	}
+}
+
+// proposalWindow is how many past views of proposals are kept to compare
+// new proposals against.
+const proposalWindow = 16
+
+// checkProposal remembers the first proposal seen in each view and reports
+// the leader if a different one shows up.
+func (hc *hotStuffCore) checkProposal(args *ProposalArgs) bool {
+	prev, ok := hc.proposals[args.ViewId]
+	if !ok {
+		hc.proposals[args.ViewId] = args
+		return true
+	}
+	if bytes.Equal(prev.Node.hash(), args.Node.hash()) {
+		return true
+	}
+
+	hc.addEvidence(makeProposalEvidence(prev, args))
+	return false
+}
+
+func (hc *hotStuffCore) pruneProposals() {
+	for viewId := range hc.proposals {
+		if viewId < hc.viewId-proposalWindow {
+			delete(hc.proposals, viewId)
+		}
+	}
+}
+
+func (hc *hotStuffCore) getEvidence() string {
+	msg := fmt.Sprintf("Evidence: %d\n", len(hc.evidence))
+	faulty := make(map[int]bool)
+	for _, ev := range hc.evidence {
+		msg += fmt.Sprintf("    %s\n", ev.String())
+		faulty[ev.RepId] = true
+	}
+	for repId := range faulty {
+		msg += fmt.Sprintf("Faulty replica: %d\n", repId)
+	}
+	return msg
+}
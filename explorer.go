@@ -0,0 +1,416 @@
+package hotstuff
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// The status of a node in the block tree of a replica.
+const (
+	// executed, numbered by height in the order of execution
+	statusCommitted = "committed"
+	// an ancestor of a committed node that was not executed itself, such
+	// as the dummy nodes filling the views without a QC
+	statusChain = "chain"
+	// extends the last committed node, may still commit
+	statusPending = "pending"
+	// conflicts with the committed chain, can never commit
+	statusAbandoned = "abandoned"
+)
+
+// chainExplorer answers questions about the block tree a replica has
+// seen. It reads the core directly and must be used on the event loop.
+type chainExplorer struct {
+	nodes     map[string]*LogNode
+	committed []*LogNode
+	height    map[string]int
+	status    map[string]string
+	children  map[string][]string
+}
+
+// maxChainLimit caps how many nodes a query for ancestors or descendants
+// lists, since it runs on the event loop.
+const maxChainLimit = 1000
+
+// ChainNode is a node of the block tree as the explorer shows it. Height
+// is the position of a committed node in the log, from 1.
+type ChainNode struct {
+	Id        string      `json:"id"`
+	Parent    string      `json:"parent"`
+	Epoch     int         `json:"epoch"`
+	View      int         `json:"view"`
+	Height    int         `json:"height,omitempty"`
+	Status    string      `json:"status"`
+	Dummy     bool        `json:"dummy,omitempty"`
+	Op        interface{} `json:"op"`
+	Client    int         `json:"client"`
+	Timestamp int64       `json:"timestamp,omitempty"`
+	QC        ChainQC     `json:"qc"`
+	Children  []string    `json:"children,omitempty"`
+}
+
+type ChainQC struct {
+	Epoch int    `json:"epoch"`
+	View  int    `json:"view"`
+	Node  string `json:"node"`
+}
+
+// ChainFork is a branch that left the committed chain at Base and was
+// abandoned.
+type ChainFork struct {
+	Base  string   `json:"base"`
+	Nodes []string `json:"nodes"`
+}
+
+func isDummy(n *LogNode) bool {
+	return n.Request.Timestamp == 0 && n.Request.Operation == "dummy"
+}
+
+func makeChainExplorer(hc *hotStuffCore) *chainExplorer {
+	ex := &chainExplorer{}
+	ex.nodes = hc.nodeMap
+	ex.committed = hc.committed
+	ex.height = make(map[string]int)
+	ex.status = make(map[string]string)
+	ex.children = make(map[string][]string)
+
+	for id, node := range ex.nodes {
+		if parent := ex.parentOf(node); parent != nil {
+			ex.children[parent.Id] = append(ex.children[parent.Id], id)
+		}
+	}
+	for _, ids := range ex.children {
+		sort.Slice(ids, func(i, j int) bool { return ex.before(ids[i], ids[j]) })
+	}
+
+	for i, node := range ex.committed {
+		ex.height[node.Id] = i + 1
+		ex.status[node.Id] = statusCommitted
+	}
+	for _, node := range ex.committed {
+		for parent := ex.parentOf(node); parent != nil && ex.status[parent.Id] == ""; parent = ex.parentOf(parent) {
+			ex.status[parent.Id] = statusChain
+		}
+	}
+
+	// what extends the last committed node may still commit, and so may
+	// anything at all before the first commit
+	var tips []string
+	if len(ex.committed) > 0 {
+		tips = ex.children[ex.committed[len(ex.committed)-1].Id]
+	} else {
+		for id, node := range ex.nodes {
+			if ex.parentOf(node) == nil {
+				tips = append(tips, id)
+			}
+		}
+	}
+	ex.walk(tips, -1, func(id string) {
+		if ex.status[id] == "" {
+			ex.status[id] = statusPending
+		}
+	})
+	for id := range ex.nodes {
+		if ex.status[id] == "" {
+			ex.status[id] = statusAbandoned
+		}
+	}
+	return ex
+}
+
+// parentOf returns the parent of n. Replicas never see the dummy nodes
+// of the views a leader skipped, only the nodes extending them; those hang
+// off their QC, where the dummy nodes start. Like the core it ignores a
+// parent from a view not before n, so the tree has no cycles.
+func (ex *chainExplorer) parentOf(n *LogNode) *LogNode {
+	parent := ex.nodes[n.Parent]
+	if parent == nil && n.Parent != "" {
+		parent = ex.nodes[n.Justify.NodeId]
+	}
+	if parent == nil || parent.ViewId >= n.ViewId {
+		return nil
+	}
+	return parent
+}
+
+// before orders nodes by view, then id.
+func (ex *chainExplorer) before(a, b string) bool {
+	na, nb := ex.nodes[a], ex.nodes[b]
+	if na.ViewId != nb.ViewId {
+		return na.ViewId < nb.ViewId
+	}
+	return a < b
+}
+
+// walk visits the subtrees below ids breadth first, each node once and at
+// most limit nodes when limit is not negative.
+func (ex *chainExplorer) walk(ids []string, limit int, visit func(id string)) {
+	visited := make(map[string]bool)
+	queue := append([]string{}, ids...)
+	for len(queue) > 0 && limit != 0 {
+		id := queue[0]
+		queue = queue[1:]
+		if visited[id] {
+			continue
+		}
+		visited[id] = true
+		visit(id)
+		limit--
+		queue = append(queue, ex.children[id]...)
+	}
+}
+
+func (ex *chainExplorer) info(n *LogNode) ChainNode {
+	cn := ChainNode{}
+	cn.Id = n.Id
+	cn.Parent = n.Parent
+	cn.Epoch = n.Epoch
+	cn.View = n.ViewId
+	cn.Height = ex.height[n.Id]
+	cn.Status = ex.status[n.Id]
+	cn.Dummy = isDummy(n)
+	cn.Op = n.Request.Operation
+	cn.Client = n.Request.ClientId
+	cn.Timestamp = n.Request.Timestamp
+	cn.QC = ChainQC{n.Justify.Epoch, n.Justify.ViewId, n.Justify.NodeId}
+	cn.Children = append([]string{}, ex.children[n.Id]...)
+	return cn
+}
+
+func (ex *chainExplorer) lookup(id string) (*LogNode, error) {
+	node := ex.nodes[id]
+	if node == nil {
+		return nil, fmt.Errorf("unknown node[%s]", id)
+	}
+	return node, nil
+}
+
+// committedRange lists the committed nodes with heights from to to,
+// both included, at most maxChainLimit of them; to 0 means the last one.
+func (ex *chainExplorer) committedRange(from, to int) []ChainNode {
+	if from < 1 {
+		from = 1
+	}
+	if to <= 0 || to > len(ex.committed) {
+		to = len(ex.committed)
+	}
+	if to-from+1 > maxChainLimit {
+		to = from + maxChainLimit - 1
+	}
+	nodes := []ChainNode{}
+	for h := from; h <= to; h++ {
+		nodes = append(nodes, ex.info(ex.committed[h-1]))
+	}
+	return nodes
+}
+
+func (ex *chainExplorer) node(id string) (ChainNode, error) {
+	node, err := ex.lookup(id)
+	if err != nil {
+		return ChainNode{}, err
+	}
+	return ex.info(node), nil
+}
+
+// ancestors follows the parents of id, nearest first.
+func (ex *chainExplorer) ancestors(id string, limit int) ([]ChainNode, error) {
+	node, err := ex.lookup(id)
+	if err != nil {
+		return nil, err
+	}
+	nodes := []ChainNode{}
+	visited := map[string]bool{node.Id: true}
+	for parent := ex.parentOf(node); parent != nil && !visited[parent.Id] && len(nodes) != limit; parent = ex.parentOf(parent) {
+		visited[parent.Id] = true
+		nodes = append(nodes, ex.info(parent))
+	}
+	return nodes, nil
+}
+
+// descendants lists the subtree below id breadth first.
+func (ex *chainExplorer) descendants(id string, limit int) ([]ChainNode, error) {
+	if _, err := ex.lookup(id); err != nil {
+		return nil, err
+	}
+	nodes := []ChainNode{}
+	ex.walk(ex.children[id], limit, func(id string) {
+		nodes = append(nodes, ex.info(ex.nodes[id]))
+	})
+	return nodes, nil
+}
+
+// forks lists the abandoned branches, by the view of their first node.
+func (ex *chainExplorer) forks() []ChainFork {
+	var roots []string
+	for id, node := range ex.nodes {
+		parent := ex.parentOf(node)
+		if ex.status[id] == statusAbandoned && (parent == nil || ex.status[parent.Id] != statusAbandoned) {
+			roots = append(roots, id)
+		}
+	}
+	sort.Slice(roots, func(i, j int) bool { return ex.before(roots[i], roots[j]) })
+
+	forks := []ChainFork{}
+	for _, root := range roots {
+		fork := ChainFork{}
+		if parent := ex.parentOf(ex.nodes[root]); parent != nil {
+			fork.Base = parent.Id
+		}
+		ex.walk([]string{root}, -1, func(id string) {
+			fork.Nodes = append(fork.Nodes, id)
+		})
+		forks = append(forks, fork)
+	}
+	return forks
+}
+
+var dotStyles = map[string]string{
+	statusCommitted: `style=filled, fillcolor="palegreen"`,
+	statusChain:     `style=filled, fillcolor="lightgrey"`,
+	statusPending:   `style=solid`,
+	statusAbandoned: `style="filled,dashed", fillcolor="mistyrose"`,
+}
+
+// dot renders the block tree in Graphviz DOT: parents point to their
+// children, QCs are dashed edges to the node they certify. Dummy nodes are
+// ellipses; dummy nodes the replica never saw are dotted, after the node
+// their chain starts from.
+func (ex *chainExplorer) dot() string {
+	ids := make([]string, 0, len(ex.nodes))
+	for id := range ex.nodes {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ex.before(ids[i], ids[j]) })
+
+	b := &strings.Builder{}
+	b.WriteString("digraph chain {\n")
+	b.WriteString("\trankdir=LR;\n")
+	b.WriteString("\tnode [shape=box, fontname=\"monospace\"];\n")
+	missing := make(map[string]bool)
+	for _, id := range ids {
+		node := ex.nodes[id]
+		label := fmt.Sprintf("%s\nview %d epoch %d", id, node.ViewId, node.Epoch)
+		if h := ex.height[id]; h > 0 {
+			label += fmt.Sprintf("\nheight %d", h)
+		}
+		attrs := dotStyles[ex.status[id]]
+		if isDummy(node) {
+			attrs += ", shape=ellipse"
+		}
+		fmt.Fprintf(b, "\t%s [label=%s, %s];\n", strconv.Quote(id), strconv.Quote(label), attrs)
+
+		if node.Parent != "" {
+			if ex.nodes[node.Parent] == nil && !missing[node.Parent] {
+				missing[node.Parent] = true
+				fmt.Fprintf(b, "\t%s [shape=ellipse, style=dotted];\n", strconv.Quote(node.Parent))
+				if parent := ex.parentOf(node); parent != nil {
+					fmt.Fprintf(b, "\t%s -> %s [style=dotted];\n", strconv.Quote(parent.Id), strconv.Quote(node.Parent))
+				}
+			}
+			fmt.Fprintf(b, "\t%s -> %s;\n", strconv.Quote(node.Parent), strconv.Quote(id))
+		}
+		if node.Justify.NodeId != "" && ex.nodes[node.Justify.NodeId] != nil {
+			fmt.Fprintf(b, "\t%s -> %s [style=dashed, color=\"blue\", constraint=false, label=\"qc %d\"];\n",
+				strconv.Quote(id), strconv.Quote(node.Justify.NodeId), node.Justify.ViewId)
+		}
+	}
+	b.WriteString("}\n")
+	return b.String()
+}
+
+// query answers a chain command of the debug console:
+//
+//	committed [from [to]]
+//	node <id>
+//	ancestors <id> [limit]
+//	descendants <id> [limit]
+//	forks
+//	dot
+//
+// A negative limit, or one above maxChainLimit, means maxChainLimit, and
+// committed lists at most maxChainLimit nodes from from on.
+func (ex *chainExplorer) query(args []string) (interface{}, error) {
+	if len(args) == 0 {
+		return nil, errors.New("usage: chain committed|node|ancestors|descendants|forks|dot")
+	}
+	ints := make([]int, 0, 2)
+	for _, arg := range args[1:] {
+		if v, err := strconv.Atoi(arg); err == nil {
+			ints = append(ints, v)
+		}
+	}
+	limit := 10
+	if len(ints) > 0 {
+		limit = ints[0]
+	}
+	if limit < 0 || limit > maxChainLimit {
+		limit = maxChainLimit
+	}
+
+	switch args[0] {
+	case "committed":
+		for len(ints) < 2 {
+			ints = append(ints, 0)
+		}
+		return ex.committedRange(ints[0], ints[1]), nil
+	case "forks":
+		return ex.forks(), nil
+	case "dot":
+		return ex.dot(), nil
+	case "node", "ancestors", "descendants":
+		if len(args) < 2 {
+			return nil, errors.New("usage: chain " + args[0] + " <id>")
+		}
+	default:
+		return nil, errors.New("unknown chain command " + args[0])
+	}
+
+	switch args[0] {
+	case "ancestors":
+		return ex.ancestors(args[1], limit)
+	case "descendants":
+		return ex.descendants(args[1], limit)
+	}
+	return ex.node(args[1])
+}
+
+func formatChainNode(cn ChainNode) string {
+	msg := fmt.Sprintf("nodeId[%s] view[%d] epoch[%d] %s", cn.Id, cn.View, cn.Epoch, cn.Status)
+	if cn.Height > 0 {
+		msg += fmt.Sprintf(" height[%d]", cn.Height)
+	}
+	msg += fmt.Sprintf(" parent[%s] qc[%s]", cn.Parent, cn.QC.Node)
+	return msg
+}
+
+// formatChain renders the answer of query for the debug console.
+func formatChain(v interface{}) string {
+	var msg string
+	switch v := v.(type) {
+	case []ChainNode:
+		for _, cn := range v {
+			msg += "    " + formatChainNode(cn) + "\n"
+		}
+		if len(v) == 0 {
+			msg = "    none\n"
+		}
+	case ChainNode:
+		msg = formatChainNode(v) + "\n"
+		msg += fmt.Sprintf("    op[%v] client[%d] timestamp[%d]\n", v.Op, v.Client, v.Timestamp)
+		msg += fmt.Sprintf("    qc: epoch[%d] view[%d] node[%s]\n", v.QC.Epoch, v.QC.View, v.QC.Node)
+		msg += fmt.Sprintf("    children%v\n", v.Children)
+	case []ChainFork:
+		for _, fork := range v {
+			msg += fmt.Sprintf("    base[%s] nodes%v\n", fork.Base, fork.Nodes)
+		}
+		if len(v) == 0 {
+			msg = "    none\n"
+		}
+	case string:
+		msg = v
+	}
+	return msg
+}
@@ -0,0 +1,56 @@
+package hotstuff
+
+import (
+	"fmt"
+	"testing"
+)
+
+func logNode(id, parent string, viewId int) *LogNode {
+	node := &LogNode{}
+	node.Id = id
+	node.Parent = parent
+	node.ViewId = viewId
+	return node
+}
+
+// Parent links that loop, as a faulty leader can send them, do not trap
+// the explorer, and no query lists more than maxChainLimit nodes.
+func TestExplorerQuery(t *testing.T) {
+	hc := makeHotStuffCore(0, 4, ThreeChainMode, nil)
+	hc.nodeMap["a"] = logNode("a", "b", 2)
+	hc.nodeMap["b"] = logNode("b", "a", 2)
+	hc.nodeMap["c"] = logNode("c", "c", 3)
+	parent := ""
+	for v := 1; v <= maxChainLimit+10; v++ {
+		id := fmt.Sprintf("%d_noop", v)
+		hc.nodeMap[id] = logNode(id, parent, v)
+		hc.committed = append(hc.committed, hc.nodeMap[id])
+		parent = id
+	}
+	ex := makeChainExplorer(hc)
+
+	tests := []struct {
+		args  []string
+		nodes int
+	}{
+		{[]string{"ancestors", "a"}, 0},
+		{[]string{"ancestors", "c", "-1"}, 0},
+		{[]string{"descendants", "b", "-1"}, 0},
+		{[]string{"descendants", "1_noop", "-1"}, maxChainLimit},
+		{[]string{"descendants", "1_noop", "5000"}, maxChainLimit},
+		{[]string{"ancestors", parent, "-1"}, maxChainLimit},
+		{[]string{"ancestors", parent, "3"}, 3},
+		{[]string{"committed"}, maxChainLimit},
+		{[]string{"committed", "5", "5000"}, maxChainLimit},
+		{[]string{"committed", "5", "7"}, 3},
+	}
+	for _, test := range tests {
+		v, err := ex.query(test.args)
+		if err != nil {
+			t.Fatalf("%v: %s", test.args, err)
+		}
+		if nodes := v.([]ChainNode); len(nodes) != test.nodes {
+			t.Errorf("%v: %d nodes, want %d", test.args, len(nodes), test.nodes)
+		}
+	}
+}
@@ -1,356 +1,529 @@
 package hotstuff
 
 import (
+	"context"
+	"crypto/ed25519"
+	"encoding/gob"
 	"fmt"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
-const ViewTimeOut = 15000
-const NoopTimeOut = 4000
+// callEvent runs f on the event loop, between two protocol events.
+type callEvent struct {
+	f func()
+}
 
+// HotStuff drives a hotStuffCore: RPC handlers and timers turn incoming
+// messages into events on eventCh, and a single goroutine feeds them to
+// the core and carries out the actions it emits.
 type HotStuff struct {
-	mu            *sync.Mutex
-	servers       []peerWrapper
-	clients       []peerWrapper
-	request       *RequestArgs
-	n             int
-	f             int
-	me            int
-	viewId        int
-	nodeMap       map[string]*LogNode
-	lastNode      *LogNode
-	genericQC     QC
-	lockedQC      QC
-	savedMsgs     map[int]*MsgArgs
-	viewTimer     *TimerWithCancel
-	noopTimer     *TimerWithCancel
-	maliciousMode MaliciousBehaviorMode
-
-	debugCh chan interface{}
+	// servers grows when a reconfiguration adds a replica
+	peersMu   *sync.RWMutex
+	servers   []*outbox
+	clients   []*outbox
+	dial      func(id int, address string) caller
+	core      *hotStuffCore
+	eventCh   chan interface{}
+	timers    map[timerKind]*time.Timer
+	adversary Adversary
+	// keys are replaced, never modified, once the replica runs
+	keysMu    *sync.RWMutex
+	keys      *SigningKeys
+	stagedKey ed25519.PrivateKey
+	// updated atomically by the RPC handlers
+	authFailures int64
+
+	dkgMu    *sync.Mutex
+	dkg      *dkgSession
+	dkgRound time.Duration
+
+	metrics *metricsRegistry
+	views   *rateWindow
+	// when each proposal arrived, for the commit latency
+	proposalSeen map[string]time.Time
+	proposalView map[string]int
+
+	logger *Logger
+	tracer *Tracer
+	// the open phase span of each traced node
+	phases map[string]*Span
+
+	life *lifecycle
+	// once the event loop is gone, exec runs on the caller under haltedMu
+	haltedMu *sync.Mutex
 }
 
-func (hs *HotStuff) isLeader() bool {
-	return hs.me == hs.viewId%hs.n
+// Start runs the outboxes and the event loop, which begins the first view.
+func (hs *HotStuff) Start() error {
+	return hs.life.start(func() {
+		hs.peersMu.RLock()
+		for _, o := range hs.servers {
+			o.start(hs.life)
+		}
+		for _, o := range hs.clients {
+			o.start(hs.life)
+		}
+		hs.peersMu.RUnlock()
+		hs.life.goWorker(hs.run)
+	})
 }
 
-func (hs *HotStuff) isNextLeader() bool {
-	return hs.me == (hs.viewId+1)%hs.n
+// Stop closes the listeners of the replica, ends its event loop, timers
+// and outboxes, then writes out its log and trace. It returns when all
+// that is done or ctx is, whichever comes first.
+func (hs *HotStuff) Stop(ctx context.Context) error {
+	return hs.life.stop(ctx)
 }
 
-func (hs *HotStuff) getLeader(viewId int) peerWrapper {
-	id := viewId % hs.n
-	return hs.servers[id]
+// flush ends the log and trace once the event loop is gone.
+func (hs *HotStuff) flush() error {
+	hs.logger.close()
+	return hs.tracer.close()
 }
 
-func (hs *HotStuff) broadcast(rpcname string, rpcargs interface{}) {
-	for id := range hs.servers {
-		hs.sendMsg(id, rpcname, rpcargs)
+// post hands e to the event loop, or drops it once the replica stops.
+func (hs *HotStuff) post(e interface{}) {
+	select {
+	case hs.eventCh <- e:
+	case <-hs.life.stopping:
 	}
 }
 
-func (hs *HotStuff) sendMsg(id int, rpcname string, rpcacgs interface{}) {
-	switch hs.maliciousMode {
-	case NormalMode:
-		hs.rawSendMsg(id, rpcname, rpcacgs)
-	case CrashedLike:
-		return
-	case MaliciousMode:
-		hs.sendMaliciousMsg(id, rpcname, rpcacgs, false)
-	case PartialMaliciousMode:
-		hs.sendMaliciousMsg(id, rpcname, rpcacgs, true)
+func (hs *HotStuff) run() {
+	hs.perform(hs.core.start())
+	for {
+		var e interface{}
+		select {
+		case e = <-hs.eventCh:
+		case <-hs.life.stopping:
+			hs.halt()
+			return
+		}
+		if call, ok := e.(callEvent); ok {
+			call.f()
+			continue
+		}
+		if p, ok := e.(proposalEvent); ok {
+			hs.noteProposal(p.msg)
+		}
+		span := hs.traceEvent(e)
+		hs.perform(hs.core.step(e))
+		span.end()
 	}
 }
 
-func (hs *HotStuff) rawSendMsg(id int, rpcname string, rpcacgs interface{}) {
-	p := hs.servers[id]
-	reply := &DefaultReply{}
-	go p.Call("HotStuff."+rpcname, rpcacgs, reply)
+// halt cancels the timers and ends the phase spans still open as the
+// event loop stops.
+func (hs *HotStuff) halt() {
+	for _, t := range hs.timers {
+		t.Stop()
+	}
+	for nodeId, span := range hs.phases {
+		span.set("stopped", true)
+		span.end()
+		delete(hs.phases, nodeId)
+	}
 }
 
-func (hs *HotStuff) replyClient(clientId int, replyArgs *ReplyArgs) {
-	client := hs.clients[clientId]
-	defaultReply := &DefaultReply{}
-	go client.Call("Client.Reply", replyArgs, defaultReply)
+func (hs *HotStuff) perform(actions []interface{}) {
+	for _, action := range actions {
+		switch a := action.(type) {
+		case sendAction:
+			if a.method == "Propose" && a.to == hs.core.me {
+				hs.metrics.observe("hotstuff_proposal_size_bytes", float64(encodedSize(a.args)))
+				hs.traceProposal(a.args.(*ProposalArgs))
+			}
+			hs.sendMsg(a.to, a.method, a.args)
+		case replyAction:
+			hs.replyClient(a.clientId, a.reply)
+		case timerAction:
+			hs.setTimer(a)
+		case logAction:
+			hs.logger.write(a.entry)
+		case reconfigAction:
+			hs.reconfigure(a.cmd)
+		case metricAction:
+			hs.recordMetric(a)
+			hs.tracePhase(a)
+		}
+	}
 }
 
-func (hs *HotStuff) debugPrint(msg string) {
-	hs.debugCh <- msg
+func (hs *HotStuff) noteProposal(args *ProposalArgs) {
+	if _, ok := hs.proposalSeen[args.Node.Id]; !ok {
+		hs.proposalSeen[args.Node.Id] = time.Now()
+		hs.proposalView[args.Node.Id] = args.ViewId
+	}
 }
 
-func (hs *HotStuff) processClientRequest(request *RequestArgs) {
-	curProposal := hs.createLeaf(hs.genericQC.NodeId, request, hs.genericQC)
-	genericMsg := &MsgArgs{}
-	genericMsg.RepId = hs.me
-	genericMsg.ViewId = hs.viewId
-	genericMsg.Node = *curProposal
-	hs.broadcast("Msg", genericMsg)
+func (hs *HotStuff) recordMetric(a metricAction) {
+	switch a.event {
+	case viewStarted:
+		hs.metrics.set("hotstuff_view", float64(a.viewId))
+		hs.metrics.add("hotstuff_views_total", 1)
+		hs.views.record()
+		// proposals that never commit are forgotten after a while
+		for nodeId, viewId := range hs.proposalView {
+			if viewId < a.viewId-100 {
+				delete(hs.proposalSeen, nodeId)
+				delete(hs.proposalView, nodeId)
+			}
+		}
+	case viewTimedOut:
+		hs.metrics.add("hotstuff_timeouts_total", 1)
+	case qcFormed:
+		hs.metrics.add("hotstuff_qcs_total", 1)
+	case nodeCommitted:
+		hs.metrics.add("hotstuff_commits_total", 1)
+		if seen, ok := hs.proposalSeen[a.nodeId]; ok {
+			hs.metrics.observe("hotstuff_commit_latency_seconds", time.Since(seen).Seconds())
+			delete(hs.proposalSeen, a.nodeId)
+			delete(hs.proposalView, a.nodeId)
+		}
+	}
 }
 
-func (hs *HotStuff) createLeaf(parent string, request *RequestArgs, qc QC) *LogNode {
-	if request == nil {
-		return nil
+// observeCall counts the calls made to a replica or client.
+func (hs *HotStuff) observeCall(client bool) func(int, string, error) {
+	return func(id int, method string, err error) {
+		peer := identityName(client, id)
+		hs.metrics.add("hotstuff_messages_sent_total", 1, "peer", peer, "method", methodName(method))
+		if err != nil {
+			hs.metrics.add("hotstuff_rpc_errors_total", 1, "peer", peer)
+		}
 	}
+}
 
-	parentNode, ok := hs.nodeMap[parent]
-	if ok {
-		tmpView := parentNode.ViewId + 1
-		for tmpView < hs.viewId {
-			dummyNode := &LogNode{}
-			dummyNode.ViewId = tmpView
-			dummyNode.Parent = parent
-			dummyNode.Request = RequestArgs{}
-			dummyNode.Request.Operation = "dummy"
-			dummyNode.Id = getLogNodeId(dummyNode.ViewId, &dummyNode.Request)
-			dummyNode.Justify = QC{}
-			hs.nodeMap[dummyNode.Id] = dummyNode
-			parent = dummyNode.Id
-			tmpView++
-		}
+// received counts a message once it is authenticated.
+func (hs *HotStuff) received(method string, sender peerIdentity) {
+	hs.peersMu.RLock()
+	n := len(hs.servers)
+	if sender.client {
+		n = len(hs.clients)
 	}
+	hs.peersMu.RUnlock()
+	hs.metrics.add("hotstuff_messages_received_total", 1, "peer", peerLabel(sender.client, sender.id, n), "method", method)
+}
 
-	node := &LogNode{}
-	node.ViewId = hs.viewId
-	node.Parent = parent
-	node.Request = *request
-	node.Id = getLogNodeId(hs.viewId, request)
-	node.Justify = qc
+func encodedSize(args interface{}) int {
+	w := &countingWriter{}
+	gob.NewEncoder(w).Encode(args)
+	return w.n
+}
 
-	hs.saveNode(node)
-	msg := fmt.Sprintf("\033[0;32mCreate Leaf:\033[0m id[%s] parent[%s] view[%d] op[%s]\n", node.Id, node.Parent, node.ViewId, node.Request.Operation.(string))
-	hs.debugPrint(msg)
-	return node
+type countingWriter struct {
+	n int
 }
 
-func (hs *HotStuff) safeNode(n *LogNode, qc QC) bool {
-	for n != nil {
-		if n.Parent == hs.lockedQC.NodeId {
-			return true
-		}
-		n = hs.nodeMap[n.Parent]
+func (w *countingWriter) Write(p []byte) (int, error) {
+	w.n += len(p)
+	return len(p), nil
+}
+
+// traceEvent opens the span of handling a traced message.
+func (hs *HotStuff) traceEvent(e interface{}) *Span {
+	if hs.tracer == nil {
+		return nil
 	}
-	if qc.ViewId > hs.lockedQC.ViewId {
-		return true
+	var name string
+	var parent SpanContext
+	kv := []interface{}{"view", hs.core.viewId}
+	switch e := e.(type) {
+	case requestEvent:
+		name, parent = "HotStuff.Request", e.request.Trace
+	case proposalEvent:
+		name, parent = "HotStuff.Propose", e.msg.Trace
+		kv = append(kv, "from", e.msg.RepId, "node", e.msg.Node.Id)
+	case voteEvent:
+		name, parent = "HotStuff.Vote", e.msg.Trace
+		kv = append(kv, "from", e.msg.RepId, "node", e.msg.NodeId)
+	default:
+		return nil
 	}
-	return false
+	return hs.tracer.start(name, SpanKindServer, parent.child(name, hs.core.me), parent, kv...)
 }
 
-func (hs *HotStuff) saveNode(n *LogNode) {
-	hs.lastNode = n
-	hs.nodeMap[n.Id] = n
+// traceProposal marks the moment we proposed a traced node as leader.
+func (hs *HotStuff) traceProposal(args *ProposalArgs) {
+	hs.tracer.start("propose", SpanKindInternal, args.Trace, args.Node.Request.Trace, "view", args.ViewId, "node", args.Node.Id).end()
 }
 
-func (hs *HotStuff) update(n *LogNode) {
-	var prepare, precommit, commit, decide *LogNode
-	var nodeId string
-	prepare = n
-	if prepare != nil {
-		nodeId = prepare.Justify.NodeId
-		precommit = hs.nodeMap[nodeId]
-	}
-	if precommit != nil {
-		nodeId = precommit.Justify.NodeId
-		commit = hs.nodeMap[nodeId]
+var phaseNames = map[protocolEvent]string{
+	nodeVoted:    "prepare",
+	nodePrepared: "precommit",
+	nodeLocked:   "commit",
+}
+
+var phaseOrder = map[string]int{"prepare": 1, "precommit": 2, "commit": 3}
+
+// tracePhase follows a traced node through the commit pipeline: each
+// phase is a span that lasts until the node enters the next one.
+func (hs *HotStuff) tracePhase(a metricAction) {
+	if hs.tracer == nil {
+		return
 	}
-	if commit != nil {
-		nodeId = commit.Justify.NodeId
-		decide = hs.nodeMap[nodeId]
+	if a.event == viewStarted {
+		// nodes that never commit are forgotten after a while
+		for nodeId, span := range hs.phases {
+			if node := hs.core.nodeMap[nodeId]; node == nil || node.ViewId < a.viewId-100 {
+				span.set("abandoned", true)
+				span.end()
+				delete(hs.phases, nodeId)
+			}
+		}
+		return
 	}
 
-	if hs.safeNode(prepare, prepare.Justify) {
-		// node saved
-		msg := fmt.Sprintf("\033[1;32mLogNode saved:\033[0m id[%s] qcId[%s] qcview[%d] \n", n.Id, n.Justify.NodeId, n.Justify.ViewId)
-		hs.debugPrint(msg)
-
-		hs.saveNode(n)
-		voteMsg := &MsgArgs{}
-		voteMsg.RepId = hs.me
-		voteMsg.ViewId = hs.viewId
-		voteMsg.Node = *prepare
-		voteMsg.ParSig = true
-		nextLeaderId := (hs.viewId + 1) % hs.n
-		hs.sendMsg(nextLeaderId, "Msg", voteMsg)
-	} else {
+	name, ok := phaseNames[a.event]
+	if !ok && a.event != nodeCommitted {
 		return
 	}
-
-	if prepare != nil && precommit != nil && prepare.Parent == precommit.Id {
-		hs.genericQC = prepare.Justify
-		if precommit != nil && commit != nil && precommit.Parent == commit.Id {
-			hs.lockedQC = precommit.Justify
-			if commit != nil && decide != nil && commit.Parent == decide.Id {
-				//execute decide
-				msg := fmt.Sprintf("\033[1;34mExecute Request:\033[0m id[%s], op[%s]\n", decide.Id, decide.Request.Operation.(string))
-				hs.debugPrint(msg)
-				request := decide.Request
-				if request.Timestamp != 0 {
-					reply := &ReplyArgs{}
-					reply.ViewId = hs.viewId
-					reply.Timestamp = request.Timestamp
-					reply.ReplicaId = hs.me
-					reply.Result = request.Operation
-					hs.replyClient(request.ClientId, reply)
-				}
-			}
+	node := hs.core.nodeMap[a.nodeId]
+	if node == nil || !node.Request.Trace.valid() {
+		return
+	}
+	open := hs.phases[a.nodeId]
+	if open != nil {
+		if ok && phaseOrder[open.Name] >= phaseOrder[name] {
+			return
 		}
+		open.end()
+		delete(hs.phases, a.nodeId)
+	}
+	if ok {
+		hs.phases[a.nodeId] = hs.tracer.start(name, SpanKindInternal, phaseContext(node, name, hs.core.me), node.Request.Trace, "view", node.ViewId, "node", node.Id)
 	}
 }
 
-func (hs *HotStuff) processSavedMsgs() {
-	cnt := 0
-	for _, msg := range hs.savedMsgs {
-		if msg.ViewId == hs.viewId {
-			cnt++
-		}
+func (hs *HotStuff) setTimer(a timerAction) {
+	if t := hs.timers[a.kind]; t != nil {
+		t.Stop()
 	}
 
-	if cnt >= hs.n-hs.f {
-		checkVoteMap := make(map[string]int)
-		// try to find genericQC (get consensus)
-		for _, msg := range hs.savedMsgs {
-			if msg.Node.Id != "" {
-				node := msg.Node
-				checkVoteMap[node.Id]++
-				if checkVoteMap[node.Id] > hs.f {
-					// get valid consensus
-					newQc := QC{}
-					newQc.ViewId = node.ViewId
-					newQc.NodeId = node.Id
-					hs.genericQC = newQc
-				}
-			}
-		}
-		// if cannot find genericQC, it will generate a dummy node
-		hs.newView(hs.viewId + 1)
+	var e interface{}
+	switch a.kind {
+	case viewTimer:
+		e = timeoutEvent{a.viewId}
+	case noopTimer:
+		e = tickEvent{a.viewId}
 	}
+	hs.timers[a.kind] = time.AfterFunc(a.d, func() {
+		hs.post(e)
+	})
 }
 
-func (hs *HotStuff) newView(viewId int) {
-	if hs.viewId >= viewId {
+// exec runs f on the event loop and waits for it to finish, so f may read
+// the core state without racing with the protocol. Once the replica has
+// stopped, f reads the state it was left in.
+func (hs *HotStuff) exec(f func()) {
+	done := make(chan bool)
+	hs.post(callEvent{func() {
+		f()
+		close(done)
+	}})
+	select {
+	case <-done:
 		return
+	case <-hs.life.stopped:
+	}
+	select {
+	case <-done:
+	default:
+		hs.haltedMu.Lock()
+		f()
+		hs.haltedMu.Unlock()
 	}
+}
 
-	msg := hs.getRecentNodes()
-	hs.debugPrint(msg)
+func (hs *HotStuff) sendMsg(id int, rpcname string, rpcacgs interface{}) {
+	hs.adversary.Send(hs, id, rpcname, rpcacgs)
+}
 
-	msg = fmt.Sprintf("=== HotStuff: Change to NewView[%d] ===\n", viewId)
-	hs.debugPrint(msg)
-	if hs.viewTimer != nil {
-		hs.viewTimer.Cancel()
-		hs.viewTimer = nil
+func (hs *HotStuff) rawSendMsg(id int, rpcname string, rpcacgs interface{}) {
+	if o := hs.server(id); o != nil {
+		o.send("HotStuff."+rpcname, rpcacgs)
 	}
+}
 
-	if hs.noopTimer != nil {
-		hs.noopTimer.Cancel()
-		hs.noopTimer = nil
+func (hs *HotStuff) server(id int) *outbox {
+	hs.peersMu.RLock()
+	defer hs.peersMu.RUnlock()
+	if id < 0 || id >= len(hs.servers) {
+		return nil
 	}
+	return hs.servers[id]
+}
 
-	hs.viewId = viewId
-	if hs.isLeader() {
-		var highNode *LogNode
-		for _, msg := range hs.savedMsgs {
-			if msg.QC.NodeId != "" {
-				node, ok := hs.nodeMap[msg.QC.NodeId]
-				if ok {
-					if highNode == nil || node.ViewId > highNode.ViewId {
-						highNode = node
-					}
-				}
-			}
-		}
+func (hs *HotStuff) replicaCount() int {
+	hs.peersMu.RLock()
+	defer hs.peersMu.RUnlock()
+	return len(hs.servers)
+}
 
-		if highNode != nil {
-			highQC := highNode.Justify
-			if highQC.ViewId > hs.genericQC.ViewId {
-				hs.genericQC = highQC
-			}
+func (hs *HotStuff) getKeys() *SigningKeys {
+	hs.keysMu.RLock()
+	defer hs.keysMu.RUnlock()
+	return hs.keys
+}
+
+// setKeys runs on the event loop, where the core reads its keys.
+func (hs *HotStuff) setKeys(keys *SigningKeys) {
+	hs.keysMu.Lock()
+	hs.keys = keys
+	hs.keysMu.Unlock()
+	hs.core.keys = keys
+}
+
+// reconfigure runs on the event loop when an epoch begins: it connects to
+// an added replica and installs replaced public keys.
+func (hs *HotStuff) reconfigure(cmd *reconfigCommand) {
+	if cmd.op == "add" {
+		hs.addServer(cmd.id, cmd.address)
+	}
+	keys := hs.getKeys()
+	if cmd.key == nil || keys == nil {
+		return
+	}
+
+	next := *keys
+	next.Replicas = append([]ed25519.PublicKey{}, keys.Replicas...)
+	for len(next.Replicas) <= cmd.id {
+		next.Replicas = append(next.Replicas, nil)
+	}
+	next.Replicas[cmd.id] = cmd.key
+	if cmd.id == hs.core.me {
+		if hs.stagedKey == nil || !hs.stagedKey.Public().(ed25519.PublicKey).Equal(cmd.key) {
+			hs.logger.log(ErrorLevel, "key_missing", "No staged key matches the new public key of this replica")
+		} else {
+			next.Private = hs.stagedKey
+			hs.stagedKey = nil
 		}
+	}
+	hs.setKeys(&next)
+}
 
-		hs.noopTimer = NewTimerWithCancel(time.Duration(NoopTimeOut * time.Millisecond))
-		hs.noopTimer.SetTimeout(func() {
-			hs.mu.Lock()
-			defer hs.mu.Unlock()
-			hs.noopTimer = nil
-
-			noopRequset := &RequestArgs{}
-			noopRequset.Operation = "noop"
-			hs.processClientRequest(noopRequset)
-		})
-		hs.noopTimer.Start()
+func (hs *HotStuff) addServer(id int, address string) {
+	if hs.dial == nil {
+		hs.logger.log(ErrorLevel, "peer_unreachable", "Cannot reach new replica without a dialer", "peer", id)
+		return
 	}
 
-	hs.viewTimer = NewTimerWithCancel(time.Duration(ViewTimeOut * time.Millisecond))
-	hs.viewTimer.SetTimeout(func() {
-		hs.mu.Lock()
-		defer hs.mu.Unlock()
-		hs.viewTimer = nil
-		msg := fmt.Sprintf("\033[1;33mNewView timeout:\033[0m rep[%d] oldview[%d]\n", hs.me, hs.viewId)
-		hs.debugPrint(msg)
-
-		newViewMsg := &MsgArgs{}
-		newViewMsg.ViewId = hs.viewId
-		newViewMsg.RepId = hs.me
-		newViewMsg.QC = hs.genericQC
-		newViewMsg.ParSig = true
-		nextLeaderId := (hs.viewId + 1) % hs.n
-		hs.sendMsg(nextLeaderId, "Msg", newViewMsg)
-		hs.newView(hs.viewId + 1)
+	hs.peersMu.Lock()
+	defer hs.peersMu.Unlock()
+	for len(hs.servers) <= id {
+		i := len(hs.servers)
+		addr := ""
+		if i == id {
+			addr = address
+		}
+		o := makeOutbox(i, hs.dial(i, addr), hs.observeCall(false))
+		o.start(hs.life)
+		hs.servers = append(hs.servers, o)
+	}
+}
+
+// stageKey keeps the private key this replica signs with once a committed
+// "reconfig key" command installs its public key.
+func (hs *HotStuff) stageKey(priv ed25519.PrivateKey) {
+	hs.exec(func() {
+		hs.stagedKey = priv
 	})
-	hs.viewTimer.Start()
+}
+
+func (hs *HotStuff) replyClient(clientId int, replyArgs *ReplyArgs) {
+	if clientId < 0 || clientId >= len(hs.clients) {
+		hs.logger.log(WarnLevel, "reply_dropped", "Reply dropped for unknown client", "client", clientId)
+		return
+	}
+	hs.clients[clientId].send("Client.Reply", replyArgs)
 }
 
 func (hs *HotStuff) getServerInfo() map[string]interface{} {
-	hs.mu.Lock()
-	defer hs.mu.Unlock()
-
-	info := make(map[string]interface{})
-	info["id"] = hs.me
-	info["viewId"] = hs.viewId
-	info["n"] = hs.n
-	info["f"] = hs.f
-	info["genericQCId"] = hs.genericQC.NodeId
-	info["genericQCView"] = hs.genericQC.ViewId
-	info["lockedQCId"] = hs.lockedQC.NodeId
-	info["lockedQCView"] = hs.lockedQC.ViewId
+	var info map[string]interface{}
+	hs.exec(func() {
+		info = hs.core.getServerInfo()
+		info["adversary"] = hs.adversary.Name()
+		info["authFailures"] = int(atomic.LoadInt64(&hs.authFailures))
+		info["logDropped"] = int(hs.logger.Dropped())
+		info["threshold"] = "none"
+		if hs.keys != nil && hs.keys.Threshold != nil {
+			key := hs.keys.Threshold
+			info["threshold"] = fmt.Sprintf("%d of %d, group key %x", key.Threshold, len(key.ShareKeys), key.GroupKey[:8])
+		}
+	})
 	return info
 }
 
 func (hs *HotStuff) getRecentNodesWithLock() string {
-	hs.mu.Lock()
-	defer hs.mu.Unlock()
-	return hs.getRecentNodes()
+	var msg string
+	hs.exec(func() {
+		msg = hs.core.getRecentNodes()
+	})
+	return msg
 }
 
-func (hs *HotStuff) getRecentNodes() string {
-	node := hs.nodeMap[hs.genericQC.NodeId]
-	msg := "Recent valid nodes: \n"
-	for i := 0; i < 5; i++ {
-		if node == nil {
-			return msg
+// getRecentNodes describes the chain back from the generic QC.
+func (hs *HotStuff) getRecentNodes() []ChainNode {
+	nodes := []ChainNode{}
+	hs.exec(func() {
+		ex := makeChainExplorer(hs.core)
+		for _, node := range hs.core.recentNodes() {
+			nodes = append(nodes, ex.info(node))
 		}
+	})
+	return nodes
+}
 
-		msg += fmt.Sprintf("    nodeId[%s] view[%d] parent[%s] qc[%s]\n", node.Id, node.ViewId, node.Parent, node.Justify.NodeId)
-		qcId := node.Justify.NodeId
-		node = hs.nodeMap[qcId]
-	}
+// exploreChain answers a query of the chain explorer.
+func (hs *HotStuff) exploreChain(args []string) (interface{}, error) {
+	var v interface{}
+	var err error
+	hs.exec(func() {
+		v, err = makeChainExplorer(hs.core).query(args)
+	})
+	return v, err
+}
 
+func (hs *HotStuff) getEvidence() string {
+	var msg string
+	hs.exec(func() {
+		msg = hs.core.getEvidence()
+	})
 	return msg
 }
 
-func MakeHotStuff(id int, serverPeers, clientPeers []peerWrapper, debugCh chan interface{}) *HotStuff {
+// MakeHotStuff starts a replica that logs every entry to debugCh.
+func MakeHotStuff(id int, serverPeers, clientPeers []caller, protocol ProtocolMode, keys *SigningKeys, debugCh chan interface{}) *HotStuff {
+	hs := makeHotStuff(id, serverPeers, clientPeers, protocol, keys, makeLogger(DebugLevel, debugCh).with("replica", id))
+	hs.Start()
+	return hs
+}
+
+// makeHotStuff builds a replica without starting its event loop, so the
+// caller can still adjust the core before the first view begins.
+func makeHotStuff(id int, serverPeers, clientPeers []caller, protocol ProtocolMode, keys *SigningKeys, logger *Logger) *HotStuff {
 	hs := &HotStuff{}
-	hs.mu = &sync.Mutex{}
-	hs.me = id
-	hs.servers = serverPeers
-	hs.clients = clientPeers
-	hs.viewId = 0
-	hs.nodeMap = make(map[string]*LogNode)
-	hs.n = len(hs.servers)
-	hs.f = (hs.n - 1) / 3
-	hs.savedMsgs = make(map[int]*MsgArgs)
-	hs.maliciousMode = NormalMode
-	go hs.newView(1)
-
-	hs.debugCh = debugCh
+	hs.views = makeRateWindow(10 * time.Second)
+	hs.metrics = makeReplicaMetrics(hs.views)
+	hs.proposalSeen = make(map[string]time.Time)
+	hs.proposalView = make(map[string]int)
+	hs.phases = make(map[string]*Span)
+	hs.peersMu = &sync.RWMutex{}
+	hs.servers = makeOutboxes(serverPeers, hs.observeCall(false))
+	hs.clients = makeOutboxes(clientPeers, hs.observeCall(true))
+	hs.core = makeHotStuffCore(id, len(serverPeers), protocol, keys)
+	hs.keysMu = &sync.RWMutex{}
+	hs.keys = keys
+	hs.dkgMu = &sync.Mutex{}
+	hs.dkgRound = time.Duration(DKGRound * time.Millisecond)
+	hs.eventCh = make(chan interface{}, 1024)
+	hs.timers = make(map[timerKind]*time.Timer)
+	hs.adversary = &honestAdversary{}
+	hs.logger = logger
+	hs.life = makeLifecycle(hs.flush)
+	hs.life.onStop(hs.stopDKG)
+	hs.haltedMu = &sync.Mutex{}
 	return hs
 }
@@ -0,0 +1,93 @@
+package hotstuff
+
+import (
+	"crypto/ed25519"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+// KeyFiles locates the keys of a node. SigningKey names the file holding
+// the node's hex private key; the public keys are hex strings from the
+// cluster config, indexed by id. Operators are the ids of the clients
+// allowed to reconfigure the cluster.
+type KeyFiles struct {
+	SigningKey string
+	Replicas   []string
+	Clients    []string
+	Operators  []int
+}
+
+func readHexFile(path string) ([]byte, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return hex.DecodeString(strings.TrimSpace(string(data)))
+}
+
+func decodePublicKeys(hexKeys []string, client bool) ([]ed25519.PublicKey, error) {
+	pubs := make([]ed25519.PublicKey, len(hexKeys))
+	for id, hexKey := range hexKeys {
+		if hexKey == "" {
+			return nil, fmt.Errorf("missing public key of %s", identityName(client, id))
+		}
+		pub, err := hex.DecodeString(hexKey)
+		if err != nil || len(pub) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("invalid public key of %s", identityName(client, id))
+		}
+		pubs[id] = pub
+	}
+	return pubs, nil
+}
+
+func readKeys(files *KeyFiles, self peerIdentity) (*SigningKeys, error) {
+	var err error
+	keys := &SigningKeys{}
+	if keys.Replicas, err = decodePublicKeys(files.Replicas, false); err != nil {
+		return nil, err
+	}
+	if keys.Clients, err = decodePublicKeys(files.Clients, true); err != nil {
+		return nil, err
+	}
+	keys.Operators = append([]int{}, files.Operators...)
+
+	pubs := keys.Replicas
+	if self.client {
+		pubs = keys.Clients
+	}
+	if self.id < 0 || self.id >= len(pubs) {
+		return nil, errors.New("no public key in the config")
+	}
+	if files.SigningKey == "" {
+		return nil, errors.New("no signing key configured")
+	}
+	priv, err := readHexFile(files.SigningKey)
+	if err != nil {
+		return nil, fmt.Errorf("read signing key: %s", err)
+	}
+	if len(priv) != ed25519.PrivateKeySize {
+		return nil, fmt.Errorf("%s is not an ed25519 private key", files.SigningKey)
+	}
+	keys.Private = priv
+	if !keys.Private.Public().(ed25519.PublicKey).Equal(pubs[self.id]) {
+		return nil, fmt.Errorf("signing key %s does not match the public key in the config", files.SigningKey)
+	}
+	return keys, nil
+}
+
+// loadKeys reads the keys of the node self and checks that its private key
+// matches the public key the rest of the cluster expects.
+func loadKeys(files *KeyFiles, self peerIdentity) (*SigningKeys, error) {
+	if files == nil {
+		return nil, nil
+	}
+
+	keys, err := readKeys(files, self)
+	if err != nil {
+		return nil, fmt.Errorf("keys: %s: %s", identityName(self.client, self.id), err)
+	}
+	return keys, nil
+}
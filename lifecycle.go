@@ -0,0 +1,109 @@
+package hotstuff
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+// lifecycle starts and stops what a replica or client runs. Stopping goes
+// in order: the closers shut the listeners, the workers (event loop,
+// outboxes, servers) are waited for, and only then flush writes out the
+// log and trace, so nothing produced before the end is lost.
+type lifecycle struct {
+	mu       *sync.Mutex
+	started  bool
+	stopping chan bool
+	stopped  chan bool
+	err      error
+	workers  *sync.WaitGroup
+	closers  []func()
+	flush    func() error
+}
+
+// start runs f, which starts the workers, unless the owner was started or
+// stopped before.
+func (lc *lifecycle) start(f func()) error {
+	lc.mu.Lock()
+	select {
+	case <-lc.stopping:
+		lc.mu.Unlock()
+		return errors.New("already stopped")
+	default:
+	}
+	if lc.started {
+		lc.mu.Unlock()
+		return errors.New("already started")
+	}
+	lc.started = true
+	lc.mu.Unlock()
+	f()
+	return nil
+}
+
+// goWorker runs f until it returns, which it must once stopping is closed.
+// A worker started after Stop began does not run.
+func (lc *lifecycle) goWorker(f func()) {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+	select {
+	case <-lc.stopping:
+		return
+	default:
+	}
+	lc.workers.Add(1)
+	go func() {
+		defer lc.workers.Done()
+		f()
+	}()
+}
+
+func (lc *lifecycle) onStop(f func()) {
+	lc.mu.Lock()
+	lc.closers = append(lc.closers, f)
+	lc.mu.Unlock()
+}
+
+// stop returns once the owner stopped or ctx is done; the stopping goes on
+// in the background after ctx is. Later calls wait for the first.
+func (lc *lifecycle) stop(ctx context.Context) error {
+	lc.mu.Lock()
+	first := true
+	select {
+	case <-lc.stopping:
+		first = false
+	default:
+		close(lc.stopping)
+	}
+	closers := lc.closers
+	lc.mu.Unlock()
+
+	if first {
+		go func() {
+			for _, f := range closers {
+				f()
+			}
+			lc.workers.Wait()
+			if lc.flush != nil {
+				lc.err = lc.flush()
+			}
+			close(lc.stopped)
+		}()
+	}
+	select {
+	case <-lc.stopped:
+		return lc.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func makeLifecycle(flush func() error) *lifecycle {
+	lc := &lifecycle{}
+	lc.mu = &sync.Mutex{}
+	lc.stopping = make(chan bool)
+	lc.stopped = make(chan bool)
+	lc.workers = &sync.WaitGroup{}
+	lc.flush = flush
+	return lc
+}
@@ -0,0 +1,107 @@
+package hotstuff
+
+import (
+	"context"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Stopping closes the listeners, waits for the workers and only then
+// flushes; a lifecycle starts at most once and never after it stopped.
+func TestLifecycle(t *testing.T) {
+	mu := &sync.Mutex{}
+	var steps []string
+	step := func(s string) {
+		mu.Lock()
+		steps = append(steps, s)
+		mu.Unlock()
+	}
+
+	life := makeLifecycle(func() error {
+		step("flush")
+		return nil
+	})
+	// the worker serves until its listener is closed
+	listener := make(chan bool)
+	life.onStop(func() {
+		step("close")
+		close(listener)
+	})
+	err := life.start(func() {
+		life.goWorker(func() {
+			<-listener
+			step("worker")
+		})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := life.start(func() {}); err == nil {
+		t.Errorf("started twice")
+	}
+
+	if err := life.stop(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"close", "worker", "flush"}; !reflect.DeepEqual(steps, want) {
+		t.Errorf("stopped in steps %v, want %v", steps, want)
+	}
+	if err := life.stop(context.Background()); err != nil {
+		t.Errorf("second stop: %v", err)
+	}
+	ran := false
+	life.goWorker(func() { ran = true })
+	if err := life.start(func() {}); err == nil || ran {
+		t.Errorf("started after stop")
+	}
+}
+
+// Stop gives up when ctx is done before a worker ends.
+func TestLifecycleStopTimeout(t *testing.T) {
+	release := make(chan bool)
+	life := makeLifecycle(nil)
+	life.start(func() {
+		life.goWorker(func() { <-release })
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := life.stop(ctx); err != context.DeadlineExceeded {
+		t.Errorf("stop returned %v, want %v", err, context.DeadlineExceeded)
+	}
+	close(release)
+	if err := life.stop(context.Background()); err != nil {
+		t.Errorf("stop after the worker ended: %v", err)
+	}
+}
+
+// Replicas and clients sharing a process stop on their own, and a stopped
+// replica drops what it receives instead of blocking the sender.
+func TestStopCluster(t *testing.T) {
+	lc, err := makeLocalCluster(4, 1, ThreeChainMode, time.Second, 100*time.Millisecond, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(200 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for i, hs := range lc.servers {
+		if err := hs.Stop(ctx); err != nil {
+			t.Errorf("replica %d: %v", i, err)
+		}
+	}
+	for i, c := range lc.clients {
+		if err := c.Stop(ctx); err != nil {
+			t.Errorf("client %d: %v", i, err)
+		}
+	}
+	if err := lc.servers[0].Start(); err == nil {
+		t.Errorf("replica restarted after stop")
+	}
+	for i := 0; i < 2*cap(lc.servers[0].eventCh)+1; i++ {
+		lc.servers[0].post(requestEvent{})
+	}
+}
@@ -0,0 +1,247 @@
+package hotstuff
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type Level int
+
+const (
+	DebugLevel Level = iota
+	InfoLevel
+	WarnLevel
+	ErrorLevel
+)
+
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+func (l Level) String() string {
+	if l < DebugLevel || l > ErrorLevel {
+		return fmt.Sprintf("level(%d)", int(l))
+	}
+	return levelNames[l]
+}
+
+func ParseLevel(s string) (Level, error) {
+	for i, name := range levelNames {
+		if strings.EqualFold(s, name) {
+			return Level(i), nil
+		}
+	}
+	return DebugLevel, fmt.Errorf("unknown log level %s", s)
+}
+
+type LogField struct {
+	Key   string
+	Value interface{}
+}
+
+// LogEntry is one event of a replica or client: what happened (Event, a
+// short snake_case name), a human message, and fields such as the replica,
+// the view and the node involved.
+type LogEntry struct {
+	Time   time.Time
+	Level  Level
+	Event  string
+	Msg    string
+	Fields []LogField
+}
+
+func makeLogEntry(level Level, event, msg string, kv []interface{}) *LogEntry {
+	e := &LogEntry{}
+	e.Level = level
+	e.Event = event
+	e.Msg = msg
+	for i := 0; i+1 < len(kv); i += 2 {
+		e.Fields = append(e.Fields, LogField{fmt.Sprint(kv[i]), kv[i+1]})
+	}
+	return e
+}
+
+// Logger hands entries to its sinks without ever blocking the caller: an
+// entry a sink has no room for is dropped and counted.
+type Logger struct {
+	level   Level
+	fields  []LogField
+	sinks   []chan interface{}
+	dropped *int64
+	// closing the sinks waits out the entries being handed over; the
+	// writers of the log output end once they wrote what was left
+	mu      *sync.RWMutex
+	closed  *bool
+	writers *sync.WaitGroup
+}
+
+func (l *Logger) enabled(level Level) bool {
+	return l != nil && level >= l.level
+}
+
+func (l *Logger) write(e *LogEntry) {
+	if !l.enabled(e.Level) {
+		return
+	}
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	e.Fields = append(append([]LogField{}, l.fields...), e.Fields...)
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if *l.closed {
+		return
+	}
+	for _, sink := range l.sinks {
+		select {
+		case sink <- e:
+		default:
+			atomic.AddInt64(l.dropped, 1)
+		}
+	}
+}
+
+func (l *Logger) log(level Level, event, msg string, kv ...interface{}) {
+	if l.enabled(level) {
+		l.write(makeLogEntry(level, event, msg, kv))
+	}
+}
+
+// with returns a logger adding key to every entry.
+func (l *Logger) with(key string, value interface{}) *Logger {
+	child := *l
+	child.fields = append(append([]LogField{}, l.fields...), LogField{key, value})
+	return &child
+}
+
+// close closes the sinks and waits for the writers, after which entries
+// are dropped. The loggers made from l by with share its sinks.
+func (l *Logger) close() {
+	l.mu.Lock()
+	if !*l.closed {
+		*l.closed = true
+		for _, sink := range l.sinks {
+			if sink != nil {
+				close(sink)
+			}
+		}
+	}
+	l.mu.Unlock()
+	l.writers.Wait()
+}
+
+func (l *Logger) Dropped() int64 {
+	return atomic.LoadInt64(l.dropped)
+}
+
+func makeLogger(level Level, sinks ...chan interface{}) *Logger {
+	l := &Logger{}
+	l.level = level
+	l.sinks = sinks
+	l.dropped = new(int64)
+	l.mu = &sync.RWMutex{}
+	l.closed = new(bool)
+	l.writers = &sync.WaitGroup{}
+	return l
+}
+
+type LogFormatter interface {
+	Format(e *LogEntry) string
+}
+
+// TextFormatter writes entries for people. With Color it is the format of
+// the debug servers: the message in the color of its event, then the
+// fields as key[value].
+type TextFormatter struct {
+	Color bool
+}
+
+var eventColors = map[string]string{
+	"proposal_received": "1;36",
+	"vote_received":     "1;36",
+	"newview_received":  "1;36",
+	"qc_formed":         "1;32",
+	"node_saved":        "1;32",
+	"dkg_finished":      "1;32",
+	"leaf_created":      "0;32",
+	"view_timeout":      "1;33",
+	"tc_formed":         "1;33",
+	"node_executed":     "1;34",
+	"epoch_change":      "1;35",
+}
+
+func (f *TextFormatter) Format(e *LogEntry) string {
+	msg := e.Msg
+	if len(e.Fields) > 0 {
+		msg += ":"
+	}
+	if f.Color {
+		color := eventColors[e.Event]
+		if e.Level >= WarnLevel {
+			color = "1;31"
+		}
+		if color != "" {
+			msg = "\033[" + color + "m" + msg + "\033[0m"
+		}
+	} else {
+		msg = fmt.Sprintf("%s %-5s %s", e.Time.Format("15:04:05.000"), e.Level, msg)
+	}
+
+	for _, field := range e.Fields {
+		msg += fmt.Sprintf(" %s[%v]", field.Key, field.Value)
+	}
+	return msg + "\n"
+}
+
+// JSONFormatter writes one JSON object per entry.
+type JSONFormatter struct{}
+
+func (f *JSONFormatter) Format(e *LogEntry) string {
+	obj := make(map[string]interface{})
+	for _, field := range e.Fields {
+		obj[field.Key] = field.Value
+	}
+	obj["time"] = e.Time.Format(time.RFC3339Nano)
+	obj["level"] = e.Level.String()
+	obj["event"] = e.Event
+	obj["msg"] = e.Msg
+	data, err := json.Marshal(obj)
+	if err != nil {
+		data, _ = json.Marshal(map[string]string{"event": e.Event, "error": err.Error()})
+	}
+	return string(data) + "\n"
+}
+
+func ParseLogFormat(s string) (LogFormatter, error) {
+	switch s {
+	case "", "text":
+		return &TextFormatter{}, nil
+	case "color":
+		return &TextFormatter{true}, nil
+	case "json":
+		return &JSONFormatter{}, nil
+	}
+	return nil, fmt.Errorf("unknown log format %s", s)
+}
+
+// formatLog renders what arrives on a log channel: entries through f, and
+// plain strings as they are.
+func formatLog(msg interface{}, f LogFormatter) string {
+	switch m := msg.(type) {
+	case *LogEntry:
+		return f.Format(m)
+	case string:
+		return m
+	}
+	return fmt.Sprintln(msg)
+}
+
+// writeLog writes the entries arriving on ch to w until ch is closed.
+func writeLog(ch chan interface{}, f LogFormatter, w io.Writer) {
+	for msg := range ch {
+		io.WriteString(w, formatLog(msg, f))
+	}
+}
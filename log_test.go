@@ -0,0 +1,87 @@
+package hotstuff
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// A logger passes on entries at or above its level, with its fields in
+// front, and drops what a full sink has no room for instead of blocking.
+func TestLogger(t *testing.T) {
+	sink := make(chan interface{}, 2)
+	logger := makeLogger(InfoLevel, sink).with("replica", 1)
+
+	logger.log(DebugLevel, "vote_received", "vote")
+	logger.log(InfoLevel, "qc_formed", "qc", "view", 3)
+	logger.log(WarnLevel, "view_timeout", "timeout")
+	logger.log(ErrorLevel, "view_timeout", "timeout")
+
+	if len(sink) != 2 {
+		t.Fatalf("%d entries in the sink, want 2", len(sink))
+	}
+	if logger.Dropped() != 1 {
+		t.Errorf("%d entries dropped, want 1", logger.Dropped())
+	}
+	e := (<-sink).(*LogEntry)
+	want := []LogField{{"replica", 1}, {"view", 3}}
+	if e.Event != "qc_formed" || len(e.Fields) != 2 || e.Fields[0] != want[0] || e.Fields[1] != want[1] {
+		t.Errorf("entry %+v, want event qc_formed with fields %v", e, want)
+	}
+
+	// after close entries are dropped, not sent on a closed sink
+	logger.close()
+	logger.log(ErrorLevel, "view_timeout", "timeout")
+}
+
+func TestLogFormat(t *testing.T) {
+	e := makeLogEntry(WarnLevel, "view_timeout", "timeout", []interface{}{"replica", 1, "view", 3})
+	e.Time = time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	tests := []struct {
+		format string
+		want   string
+	}{
+		{"text", "03:04:05.000 warn  timeout: replica[1] view[3]\n"},
+		{"color", "\033[1;31mtimeout:\033[0m replica[1] view[3]\n"},
+		{"json", `{"event":"view_timeout","level":"warn","msg":"timeout","replica":1,"time":"2020-01-02T03:04:05Z","view":3}` + "\n"},
+	}
+	for _, test := range tests {
+		f, err := ParseLogFormat(test.format)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := formatLog(e, f); got != test.want {
+			t.Errorf("%s: %q, want %q", test.format, got, test.want)
+		}
+	}
+
+	if got := formatLog("plain\n", &JSONFormatter{}); got != "plain\n" {
+		t.Errorf("plain string formatted as %q", got)
+	}
+	if _, err := ParseLogFormat("xml"); err == nil {
+		t.Errorf("unknown format accepted")
+	}
+}
+
+func TestParseLevel(t *testing.T) {
+	tests := []struct {
+		s     string
+		level Level
+		ok    bool
+	}{
+		{"debug", DebugLevel, true},
+		{"WARN", WarnLevel, true},
+		{"error", ErrorLevel, true},
+		{"trace", DebugLevel, false},
+	}
+	for _, test := range tests {
+		level, err := ParseLevel(test.s)
+		if (err == nil) != test.ok || level != test.level {
+			t.Errorf("%q: level %s error %v, want %s ok %v", test.s, level, err, test.level, test.ok)
+		}
+	}
+	if s := Level(7).String(); !strings.HasPrefix(s, "level(") {
+		t.Errorf("level 7 named %s", s)
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/myzWILLmake/hotstuff-go"
+)
+
+// runBench handles "bench [flags]": it sends load through virtual clients,
+// those of a config whose servers are running, or with -replicas those of
+// an in-process cluster, and prints a report. The latency it reports runs
+// from sending a request to accepting its result. Leaders wait for the
+// noop timeout before filling an idle view, so an in-process cluster runs
+// with a short one by default; the servers of a config keep their own.
+func runBench(args []string) {
+	fs := newFlagSet("bench", "")
+	config := fs.String("config", "config.json", "config of the cluster, whose clients must not be running")
+	replicas := fs.Int("replicas", 0, "bench an in-process cluster of this many replicas instead")
+	clients := fs.Int("clients", 0, "number of virtual clients, all those of the config when 0")
+	protocol := fs.String("protocol", "three-chain", "protocol mode of an in-process cluster")
+	viewTimeout := fs.Duration("view-timeout", time.Second, "view timeout of an in-process cluster")
+	noopTimeout := fs.Duration("noop-timeout", 10*time.Millisecond, "how long an idle leader of an in-process cluster waits before proposing a noop")
+	rate := fs.Float64("rate", 0, "requests per second over all clients, 0 for a closed loop")
+	duration := fs.Duration("duration", 10*time.Second, "how long to send requests")
+	timeout := fs.Duration("timeout", 15*time.Second, "time after which a request counts as timed out")
+	asJSON := fs.Bool("json", false, "print the report as JSON")
+	parseArgs(fs, args, 0)
+
+	b := &hotstuff.Bench{}
+	b.Rate = *rate
+	b.Duration = *duration
+	b.Timeout = *timeout
+
+	var report *hotstuff.BenchReport
+	if *replicas > 0 {
+		mode, err := hotstuff.ParseProtocolMode(*protocol)
+		if err != nil {
+			log.Fatal(err)
+		}
+		k := *clients
+		if k == 0 {
+			k = 1
+		}
+		if report, err = hotstuff.RunLocalBench(b, *replicas, k, mode, *viewTimeout, *noopTimeout); err != nil {
+			log.Fatal(err)
+		}
+	} else {
+		x, err := readConfig(*config)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := validateConfig(x); err != nil {
+			log.Fatalf("config %s: %s", *config, err)
+		}
+		k := *clients
+		if k == 0 {
+			k = len(x.Clients)
+		}
+		if k < 1 || k > len(x.Clients) {
+			log.Fatalf("Invalid number of clients, the config has %d", len(x.Clients))
+		}
+
+		serverAddrs, _ := addresses(x)
+		wg := &sync.WaitGroup{}
+		var cs []*hotstuff.Client
+		for _, node := range x.Clients[:k] {
+			opts, err := nodeOptions(x, node, false)
+			if err != nil {
+				log.Fatal(err)
+			}
+			// the virtual clients only report
+			opts.LogOutput = nil
+			opts.MetricsAddr = ""
+			opts.AdminAddr = ""
+			cs = append(cs, hotstuff.RunClient(node.Id, node.Address, serverAddrs, opts, false, "", wg))
+		}
+		if report, err = hotstuff.RunBench(b, cs); err != nil {
+			log.Fatal(err)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		for _, c := range cs {
+			c.Stop(ctx)
+		}
+		cancel()
+	}
+
+	if *asJSON {
+		data, err := json.MarshalIndent(report, "", "    ")
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Println(string(data))
+	} else {
+		fmt.Print(report.String())
+	}
+	if report.Committed == 0 {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/myzWILLmake/hotstuff-go"
+)
+
+// prefixWriter writes every line written to it to w after prefix. The
+// writers of a cluster share mu so their lines do not interleave.
+type prefixWriter struct {
+	mu     *sync.Mutex
+	w      io.Writer
+	prefix string
+	buf    []byte
+}
+
+func (pw *prefixWriter) Write(p []byte) (int, error) {
+	pw.mu.Lock()
+	defer pw.mu.Unlock()
+	pw.buf = append(pw.buf, p...)
+	for {
+		i := bytes.IndexByte(pw.buf, '\n')
+		if i < 0 {
+			break
+		}
+		fmt.Fprintf(pw.w, "%s%s", pw.prefix, pw.buf[:i+1])
+		pw.buf = pw.buf[i+1:]
+	}
+	return len(p), nil
+}
+
+// flush writes what is left of a last line without a newline.
+func (pw *prefixWriter) flush() {
+	pw.mu.Lock()
+	defer pw.mu.Unlock()
+	if len(pw.buf) > 0 {
+		fmt.Fprintf(pw.w, "%s%s\n", pw.prefix, pw.buf)
+		pw.buf = nil
+	}
+}
+
+func makePrefixWriter(mu *sync.Mutex, w io.Writer, prefix string) *prefixWriter {
+	pw := &prefixWriter{}
+	pw.mu = mu
+	pw.w = w
+	pw.prefix = fmt.Sprintf("%-6s", prefix)
+	return pw
+}
+
+// clusterChild is a node of the cluster run as a child process.
+type clusterChild struct {
+	name string
+	cmd  *exec.Cmd
+	out  *prefixWriter
+	done chan bool
+}
+
+func (c *clusterChild) wait() {
+	err := c.cmd.Wait()
+	c.out.flush()
+	if err != nil {
+		c.out.Write([]byte(fmt.Sprintf("%s exited: %s\n", c.name, err)))
+	}
+	close(c.done)
+}
+
+func startClusterChild(dir, kind string, id int, out *prefixWriter) (*clusterChild, error) {
+	self, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+	c := &clusterChild{}
+	c.name = fmt.Sprintf("%s %d", kind, id)
+	c.cmd = exec.Command(self, kind, "-config", filepath.Join(dir, "config.json"), "-data", dir, strconv.Itoa(id))
+	c.cmd.Stdout = out
+	c.cmd.Stderr = out
+	c.out = out
+	c.done = make(chan bool)
+	if err := c.cmd.Start(); err != nil {
+		return nil, err
+	}
+	go c.wait()
+	return c, nil
+}
+
+// stopClusterChildren terminates the children and kills those still
+// running after grace.
+func stopClusterChildren(children []*clusterChild, grace time.Duration) {
+	for _, c := range children {
+		c.cmd.Process.Signal(syscall.SIGTERM)
+	}
+	deadline := time.After(grace)
+	for _, c := range children {
+		select {
+		case <-c.done:
+			continue
+		case <-deadline:
+		}
+		for _, c := range children {
+			c.cmd.Process.Kill()
+		}
+		break
+	}
+	for _, c := range children {
+		<-c.done
+	}
+}
+
+// runCluster handles "cluster [flags]": it writes the config of a testbed of
+// replicas and clients on localhost into a directory, starts them in this
+// process or as child processes, and prints their logs, each line after
+// the node it comes from, until interrupted.
+func runCluster(args []string) {
+	fs := newFlagSet("cluster", "")
+	replicas := fs.Int("replicas", 4, "number of replicas")
+	clients := fs.Int("clients", 1, "number of clients")
+	dir := fs.String("dir", "cluster", "directory for the config and keys")
+	base := fs.Int("base", 10010, "first port, see keygen for the layout")
+	protocol := fs.String("protocol", "three-chain", "protocol mode")
+	level := fs.String("log-level", "info", "log level")
+	keys := fs.Bool("keys", false, "generate keys and sign messages")
+	procs := fs.Bool("procs", false, "run every node as a child process")
+	duration := fs.Duration("duration", 0, "stop after this long, 0 to run until interrupted")
+	parseArgs(fs, args, 0)
+	if *replicas < 1 || *clients < 0 {
+		log.Fatal("Invalid number of replicas or clients")
+	}
+	if _, err := hotstuff.ParseProtocolMode(*protocol); err != nil {
+		log.Fatal(err)
+	}
+
+	path, err := filepath.Abs(*dir)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := os.MkdirAll(path, 0700); err != nil {
+		log.Fatal(err)
+	}
+	keyDir := ""
+	if *keys {
+		keyDir = path
+	}
+	x, err := makeConfig(*replicas, *clients, *base, keyDir)
+	if err != nil {
+		log.Fatal(err)
+	}
+	x.Protocol = *protocol
+	x.Log.Level = *level
+	x.Log.Format = "text"
+	x.Log.File = "-"
+	if err := writeConfig(filepath.Join(path, "config.json"), x); err != nil {
+		log.Fatal(err)
+	}
+	printNodes(x)
+
+	mu := &sync.Mutex{}
+	var children []*clusterChild
+	var stops []func(ctx context.Context) error
+	if *procs {
+		for _, node := range x.Servers {
+			c, err := startClusterChild(path, "server", node.Id, makePrefixWriter(mu, os.Stdout, fmt.Sprintf("[r%d]", node.Id)))
+			if err != nil {
+				stopClusterChildren(children, 5*time.Second)
+				log.Fatal(err)
+			}
+			children = append(children, c)
+		}
+		for _, node := range x.Clients {
+			c, err := startClusterChild(path, "client", node.Id, makePrefixWriter(mu, os.Stdout, fmt.Sprintf("[c%d]", node.Id)))
+			if err != nil {
+				stopClusterChildren(children, 5*time.Second)
+				log.Fatal(err)
+			}
+			children = append(children, c)
+		}
+	} else {
+		serverAddrs, clientAddrs := addresses(x)
+		wg := &sync.WaitGroup{}
+		for _, node := range x.Servers {
+			opts, err := nodeOptions(x, node, true)
+			if err != nil {
+				log.Fatal(err)
+			}
+			opts.LogOutput = makePrefixWriter(mu, os.Stdout, fmt.Sprintf("[r%d]", node.Id))
+			hs := hotstuff.RunHotStuffServer(node.Id, serverAddrs, clientAddrs, opts, true, node.Debug, wg)
+			stops = append(stops, hs.Stop)
+		}
+		for _, node := range x.Clients {
+			opts, err := nodeOptions(x, node, false)
+			if err != nil {
+				log.Fatal(err)
+			}
+			opts.LogOutput = makePrefixWriter(mu, os.Stdout, fmt.Sprintf("[c%d]", node.Id))
+			c := hotstuff.RunClient(node.Id, node.Address, serverAddrs, opts, true, node.Debug, wg)
+			stops = append(stops, c.Stop)
+		}
+	}
+
+	// stop on a signal, at the end of the duration, or once every child
+	// process is gone
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	var timeout <-chan time.Time
+	if *duration > 0 {
+		timeout = time.After(*duration)
+	}
+	exited := make(chan bool)
+	if len(children) > 0 {
+		go func() {
+			for _, c := range children {
+				<-c.done
+			}
+			close(exited)
+		}()
+	}
+	select {
+	case <-stop:
+	case <-timeout:
+	case <-exited:
+	}
+	signal.Stop(stop)
+
+	stopClusterChildren(children, 5*time.Second)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for _, stop := range stops {
+		stop(ctx)
+	}
+	fmt.Println("cluster stopped")
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"bytes"
+	"sync"
+	"testing"
+)
+
+// The nodes of a cluster write whole lines, each after the prefix of its
+// node, however their output is split into writes.
+func TestPrefixWriter(t *testing.T) {
+	mu := &sync.Mutex{}
+	out := &bytes.Buffer{}
+	r0 := makePrefixWriter(mu, out, "[r0]")
+	c0 := makePrefixWriter(mu, out, "[c0]")
+
+	r0.Write([]byte("view 1"))
+	c0.Write([]byte("request\nrep"))
+	r0.Write([]byte(" started\n"))
+	c0.Write([]byte("ly\nlast"))
+	c0.flush()
+	r0.flush()
+
+	want := "[c0]  request\n[r0]  view 1 started\n[c0]  reply\n[c0]  last\n"
+	if out.String() != want {
+		t.Errorf("wrote %q, want %q", out.String(), want)
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/myzWILLmake/hotstuff-go"
+	"github.com/spf13/viper"
+)
+
+func readConfig(path string) (*X, error) {
+	viper.SetConfigFile(path)
+	viper.SetConfigType("json")
+	if err := viper.ReadInConfig(); err != nil {
+		return nil, err
+	}
+	x := &X{}
+	if err := viper.Unmarshal(x); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+// checkIds requires the ids of nodes to number them from 0 on, as every
+// node is handed the addresses of the others indexed by id. With no id
+// repeated and none out of range, none is missing either.
+func checkIds(kind string, nodes []NodeInfo) error {
+	seen := make([]bool, len(nodes))
+	for _, node := range nodes {
+		if node.Id < 0 || node.Id >= len(nodes) {
+			return fmt.Errorf("%s %d: ids of the %d %ss must run from 0 to %d", kind, node.Id, len(nodes), kind, len(nodes)-1)
+		}
+		if seen[node.Id] {
+			return fmt.Errorf("%s %d: duplicate id", kind, node.Id)
+		}
+		seen[node.Id] = true
+	}
+	return nil
+}
+
+// signedConfig reports whether any node of the config has a public key,
+// which makes every node sign.
+func signedConfig(x *X) bool {
+	for _, node := range append(append([]NodeInfo{}, x.Servers...), x.Clients...) {
+		if node.PublicKey != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// validateConfig checks the config for every node at once, so a mistake
+// stops a node before it starts rather than once it talks to the others.
+// Signing keys are left to the node running with them: only its own is
+// on its host.
+func validateConfig(x *X) error {
+	if len(x.Servers) == 0 {
+		return errors.New("no servers")
+	}
+	if _, err := hotstuff.ParseProtocolMode(x.Protocol); err != nil {
+		return err
+	}
+	if x.Log.Level != "" {
+		if _, err := hotstuff.ParseLevel(x.Log.Level); err != nil {
+			return err
+		}
+	}
+	if _, err := hotstuff.ParseLogFormat(x.Log.Format); err != nil {
+		return err
+	}
+	if err := checkIds("server", x.Servers); err != nil {
+		return err
+	}
+	if err := checkIds("client", x.Clients); err != nil {
+		return err
+	}
+	if _, err := weights(x); err != nil {
+		return err
+	}
+
+	members := make(map[int]bool)
+	for _, id := range x.Members {
+		if id < 0 || id >= len(x.Servers) {
+			return fmt.Errorf("member %d is not a server", id)
+		}
+		if members[id] {
+			return fmt.Errorf("member %d listed twice", id)
+		}
+		members[id] = true
+	}
+
+	// every node listens on its own addresses
+	listeners := make(map[string]string)
+	listen := func(node, what, addr string) error {
+		if addr == "" {
+			return nil
+		}
+		if other, ok := listeners[addr]; ok {
+			return fmt.Errorf("%s: %s address %s already used by %s", node, what, addr, other)
+		}
+		listeners[addr] = node
+		return nil
+	}
+	signed := signedConfig(x)
+	for _, id := range x.Operators {
+		if id < 0 || id >= len(x.Clients) {
+			return fmt.Errorf("operator %d is not a client", id)
+		}
+	}
+	if len(x.Operators) > 0 && !signed {
+		return errors.New("operators need signing keys")
+	}
+	var names []string
+	nodes := append(append([]NodeInfo{}, x.Servers...), x.Clients...)
+	for _, node := range x.Servers {
+		names = append(names, fmt.Sprintf("server %d", node.Id))
+	}
+	for _, node := range x.Clients {
+		names = append(names, fmt.Sprintf("client %d", node.Id))
+	}
+	for i, node := range nodes {
+		name := names[i]
+		if node.Address == "" {
+			return fmt.Errorf("%s: missing address", name)
+		}
+		for _, err := range []error{
+			listen(name, "rpc", node.Address),
+			listen(name, "debug", node.Debug),
+			listen(name, "admin", node.Admin),
+			listen(name, "metrics", node.Metrics),
+		} {
+			if err != nil {
+				return err
+			}
+		}
+		if signed && node.PublicKey == "" {
+			return fmt.Errorf("%s: missing public key, other nodes sign", name)
+		}
+		if x.TLS.CA != "" && (node.Cert == "" || node.Key == "") {
+			return fmt.Errorf("%s: missing TLS certificate or key", name)
+		}
+	}
+	return nil
+}
+
+func findNode(nodes []NodeInfo, id int) (NodeInfo, bool) {
+	for _, node := range nodes {
+		if node.Id == id {
+			return node, true
+		}
+	}
+	return NodeInfo{}, false
+}
+
+func printNodes(x *X) {
+	printNode := func(kind string, node NodeInfo) {
+		line := fmt.Sprintf("%-7s %-3d %-21s", kind, node.Id, node.Address)
+		if node.Debug != "" {
+			line += " debug " + node.Debug
+		}
+		if node.Admin != "" {
+			line += " admin " + node.Admin
+		}
+		if node.Metrics != "" {
+			line += " metrics " + node.Metrics
+		}
+		if node.Weight > 0 {
+			line += fmt.Sprintf(" weight %d", node.Weight)
+		}
+		fmt.Println(line)
+	}
+	for _, node := range x.Servers {
+		printNode("server", node)
+	}
+	for _, node := range x.Clients {
+		printNode("client", node)
+	}
+}
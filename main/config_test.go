@@ -0,0 +1,63 @@
+package main
+
+import (
+	"testing"
+)
+
+// validateConfig turns away configs a node could not run with, before
+// any node starts.
+func TestValidateConfig(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(x *X)
+		ok     bool
+	}{
+		{"generated", func(x *X) {}, true},
+		{"members and weights", func(x *X) { x.Members = []int{0, 1, 2}; x.Servers[0].Weight = 3 }, true},
+		{"no servers", func(x *X) { x.Servers = nil }, false},
+		{"unknown protocol", func(x *X) { x.Protocol = "pbft" }, false},
+		{"unknown log level", func(x *X) { x.Log.Level = "loud" }, false},
+		{"unknown log format", func(x *X) { x.Log.Format = "xml" }, false},
+		{"duplicate server id", func(x *X) { x.Servers[1].Id = 0 }, false},
+		{"missing client id", func(x *X) { x.Clients[1].Id = 2 }, false},
+		{"weight above the cap", func(x *X) { x.Servers[0].Weight = 1001 }, false},
+		{"member not a server", func(x *X) { x.Members = []int{0, 4} }, false},
+		{"member listed twice", func(x *X) { x.Members = []int{1, 1} }, false},
+		{"shared address", func(x *X) { x.Clients[0].Debug = x.Servers[2].Address }, false},
+		{"missing address", func(x *X) { x.Clients[1].Address = "" }, false},
+		{"operator without keys", func(x *X) { x.Operators = []int{0} }, false},
+		{"only one node with a public key", func(x *X) { x.Servers[0].PublicKey = "00" }, false},
+		{"missing certificate", func(x *X) { x.TLS.CA = "ca.pem" }, false},
+	}
+	for _, test := range tests {
+		x, err := makeConfig(4, 2, 10000, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		test.change(x)
+		if err := validateConfig(x); (err == nil) != test.ok {
+			t.Errorf("%s: error %v, want ok %v", test.name, err, test.ok)
+		}
+	}
+}
+
+// A config generated with keys is signed throughout and names an
+// operator.
+func TestValidateSignedConfig(t *testing.T) {
+	x, err := makeConfig(4, 2, 10000, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := validateConfig(x); err != nil {
+		t.Fatal(err)
+	}
+	x.Operators = []int{2}
+	if err := validateConfig(x); err == nil {
+		t.Errorf("operator that is not a client accepted")
+	}
+	x.Operators = []int{0}
+	x.Clients[1].PublicKey = ""
+	if err := validateConfig(x); err == nil {
+		t.Errorf("client without a public key accepted")
+	}
+}
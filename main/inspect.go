@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"time"
+)
+
+// fetchStatus asks the admin API at addr for the status of its node.
+func fetchStatus(client *http.Client, addr string) (string, error) {
+	resp, err := client.Get("http://" + addr + "/status")
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("%s: %s", resp.Status, data)
+	}
+	status := &bytes.Buffer{}
+	if err := json.Compact(status, data); err != nil {
+		return "", err
+	}
+	return status.String(), nil
+}
+
+// runInspect handles "inspect [flags]": it validates a config and lists its
+// nodes, and with -live asks every node that serves the admin API for its
+// status.
+func runInspect(args []string) {
+	fs := newFlagSet("inspect", "")
+	config := fs.String("config", "config.json", "config file")
+	live := fs.Bool("live", false, "show the status of the nodes serving the admin API")
+	parseArgs(fs, args, 0)
+
+	x, err := readConfig(*config)
+	if err != nil {
+		log.Fatalf("config file error: %s", err)
+	}
+	if err := validateConfig(x); err != nil {
+		fmt.Printf("config %s: invalid: %s\n", *config, err)
+		os.Exit(1)
+	}
+
+	features := ""
+	if x.TLS.CA != "" {
+		features += ", tls"
+	}
+	if signedConfig(x) {
+		features += ", signed"
+	}
+	if x.Trace != "" {
+		features += ", traced"
+	}
+	protocol := x.Protocol
+	if protocol == "" {
+		protocol = "three-chain"
+	}
+	fmt.Printf("config %s: valid, %d servers, %d clients, %s%s\n", *config, len(x.Servers), len(x.Clients), protocol, features)
+	printNodes(x)
+	if !*live {
+		return
+	}
+
+	client := &http.Client{Timeout: 2 * time.Second}
+	show := func(kind string, node NodeInfo) {
+		if node.Admin == "" {
+			return
+		}
+		status, err := fetchStatus(client, node.Admin)
+		if err != nil {
+			status = "unreachable: " + err.Error()
+		}
+		fmt.Printf("%s %d: %s\n", kind, node.Id, status)
+	}
+	for _, node := range x.Servers {
+		show("server", node)
+	}
+	for _, node := range x.Clients {
+		show("client", node)
+	}
+}
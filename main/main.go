@@ -1,55 +1,309 @@
 package main
 
 import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
 	"os"
+	"os/signal"
+	"path/filepath"
 	"strconv"
 	"sync"
+	"syscall"
+	"time"
 
 	"github.com/myzWILLmake/hotstuff-go"
-	"github.com/spf13/viper"
 )
 
 type NodeInfo struct {
-	Id      int    `json:"id"`
-	Address string `json:"address"`
-	Debug   string `json:"debug"`
+	Id         int    `json:"id"`
+	Address    string `json:"address"`
+	Debug      string `json:"debug"`
+	Cert       string `json:"cert,omitempty"`
+	Key        string `json:"key,omitempty"`
+	PublicKey  string `json:"publicKey,omitempty"`
+	SigningKey string `json:"signingKey,omitempty"`
+	// voting weight of a server, 1 when left out
+	Weight int `json:"weight,omitempty"`
+	// address of the Prometheus metrics endpoint, none when left out
+	Metrics string `json:"metrics,omitempty"`
+	// address of the HTTP admin API, none when left out
+	Admin string `json:"admin,omitempty"`
+}
+
+type TLSInfo struct {
+	CA string `json:"ca"`
+}
+
+// LogInfo configures the log written next to the debug server: File is a
+// path or "-" for stdout, no log when empty.
+type LogInfo struct {
+	Level  string `json:"level"`
+	Format string `json:"format"`
+	File   string `json:"file"`
 }
 
 type X struct {
-	Servers []NodeInfo `json:"servers"`
-	Clients []NodeInfo `json:"clients"`
+	Protocol string     `json:"protocol"`
+	TLS      TLSInfo    `json:"tls"`
+	Log      LogInfo    `json:"log"`
+	Servers  []NodeInfo `json:"servers"`
+	Clients  []NodeInfo `json:"clients"`
+	// replicas of the first epoch, all servers when left out
+	Members         []int `json:"members,omitempty"`
+	WeightedLeaders bool  `json:"weightedLeaders,omitempty"`
+	// clients allowed to reconfigure the cluster, which takes signing keys
+	Operators []int `json:"operators,omitempty"`
+	// file the spans of every client request are appended to, in the OTLP
+	// JSON encoding; no tracing when left out
+	Trace string `json:"trace,omitempty"`
 }
 
-func main() {
-	if len(os.Args) < 3 {
-		log.Fatal("Invalid augments")
-		return
+func logOptions(x *X, opts *hotstuff.Options) error {
+	var err error
+	if x.Log.Level != "" {
+		if opts.LogLevel, err = hotstuff.ParseLevel(x.Log.Level); err != nil {
+			return err
+		}
+	}
+	if opts.LogFormat, err = hotstuff.ParseLogFormat(x.Log.Format); err != nil {
+		return err
+	}
+	switch x.Log.File {
+	case "":
+	case "-":
+		opts.LogOutput = os.Stdout
+	default:
+		f, err := os.OpenFile(x.Log.File, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return err
+		}
+		opts.LogOutput = f
+	}
+	return nil
+}
+
+// weights returns the voting weights of the servers by id, or nil when
+// every server has the default weight.
+func weights(x *X) ([]int, error) {
+	var ws []int
+	for _, node := range x.Servers {
+		if node.Weight < 0 {
+			return nil, fmt.Errorf("server %d: negative weight %d", node.Id, node.Weight)
+		}
+		if node.Weight > hotstuff.MaxWeight {
+			return nil, fmt.Errorf("server %d: weight %d above %d", node.Id, node.Weight, hotstuff.MaxWeight)
+		}
+		if node.Weight > 0 {
+			ws = make([]int, len(x.Servers))
+		}
+	}
+	if ws == nil {
+		return nil, nil
+	}
+	for _, node := range x.Servers {
+		ws[node.Id] = node.Weight
 	}
+	return ws, nil
+}
+
+// tlsFiles returns nil, plain connections, unless the config names a CA.
+func tlsFiles(x *X, node NodeInfo) *hotstuff.TLSFiles {
+	if x.TLS.CA == "" {
+		return nil
+	}
+	return &hotstuff.TLSFiles{CA: x.TLS.CA, Cert: node.Cert, Key: node.Key}
+}
 
-	nodeType := os.Args[1]
-	if nodeType != "client" && nodeType != "server" {
-		log.Fatal("Invalid node type")
-		return
+// keyFiles returns nil, unsigned messages, unless the config lists public
+// keys for its nodes.
+func keyFiles(x *X, node NodeInfo) *hotstuff.KeyFiles {
+	if !signedConfig(x) {
+		return nil
+	}
+
+	files := &hotstuff.KeyFiles{}
+	files.SigningKey = node.SigningKey
+	files.Replicas = make([]string, len(x.Servers))
+	for _, server := range x.Servers {
+		files.Replicas[server.Id] = server.PublicKey
+	}
+	files.Clients = make([]string, len(x.Clients))
+	for _, client := range x.Clients {
+		files.Clients[client.Id] = client.PublicKey
 	}
+	files.Operators = x.Operators
+	return files
+}
+
+// command is a subcommand of the binary, run with the arguments after its
+// name.
+type command struct {
+	name  string
+	about string
+	run   func(args []string)
+}
 
-	id, err := strconv.Atoi(os.Args[2])
+var commands = []command{
+	{"server", "run a replica of the config", runServer},
+	{"client", "run a client of the config", runClient},
+	{"keygen", "write keys and a config template for a cluster", runKeygen},
+	{"cluster", "run a local cluster for testing", runCluster},
+	{"bench", "measure the throughput and latency of a cluster", runBench},
+	{"inspect", "validate a config and show the state of its nodes", runInspect},
+	{"scenario", "run a fault-injection scenario", runScenario},
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: %s <command> [flags] [args]\n\ncommands:\n", filepath.Base(os.Args[0]))
+	for _, c := range commands {
+		fmt.Fprintf(os.Stderr, "    %-9s %s\n", c.name, c.about)
+	}
+	fmt.Fprintf(os.Stderr, "\nRun a command with -h for its flags.\n")
+}
+
+// newFlagSet returns the flags of a command taking the positional args
+// after them.
+func newFlagSet(name, args string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: %s %s [flags] %s\n", filepath.Base(os.Args[0]), name, args)
+		fs.PrintDefaults()
+	}
+	return fs
+}
+
+// parseArgs parses args into fs and exits with its usage unless n
+// positional args remain.
+func parseArgs(fs *flag.FlagSet, args []string, n int) {
+	fs.Parse(args)
+	if fs.NArg() != n {
+		fs.Usage()
+		os.Exit(2)
+	}
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(2)
+	}
+	for _, c := range commands {
+		if c.name == os.Args[1] {
+			c.run(os.Args[2:])
+			return
+		}
+	}
+	if os.Args[1] != "-h" && os.Args[1] != "help" {
+		fmt.Fprintf(os.Stderr, "unknown command %q\n", os.Args[1])
+	}
+	usage()
+	os.Exit(2)
+}
+
+func runServer(args []string) {
+	runNode(true, args)
+}
+
+func runClient(args []string) {
+	runNode(false, args)
+}
+
+// runNode handles "server|client [flags] <id>": it starts the node of the
+// config with that id and runs until its consoles are killed or it gets
+// a signal.
+func runNode(server bool, args []string) {
+	kind := "client"
+	if server {
+		kind = "server"
+	}
+	fs := newFlagSet(kind, "<id>")
+	config := fs.String("config", "config.json", "config file")
+	data := fs.String("data", "", "directory to run in, which relative paths in the config are resolved against")
+	level := fs.String("log-level", "", "log level, overriding the config")
+	debug := fs.Bool("debug", true, "serve the debug console")
+	admin := fs.Bool("admin", true, "serve the HTTP admin API at the address in the config")
+	parseArgs(fs, args, 1)
+	id, err := strconv.Atoi(fs.Arg(0))
 	if err != nil {
 		log.Fatal("Invalid id")
-		return
 	}
-	viper.SetConfigName("config.json")
-	viper.AddConfigPath(".")
-	viper.SetConfigType("json")
-	err = viper.ReadInConfig()
+
+	path, err := filepath.Abs(*config)
 	if err != nil {
-		fmt.Printf("config file error: %s\n", err)
-		os.Exit(1)
+		log.Fatal(err)
+	}
+	if *data != "" {
+		if err := os.MkdirAll(*data, 0700); err != nil {
+			log.Fatal(err)
+		}
+		if err := os.Chdir(*data); err != nil {
+			log.Fatal(err)
+		}
+	}
+	x, err := readConfig(path)
+	if err != nil {
+		log.Fatalf("config file error: %s", err)
+	}
+	if *level != "" {
+		x.Log.Level = *level
+	}
+	if err := validateConfig(x); err != nil {
+		log.Fatalf("config %s: %s", path, err)
+	}
+	nodes := x.Clients
+	if server {
+		nodes = x.Servers
+	}
+	node, ok := findNode(nodes, id)
+	if !ok {
+		log.Fatalf("config %s: no %s %d", path, kind, id)
 	}
-	var x X
-	viper.Unmarshal(&x)
 
+	opts, err := nodeOptions(x, node, server)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if !*admin {
+		opts.AdminAddr = ""
+	}
+	serverAddrs, clientAddrs := addresses(x)
+	wg := &sync.WaitGroup{}
+	var stopNode func(ctx context.Context) error
+	if server {
+		stopNode = hotstuff.RunHotStuffServer(id, serverAddrs, clientAddrs, opts, *debug, node.Debug, wg).Stop
+	} else {
+		stopNode = hotstuff.RunClient(id, node.Address, serverAddrs, opts, *debug, node.Debug, wg).Stop
+	}
+
+	// killing a console stops the node, and so does a signal
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	var killed chan bool
+	if *debug || opts.AdminAddr != "" {
+		killed = make(chan bool)
+		go func() {
+			wg.Wait()
+			close(killed)
+		}()
+	}
+	select {
+	case <-stop:
+	case <-killed:
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := stopNode(ctx); err != nil {
+		log.Printf("stopping %s %d: %s", kind, id, err)
+	}
+}
+
+func addresses(x *X) ([]string, []string) {
 	serverAddrs := make([]string, len(x.Servers))
 	for _, node := range x.Servers {
 		serverAddrs[node.Id] = node.Address
@@ -58,18 +312,149 @@ func main() {
 	for _, node := range x.Clients {
 		clientAddrs[node.Id] = node.Address
 	}
+	return serverAddrs, clientAddrs
+}
+
+// nodeOptions gathers the options of a server or client from the config.
+func nodeOptions(x *X, node NodeInfo, server bool) (*hotstuff.Options, error) {
+	ws, err := weights(x)
+	if err != nil {
+		return nil, err
+	}
+
+	opts := &hotstuff.Options{}
+	opts.TLS = tlsFiles(x, node)
+	opts.KeyFiles = keyFiles(x, node)
+	opts.Weights = ws
+	opts.MetricsAddr = node.Metrics
+	opts.AdminAddr = node.Admin
+	opts.TraceFile = x.Trace
+	if err := logOptions(x, opts); err != nil {
+		return nil, err
+	}
+	if server {
+		if opts.Protocol, err = hotstuff.ParseProtocolMode(x.Protocol); err != nil {
+			return nil, err
+		}
+		opts.Members = x.Members
+		opts.WeightedLeaders = x.WeightedLeaders
+	}
+	return opts, nil
+}
+
+func runScenario(args []string) {
+	fs := newFlagSet("scenario", "<file>")
+	parseArgs(fs, args, 1)
+	scenario, err := hotstuff.LoadScenario(fs.Arg(0))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var logs io.Writer
+	if os.Getenv("HOTSTUFF_SCENARIO_LOG") != "" {
+		logs = os.Stdout
+	}
+	report, err := hotstuff.RunScenario(scenario, logs)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	fmt.Print(report.String())
+	if !report.Passed() {
+		os.Exit(1)
+	}
+}
+
+func writeKeyFile(path string, key []byte) {
+	err := ioutil.WriteFile(path, []byte(hex.EncodeToString(key)+"\n"), 0600)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// runKeygen handles "keygen [-dir dir] <replicas> <clients>": it writes a
+// signing key for every node into dir, and a config.json template listing
+// the public keys next to them.
+func runKeygen(args []string) {
+	fs := newFlagSet("keygen", "<replicas> <clients>")
+	dir := fs.String("dir", "keys", "directory for the keys and config template")
+	base := fs.Int("base", 10010, "first port of the layout")
+	parseArgs(fs, args, 2)
+	replicas, err := strconv.Atoi(fs.Arg(0))
+	if err != nil || replicas < 1 {
+		log.Fatal("Invalid number of replicas")
+	}
+	clients, err := strconv.Atoi(fs.Arg(1))
+	if err != nil || clients < 0 {
+		log.Fatal("Invalid number of clients")
+	}
 
-	if nodeType == "server" {
-		debugAddr := x.Servers[id].Debug
-		wg := &sync.WaitGroup{}
-		hotstuff.RunHotStuffServer(id, serverAddrs, clientAddrs, true, debugAddr, wg)
-		wg.Wait()
-	} else if nodeType == "client" {
-		clientAddr := x.Clients[id].Address
-		debugAddr := x.Clients[id].Debug
-		wg := &sync.WaitGroup{}
-		hotstuff.RunClient(id, clientAddr, serverAddrs, true, debugAddr, wg)
-		wg.Wait()
+	if err := os.MkdirAll(*dir, 0700); err != nil {
+		log.Fatal(err)
+	}
+	x, err := makeConfig(replicas, clients, *base, *dir)
+	if err != nil {
+		log.Fatal(err)
 	}
 
+	configPath := filepath.Join(*dir, "config.json")
+	if err := writeConfig(configPath, x); err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("Wrote keys for %d replicas and %d clients, config template %s\n", replicas, clients, configPath)
+}
+
+// makeConfig lays out replicas and clients on localhost: servers listen
+// from port base on, their debug consoles from base+10000, clients from
+// base+20000 and their consoles from base+20100. With a key directory it
+// also writes a signing key for every node there and makes the first
+// client an operator.
+func makeConfig(replicas, clients, base int, keyDir string) (*X, error) {
+	x := &X{}
+	for i := 0; i < replicas; i++ {
+		node := NodeInfo{}
+		node.Id = i
+		node.Address = fmt.Sprintf("127.0.0.1:%d", base+i)
+		node.Debug = fmt.Sprintf("127.0.0.1:%d", base+10000+i)
+		x.Servers = append(x.Servers, node)
+	}
+	for i := 0; i < clients; i++ {
+		node := NodeInfo{}
+		node.Id = i
+		node.Address = fmt.Sprintf("127.0.0.1:%d", base+20000+i)
+		node.Debug = fmt.Sprintf("127.0.0.1:%d", base+20100+i)
+		x.Clients = append(x.Clients, node)
+	}
+	if keyDir == "" {
+		return x, nil
+	}
+
+	replicaKeys, clientKeys, err := hotstuff.GenerateSigningKeys(replicas, clients)
+	if err != nil {
+		return nil, err
+	}
+	for i, keys := range replicaKeys {
+		node := &x.Servers[i]
+		node.PublicKey = hex.EncodeToString(keys.Replicas[i])
+		node.SigningKey = filepath.Join(keyDir, fmt.Sprintf("replica-%d.key", i))
+		writeKeyFile(node.SigningKey, keys.Private)
+	}
+	for i, keys := range clientKeys {
+		node := &x.Clients[i]
+		node.PublicKey = hex.EncodeToString(keys.Clients[i])
+		node.SigningKey = filepath.Join(keyDir, fmt.Sprintf("client-%d.key", i))
+		writeKeyFile(node.SigningKey, keys.Private)
+	}
+	if clients > 0 {
+		x.Operators = []int{0}
+	}
+	return x, nil
+}
+
+func writeConfig(path string, x *X) error {
+	data, err := json.MarshalIndent(x, "", "    ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, append(data, '\n'), 0644)
 }
@@ -1,14 +1,14 @@
 #!/bin/bash
 if [ $1 = "start" ]; then
     for (( i=0; i<4; i++ )) do
-        ./main server $i --tag=hotstuff-server &
+        ./main server $i &
     done
     for (( i=0; i<3; i++ )) do
-        ./main client $i --tag=hotstuff-client &
+        ./main client $i &
     done
 elif [ $1 = "kill" ]; then
-    pgrep -f hotstuff-server | xargs kill
-    pgrep -f hotstuff-client | xargs kill
+    pkill -f "main server"
+    pkill -f "main client"
 elif [ $1 = "build" ]; then
     go build
-fi
\ No newline at end of file
+fi
@@ -3,57 +3,122 @@ package hotstuff
 import (
 	"errors"
 	"strconv"
+	"strings"
+	"time"
 )
 
-func (hs *HotStuff) setMaliciousMode(maliciousMode int) error {
-	hs.mu.Lock()
-	defer hs.mu.Unlock()
-
-	if maliciousMode < 0 || maliciousMode > PartialMaliciousMode {
-		return errors.New("Invalid malicious mode")
+// parseAdversary builds an adversary from the arguments of the mb debug
+// command. The numeric modes of MaliciousBehaviorMode are still accepted.
+func parseAdversary(args []string) (Adversary, error) {
+	if len(args) == 0 {
+		return nil, errors.New("Arguments not enough")
 	}
 
-	hs.maliciousMode = MaliciousBehaviorMode(maliciousMode)
-	return nil
-}
+	if mode, err := strconv.Atoi(args[0]); err == nil {
+		switch mode {
+		case NormalMode:
+			return &honestAdversary{}, nil
+		case CrashedLike:
+			return &crashAdversary{}, nil
+		case MaliciousMode:
+			return &forkAdversary{false}, nil
+		case PartialMaliciousMode:
+			return &forkAdversary{true}, nil
+		}
+		return nil, errors.New("Invalid malicious mode")
+	}
 
-func (hs *HotStuff) sendMaliciousMsg(id int, rpcname string, rpcacgs interface{}, isPartial bool) {
-	args := rpcacgs.(*MsgArgs)
-	if !args.ParSig {
-		// From Leader
-		if !isPartial {
-			if args.Node.Parent != "" {
-				if hs.lockedQC.NodeId != "" {
-					node, ok := hs.nodeMap[hs.lockedQC.NodeId]
-					if ok {
-						fakeReq := &RequestArgs{}
-						fakeReq.ClientId = 1
-						fakeReq.Operation = "fakeop"
-						newId := getLogNodeId(hs.viewId, fakeReq)
-						newIdwithColor := "\033[0;31m" + newId + "_" + strconv.Itoa(hs.me) + "\033[0m"
-						args.Node.Id = newIdwithColor
-						args.Node.Parent = node.Parent
-						args.Node.Justify = node.Justify
-					}
-				}
+	switch args[0] {
+	case "honest", "normal":
+		return &honestAdversary{}, nil
+	case "crash":
+		return &crashAdversary{}, nil
+	case "fork":
+		partial := len(args) > 1 && args[1] == "partial"
+		return &forkAdversary{partial}, nil
+	case "withhold":
+		return &withholdAdversary{}, nil
+	case "selective":
+		if len(args) < 2 {
+			return nil, errors.New("usage: mb selective <id,id,...>")
+		}
+		peers := make(map[int]bool)
+		for _, field := range strings.Split(args[1], ",") {
+			id, err := strconv.Atoi(field)
+			if err != nil {
+				return nil, errors.New("Invalid replica id: " + field)
 			}
+			peers[id] = true
 		}
+		return &selectiveAdversary{peers}, nil
+	case "equivocate":
+		return &equivocateAdversary{}, nil
+	case "replay":
+		return &replayAdversary{}, nil
+	case "delay":
+		if len(args) < 2 {
+			return nil, errors.New("usage: mb delay <ms>")
+		}
+		ms, err := strconv.Atoi(args[1])
+		if err != nil || ms < 0 {
+			return nil, errors.New("Invalid delay: " + args[1])
+		}
+		return &delayAdversary{time.Duration(ms) * time.Millisecond}, nil
+	case "stale-parent":
+		depth := 1
+		if len(args) > 1 {
+			var err error
+			depth, err = strconv.Atoi(args[1])
+			if err != nil || depth < 1 {
+				return nil, errors.New("Invalid depth: " + args[1])
+			}
+		}
+		return &staleParentAdversary{depth}, nil
+	}
+	return nil, errors.New("Invalid malicious mode: " + args[0])
+}
+
+func (hs *HotStuff) setAdversary(args []string) (string, error) {
+	adversary, err := parseAdversary(args)
+	if err != nil {
+		return "", err
+	}
+
+	hs.exec(func() {
+		hs.adversary = adversary
+	})
+	return adversary.Name(), nil
+}
 
-		hs.rawSendMsg(id, rpcname, args)
-	} else {
-		// To Leader
-		// Generic message
-		if args.Node.Id != "" {
-			fakeReq := &RequestArgs{}
-			fakeReq.ClientId = 1
-			fakeReq.Operation = "fakeop"
-			newId := getLogNodeId(hs.viewId, fakeReq)
-			newIdwithColor := "\033[0;31m" + newId + "_" + strconv.Itoa(hs.me) + "\033[0m"
-			args.Node.Id = newIdwithColor
-			args.Node.Request = *fakeReq
-			hs.rawSendMsg(id, rpcname, args)
-		} else {
-			hs.rawSendMsg(id, rpcname, args)
+func (hs *HotStuff) fakeNodeId() string {
+	fakeReq := &RequestArgs{}
+	fakeReq.ClientId = 1
+	fakeReq.Operation = "fakeop"
+	newId := getLogNodeId(hs.core.viewId, fakeReq)
+	return "\033[0;31m" + newId + "_" + strconv.Itoa(hs.core.me) + "\033[0m"
+}
+
+// forkProposal rewrites the leader's proposal to extend the parent of the
+// locked node, trying to make replicas abandon the locked branch.
+func (hs *HotStuff) forkProposal(args *ProposalArgs) *ProposalArgs {
+	fakeArgs := *args
+	hc := hs.core
+	if args.Node.Parent != "" && hc.lockedQC.NodeId != "" {
+		node, ok := hc.nodeMap[hc.lockedQC.NodeId]
+		if ok {
+			fakeArgs.Node.Id = hs.fakeNodeId()
+			fakeArgs.Node.Parent = node.Parent
+			fakeArgs.Node.Justify = node.Justify
 		}
 	}
+	hs.core.keys.sign(&fakeArgs)
+	return &fakeArgs
+}
+
+// fakeVote votes for a node the leader never proposed.
+func (hs *HotStuff) fakeVote(args *VoteArgs) *VoteArgs {
+	fakeArgs := *args
+	fakeArgs.NodeId = hs.fakeNodeId()
+	hs.core.keys.sign(&fakeArgs)
+	return &fakeArgs
 }
@@ -0,0 +1,140 @@
+package hotstuff
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"reflect"
+	"strings"
+	"sync"
+)
+
+type memEndpoint struct {
+	client bool
+	id     int
+}
+
+// memNetwork connects the replicas and clients of an in-process cluster.
+// Calls are delivered synchronously to the target's RPC method after a gob
+// round trip, so nodes never share message memory, and can be cut by
+// partitions or crashes.
+type memNetwork struct {
+	mu      *sync.Mutex
+	servers []*HotStuff
+	clients []*Client
+	groups  map[int]int
+	crashed map[int]bool
+}
+
+// memPeer is the caller one endpoint uses to reach another.
+type memPeer struct {
+	net  *memNetwork
+	from memEndpoint
+	to   memEndpoint
+}
+
+func (p *memPeer) Call(serviceMethod string, args interface{}, reply interface{}) error {
+	if !p.net.connected(p.from, p.to) {
+		return errors.New("memnet: unreachable")
+	}
+
+	var target interface{}
+	if p.to.client && p.to.id < len(p.net.clients) {
+		target = p.net.clients[p.to.id]
+	} else if !p.to.client && p.to.id < len(p.net.servers) {
+		target = p.net.servers[p.to.id]
+	} else {
+		return errors.New("memnet: unknown endpoint")
+	}
+
+	dot := strings.LastIndex(serviceMethod, ".")
+	method := reflect.ValueOf(target).MethodByName(serviceMethod[dot+1:])
+	if !method.IsValid() {
+		return errors.New("memnet: unknown method " + serviceMethod)
+	}
+
+	argsCopy, err := gobCopy(args)
+	if err != nil {
+		return err
+	}
+	out := method.Call([]reflect.Value{reflect.ValueOf(argsCopy), reflect.ValueOf(reply)})
+	if err, ok := out[0].Interface().(error); ok {
+		return err
+	}
+	return nil
+}
+
+func gobCopy(args interface{}) (interface{}, error) {
+	buf := &bytes.Buffer{}
+	if err := gob.NewEncoder(buf).Encode(args); err != nil {
+		return nil, err
+	}
+	argsCopy := reflect.New(reflect.TypeOf(args).Elem())
+	if err := gob.NewDecoder(buf).Decode(argsCopy.Interface()); err != nil {
+		return nil, err
+	}
+	return argsCopy.Interface(), nil
+}
+
+// connected reports whether a message may pass. Clients are never
+// partitioned; a crashed replica neither sends nor receives.
+func (net *memNetwork) connected(from, to memEndpoint) bool {
+	net.mu.Lock()
+	defer net.mu.Unlock()
+
+	if (!from.client && net.crashed[from.id]) || (!to.client && net.crashed[to.id]) {
+		return false
+	}
+	if from.client || to.client {
+		return true
+	}
+	return net.groups[from.id] == net.groups[to.id]
+}
+
+func (net *memNetwork) partition(groups [][]int) {
+	net.mu.Lock()
+	defer net.mu.Unlock()
+
+	net.groups = make(map[int]int)
+	for i := range net.servers {
+		// replicas left out of every group form one more group
+		net.groups[i] = len(groups)
+	}
+	for g, group := range groups {
+		for _, id := range group {
+			net.groups[id] = g
+		}
+	}
+}
+
+func (net *memNetwork) heal() {
+	net.mu.Lock()
+	defer net.mu.Unlock()
+	net.groups = make(map[int]int)
+}
+
+func (net *memNetwork) setCrashed(id int, crashed bool) {
+	net.mu.Lock()
+	defer net.mu.Unlock()
+	net.crashed[id] = crashed
+}
+
+func (net *memNetwork) peers(from memEndpoint, client bool, cnt int) []caller {
+	peers := make([]caller, cnt)
+	for i := 0; i < cnt; i++ {
+		p := &memPeer{}
+		p.net = net
+		p.from = from
+		p.to = memEndpoint{client, i}
+		peers[i] = p
+	}
+	return peers
+}
+
+func makeMemNetwork() *memNetwork {
+	net := &memNetwork{}
+	net.mu = &sync.Mutex{}
+	net.groups = make(map[int]int)
+	net.crashed = make(map[int]bool)
+	return net
+}
@@ -0,0 +1,301 @@
+package hotstuff
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	counterMetric   = "counter"
+	gaugeMetric     = "gauge"
+	histogramMetric = "histogram"
+)
+
+var latencyBuckets = []float64{0.01, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60}
+var sizeBuckets = []float64{256, 512, 1024, 2048, 4096, 8192, 16384, 65536}
+
+// metricsRegistry keeps the counters, gauges and histograms of one replica
+// or client and writes them in the Prometheus text exposition format.
+// Labels are given as name, value pairs.
+type metricsRegistry struct {
+	mu       *sync.Mutex
+	families []*metricFamily
+	byName   map[string]*metricFamily
+}
+
+type metricFamily struct {
+	name    string
+	help    string
+	kind    string
+	buckets []float64
+	// gauges computed when scraped
+	read   func() float64
+	series map[string]*metricSeries
+}
+
+type metricSeries struct {
+	labels []string
+	value  float64
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+// declare adds a family. Families without labels start out at zero, the
+// others have no series until they are first recorded.
+func (r *metricsRegistry) declare(name, help, kind string, buckets []float64, labelled bool) *metricFamily {
+	mf := &metricFamily{}
+	mf.name = name
+	mf.help = help
+	mf.kind = kind
+	mf.buckets = buckets
+	mf.series = make(map[string]*metricSeries)
+	r.families = append(r.families, mf)
+	r.byName[name] = mf
+	if !labelled {
+		r.get(name, nil)
+	}
+	return mf
+}
+
+func (r *metricsRegistry) counter(name, help string) {
+	r.declare(name, help, counterMetric, nil, false)
+}
+
+// labelledCounter is a counter whose series are told apart by labels.
+func (r *metricsRegistry) labelledCounter(name, help string) {
+	r.declare(name, help, counterMetric, nil, true)
+}
+
+func (r *metricsRegistry) gauge(name, help string) {
+	r.declare(name, help, gaugeMetric, nil, false)
+}
+
+func (r *metricsRegistry) gaugeFunc(name, help string, read func() float64) {
+	r.declare(name, help, gaugeMetric, nil, true).read = read
+}
+
+func (r *metricsRegistry) histogram(name, help string, buckets []float64) {
+	r.declare(name, help, histogramMetric, buckets, false)
+}
+
+// get returns the series of name with the given labels, or nil when name
+// was never declared. The registry must be locked.
+func (r *metricsRegistry) get(name string, labels []string) *metricSeries {
+	mf := r.byName[name]
+	if mf == nil {
+		return nil
+	}
+	key := strings.Join(labels, "\x00")
+	s := mf.series[key]
+	if s == nil {
+		s = &metricSeries{}
+		s.labels = labels
+		s.counts = make([]uint64, len(mf.buckets))
+		mf.series[key] = s
+	}
+	return s
+}
+
+func (r *metricsRegistry) add(name string, v float64, labels ...string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if s := r.get(name, labels); s != nil {
+		s.value += v
+	}
+}
+
+func (r *metricsRegistry) set(name string, v float64, labels ...string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if s := r.get(name, labels); s != nil {
+		s.value = v
+	}
+}
+
+func (r *metricsRegistry) observe(name string, v float64, labels ...string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	s := r.get(name, labels)
+	if s == nil {
+		return
+	}
+	for i, bound := range r.byName[name].buckets {
+		if v <= bound {
+			s.counts[i]++
+		}
+	}
+	s.sum += v
+	s.count++
+}
+
+func formatLabels(labels []string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	pairs := make([]string, 0, len(labels)/2)
+	for i := 0; i+1 < len(labels); i += 2 {
+		value := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(labels[i+1])
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, labels[i], value))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatValue(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func (r *metricsRegistry) write(w io.Writer) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, mf := range r.families {
+		fmt.Fprintf(w, "# HELP %s %s\n", mf.name, mf.help)
+		fmt.Fprintf(w, "# TYPE %s %s\n", mf.name, mf.kind)
+		if mf.read != nil {
+			fmt.Fprintf(w, "%s %s\n", mf.name, formatValue(mf.read()))
+			continue
+		}
+
+		keys := make([]string, 0, len(mf.series))
+		for key := range mf.series {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			s := mf.series[key]
+			if mf.kind != histogramMetric {
+				fmt.Fprintf(w, "%s%s %s\n", mf.name, formatLabels(s.labels), formatValue(s.value))
+				continue
+			}
+			for i, bound := range mf.buckets {
+				labels := append(append([]string{}, s.labels...), "le", formatValue(bound))
+				fmt.Fprintf(w, "%s_bucket%s %d\n", mf.name, formatLabels(labels), s.counts[i])
+			}
+			labels := append(append([]string{}, s.labels...), "le", "+Inf")
+			fmt.Fprintf(w, "%s_bucket%s %d\n", mf.name, formatLabels(labels), s.count)
+			fmt.Fprintf(w, "%s_sum%s %s\n", mf.name, formatLabels(s.labels), formatValue(s.sum))
+			fmt.Fprintf(w, "%s_count%s %d\n", mf.name, formatLabels(s.labels), s.count)
+		}
+	}
+}
+
+func (r *metricsRegistry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	r.write(w)
+}
+
+func makeMetricsRegistry() *metricsRegistry {
+	r := &metricsRegistry{}
+	r.mu = &sync.Mutex{}
+	r.byName = make(map[string]*metricFamily)
+	return r
+}
+
+// rateWindow counts events over the last window for per-second gauges.
+type rateWindow struct {
+	mu     *sync.Mutex
+	window time.Duration
+	times  []time.Time
+}
+
+// trim forgets the events before the window ending at now. It is called
+// with the window locked.
+func (rw *rateWindow) trim(now time.Time) {
+	start := now.Add(-rw.window)
+	i := 0
+	for i < len(rw.times) && rw.times[i].Before(start) {
+		i++
+	}
+	rw.times = rw.times[i:]
+}
+
+// record trims too, so the window stays bounded when nobody reads the
+// rate.
+func (rw *rateWindow) record() {
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+	now := time.Now()
+	rw.trim(now)
+	rw.times = append(rw.times, now)
+}
+
+func (rw *rateWindow) rate() float64 {
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+	rw.trim(time.Now())
+	return float64(len(rw.times)) / rw.window.Seconds()
+}
+
+func makeRateWindow(window time.Duration) *rateWindow {
+	rw := &rateWindow{}
+	rw.mu = &sync.Mutex{}
+	rw.window = window
+	return rw
+}
+
+// peerLabel names peer id for a metric label. Ids outside the n peers
+// count as "unknown", so a sender cannot make up new series.
+func peerLabel(client bool, id, n int) string {
+	if id < 0 || id >= n {
+		return "unknown"
+	}
+	return identityName(client, id)
+}
+
+func makeReplicaMetrics(views *rateWindow) *metricsRegistry {
+	r := makeMetricsRegistry()
+	r.gauge("hotstuff_view", "Current view of the replica.")
+	r.counter("hotstuff_views_total", "Views entered.")
+	r.gaugeFunc("hotstuff_views_per_second", "Views entered per second over the last 10 seconds.", views.rate)
+	r.counter("hotstuff_timeouts_total", "Views that timed out.")
+	r.counter("hotstuff_qcs_total", "QCs formed as leader.")
+	r.counter("hotstuff_commits_total", "Nodes committed.")
+	r.histogram("hotstuff_commit_latency_seconds", "Time from receiving a proposal to committing its node.", latencyBuckets)
+	r.histogram("hotstuff_proposal_size_bytes", "Encoded size of the proposals made as leader.", sizeBuckets)
+	r.counter("hotstuff_votes_received_total", "Authenticated votes received.")
+	r.labelledCounter("hotstuff_messages_sent_total", "Messages sent by peer and method.")
+	r.labelledCounter("hotstuff_messages_received_total", "Authenticated messages received by sender and method.")
+	r.labelledCounter("hotstuff_rpc_errors_total", "Failed calls to a peer.")
+	return r
+}
+
+func makeClientMetrics() *metricsRegistry {
+	r := makeMetricsRegistry()
+	r.counter("hotstuff_client_requests_total", "Requests sent.")
+	r.counter("hotstuff_client_accepted_total", "Requests whose result was accepted.")
+	r.histogram("hotstuff_client_request_latency_seconds", "Time from sending a request to accepting its result.", latencyBuckets)
+	r.labelledCounter("hotstuff_client_messages_sent_total", "Messages sent by peer and method.")
+	r.labelledCounter("hotstuff_client_replies_received_total", "Replies received by replica.")
+	r.labelledCounter("hotstuff_client_rpc_errors_total", "Failed calls to a peer.")
+	return r
+}
+
+// methodName drops the service from an RPC method name.
+func methodName(serviceMethod string) string {
+	return serviceMethod[strings.LastIndex(serviceMethod, ".")+1:]
+}
+
+// serveMetrics exposes r at /metrics on its own mux.
+func serveMetrics(life *lifecycle, addr string, r *metricsRegistry) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", r)
+	serveHTTP(life, l, mux)
+	return nil
+}
@@ -0,0 +1,60 @@
+package hotstuff
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+// The window forgets old events as they are recorded, even when nobody
+// reads the rate.
+func TestRateWindowRecord(t *testing.T) {
+	rw := makeRateWindow(20 * time.Millisecond)
+	for i := 0; i < 5; i++ {
+		rw.record()
+	}
+	time.Sleep(30 * time.Millisecond)
+	rw.record()
+	if len(rw.times) != 1 {
+		t.Errorf("window holds %d events, want 1", len(rw.times))
+	}
+}
+
+// Only authenticated messages are counted, and senders outside the
+// cluster are labelled unknown.
+func TestMessagesReceived(t *testing.T) {
+	keys, _, err := GenerateSigningKeys(4, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed := makeHotStuff(0, make([]caller, 4), nil, ThreeChainMode, keys[0], makeLogger(ErrorLevel+1))
+	unsigned := makeHotStuff(0, make([]caller, 4), nil, ThreeChainMode, nil, makeLogger(ErrorLevel+1))
+
+	forged := vote(1000, 1, "1_noop").msg
+	signed.Vote(forged, &DefaultReply{})
+	unsigned.Vote(forged, &DefaultReply{})
+
+	tests := []struct {
+		name string
+		hs   *HotStuff
+		want string
+	}{
+		{"signed", signed, ""},
+		{"unsigned", unsigned, `hotstuff_messages_received_total{peer="unknown",method="Vote"} 1`},
+	}
+	for _, test := range tests {
+		w := &bytes.Buffer{}
+		test.hs.metrics.write(w)
+		out := w.String()
+		if strings.Contains(out, "replica-1000") {
+			t.Errorf("%s: forged sender labels a series", test.name)
+		}
+		if test.want == "" && strings.Contains(out, "hotstuff_messages_received_total{") {
+			t.Errorf("%s: counted a message that failed authentication", test.name)
+		}
+		if test.want != "" && !strings.Contains(out, test.want) {
+			t.Errorf("%s: no %s", test.name, test.want)
+		}
+	}
+}
@@ -1,17 +1,36 @@
 package hotstuff
 
 import (
+	"context"
+	"crypto/tls"
 	"errors"
+	"io"
 	"log"
 	"net"
 	"net/http"
 	"net/rpc"
 	"sync"
+	"time"
 )
 
+// caller is anything that can deliver an RPC to a peer: a peerWrapper over
+// the network, or a memPeer inside an in-process cluster.
+type caller interface {
+	Call(serviceMethod string, args interface{}, reply interface{}) error
+}
+
 type peerWrapper struct {
-	client  *rpc.Client
-	address string
+	client    *rpc.Client
+	address   string
+	name      string
+	tlsConfig *tls.Config
+}
+
+func (c *peerWrapper) dial() (*rpc.Client, error) {
+	if c.tlsConfig == nil {
+		return rpc.DialHTTP("tcp", c.address)
+	}
+	return dialHTTPTLS(c.address, c.name, c.tlsConfig)
 }
 
 func (c *peerWrapper) Call(serviceMethod string, args interface{}, reply interface{}) error {
@@ -23,7 +42,7 @@ func (c *peerWrapper) Call(serviceMethod string, args interface{}, reply interfa
 	}
 	if err != nil {
 		var errdial error
-		c.client, errdial = rpc.DialHTTP("tcp", c.address)
+		c.client, errdial = c.dial()
 		if errdial != nil {
 			return errdial
 		}
@@ -32,55 +51,365 @@ func (c *peerWrapper) Call(serviceMethod string, args interface{}, reply interfa
 	return err
 }
 
-func createPeers(addresses []string) []peerWrapper {
-	peers := make([]peerWrapper, len(addresses))
+func (c *peerWrapper) Close() error {
+	if c.client == nil {
+		return nil
+	}
+	return c.client.Close()
+}
+
+func createPeers(addresses []string, clients bool, tlsConfig *tls.Config) []caller {
+	peers := make([]caller, len(addresses))
 	for i := 0; i < len(addresses); i++ {
-		peers[i].client = nil
-		peers[i].address = addresses[i]
+		p := &peerWrapper{}
+		p.client = nil
+		p.address = addresses[i]
+		p.name = identityName(clients, i)
+		p.tlsConfig = tlsConfig
+		peers[i] = p
 	}
 
 	return peers
 }
 
-func RunHotStuffServer(id int, serverAddrs, clientAddrs []string, debug bool, debugAddr string, wg *sync.WaitGroup) *HotStuff {
-	debugCh := make(chan interface{}, 1024)
-	servers := createPeers(serverAddrs)
-	clients := createPeers(clientAddrs)
-	hotStuff := MakeHotStuff(id, servers, clients, debugCh)
+// outbox delivers the calls to one peer in order from its own goroutine,
+// so the event loop never waits on the network. observe, when set, learns
+// the outcome of every call. Calls queue up until the outbox is started.
+type outbox struct {
+	id      int
+	peer    caller
+	calls   chan outboxCall
+	observe func(id int, method string, err error)
+}
+
+type outboxCall struct {
+	method string
+	args   interface{}
+}
+
+func (o *outbox) send(method string, args interface{}) {
+	select {
+	case o.calls <- outboxCall{method, args}:
+	default:
+		// queue full, drop the message as a lossy network would
+	}
+}
+
+func (o *outbox) run(stop chan bool) {
+	for {
+		select {
+		case call := <-o.calls:
+			reply := &DefaultReply{}
+			err := o.peer.Call(call.method, call.args, reply)
+			if o.observe != nil {
+				o.observe(o.id, call.method, err)
+			}
+		case <-stop:
+			if c, ok := o.peer.(io.Closer); ok {
+				c.Close()
+			}
+			return
+		}
+	}
+}
+
+func (o *outbox) start(life *lifecycle) {
+	life.goWorker(func() { o.run(life.stopping) })
+}
+
+func makeOutbox(id int, peer caller, observe func(int, string, error)) *outbox {
+	o := &outbox{}
+	o.id = id
+	o.peer = peer
+	o.calls = make(chan outboxCall, 1024)
+	o.observe = observe
+	return o
+}
+
+func makeOutboxes(peers []caller, observe func(int, string, error)) []*outbox {
+	outboxes := make([]*outbox, len(peers))
+	for i := range peers {
+		outboxes[i] = makeOutbox(i, peers[i], observe)
+	}
+
+	return outboxes
+}
+
+// serveHTTP serves handler on l until life stops.
+func serveHTTP(life *lifecycle, l net.Listener, handler http.Handler) {
+	srv := &http.Server{Handler: handler}
+	life.onStop(func() { srv.Close() })
+	life.goWorker(func() { srv.Serve(l) })
+}
+
+// serveRPC serves rcvr on its own rpc.Server and mux, over mutual TLS
+// when tlsConfig is set.
+func serveRPC(life *lifecycle, name string, rcvr interface{}, addr string, tlsConfig *tls.Config) error {
+	server := rpc.NewServer()
+	if err := server.RegisterName(name, rcvr); err != nil {
+		return err
+	}
+
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	mux := http.NewServeMux()
+	if tlsConfig == nil {
+		mux.Handle(rpc.DefaultRPCPath, server)
+	} else {
+		l = tls.NewListener(l, tlsConfig)
+		mux.Handle(rpc.DefaultRPCPath, &tlsRPCHandler{server})
+	}
+	serveHTTP(life, l, mux)
+	return nil
+}
+
+// Options are the optional features of a replica or client. The zero value
+// runs the three-chain protocol over plain connections without signatures.
+type Options struct {
+	Protocol ProtocolMode
+	TLS      *TLSFiles
+	// KeyFiles are loaded at startup; Keys are used as they are when no
+	// KeyFiles are given.
+	KeyFiles *KeyFiles
+	Keys     *SigningKeys
+	// Members of the first epoch, all replicas when empty. A replica
+	// started later to join through "reconfig add" lists the members it
+	// joins.
+	Members []int
+	// Weights are the voting weights of the replicas by id, 1 when left
+	// out and at most MaxWeight. WeightedLeaders makes replicas lead in
+	// proportion to them.
+	Weights         []int
+	WeightedLeaders bool
+	// MetricsAddr serves Prometheus metrics at /metrics when set.
+	MetricsAddr string
+	// AdminAddr serves the HTTP admin API when set.
+	AdminAddr string
+	// Entries below LogLevel are dropped. The debug server always gets
+	// colored text; LogOutput, when set, gets LogFormat, plain text by
+	// default.
+	LogLevel  Level
+	LogFormat LogFormatter
+	LogOutput io.Writer
+	// TraceFile receives the spans of traced requests in the OTLP JSON
+	// encoding; TraceExporter receives them instead when set. A client
+	// with tracing traces every request it sends.
+	TraceFile     string
+	TraceExporter SpanExporter
+}
+
+// makeLogger logs to the given channels, those that are not nil, and to
+// LogOutput.
+func (opts *Options) makeLogger(chs ...chan interface{}) *Logger {
+	var sinks []chan interface{}
+	for _, ch := range chs {
+		if ch != nil {
+			sinks = append(sinks, ch)
+		}
+	}
+	if opts.LogOutput != nil {
+		format := opts.LogFormat
+		if format == nil {
+			format = &TextFormatter{}
+		}
+		ch := make(chan interface{}, 1024)
+		sinks = append(sinks, ch)
+		l := makeLogger(opts.LogLevel, sinks...)
+		l.writers.Add(1)
+		go func() {
+			writeLog(ch, format, opts.LogOutput)
+			l.writers.Done()
+		}()
+		return l
+	}
+	return makeLogger(opts.LogLevel, sinks...)
+}
+
+// makeTracer returns nil when tracing is off. A trace file it opens is
+// closed with the tracer.
+func (opts *Options) makeTracer(kv ...interface{}) (*Tracer, error) {
+	if opts.TraceExporter != nil {
+		return makeTracer(opts.TraceExporter, kv...), nil
+	}
+	if opts.TraceFile == "" {
+		return nil, nil
+	}
+	exporter, err := OpenTraceFile(opts.TraceFile)
+	if err != nil {
+		return nil, err
+	}
+	t := makeTracer(exporter, kv...)
+	t.closer = exporter
+	return t, nil
+}
+
+// stopOnKill is what the kill console command does: stop the whole
+// replica or client, giving up waiting after a while.
+func stopOnKill(stop func(ctx context.Context) error) func() {
+	return func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		stop(ctx)
+	}
+}
+
+func (opts *Options) loadKeys(self peerIdentity) (*SigningKeys, error) {
+	if opts.KeyFiles == nil {
+		return opts.Keys, nil
+	}
+	return loadKeys(opts.KeyFiles, self)
+}
+
+func RunHotStuffServer(id int, serverAddrs, clientAddrs []string, opts *Options, debug bool, debugAddr string, wg *sync.WaitGroup) *HotStuff {
+	if opts == nil {
+		opts = &Options{}
+	}
+	tlsConfig, err := loadTLSConfig(opts.TLS)
+	if err != nil {
+		log.Fatal(err)
+		return nil
+	}
+
+	keys, err := opts.loadKeys(peerIdentity{false, id})
+	if err != nil {
+		log.Fatal(err)
+		return nil
+	}
+
+	var debugCh, adminCh chan interface{}
+	if debug {
+		debugCh = make(chan interface{}, 1024)
+	}
+	if opts.AdminAddr != "" {
+		adminCh = make(chan interface{}, 1024)
+	}
+	logger := opts.makeLogger(debugCh, adminCh).with("replica", id)
+	servers := createPeers(serverAddrs, false, tlsConfig)
+	clients := createPeers(clientAddrs, true, tlsConfig)
+	hotStuff := makeHotStuff(id, servers, clients, opts.Protocol, keys, logger)
+	hotStuff.tracer, err = opts.makeTracer("service.name", "hotstuff-replica", "hotstuff.replica", id)
+	if err != nil {
+		log.Fatal(err)
+		return nil
+	}
+	hotStuff.dial = func(id int, address string) caller {
+		p := &peerWrapper{}
+		p.address = address
+		p.name = identityName(false, id)
+		p.tlsConfig = tlsConfig
+		return p
+	}
+	members := opts.Members
+	if len(members) == 0 {
+		members = make([]int, len(serverAddrs))
+		for i := range members {
+			members[i] = i
+		}
+	}
+	hotStuff.core.setValidators(makeValidatorSet(0, 0, members, opts.Weights, opts.WeightedLeaders))
+	hotStuff.Start()
+
+	if opts.MetricsAddr != "" {
+		if err := serveMetrics(hotStuff.life, opts.MetricsAddr, hotStuff.metrics); err != nil {
+			log.Fatal("metrics listen error:", err)
+			return nil
+		}
+	}
 
+	// killing either console stops the replica
 	if debug {
-		MakeHotStuffDebugServer(debugAddr, debugCh, hotStuff, wg)
+		hds := MakeHotStuffDebugServer(debugAddr, debugCh, hotStuff, wg)
+		hds.setOnKill(stopOnKill(hotStuff.Stop))
+		hotStuff.life.onStop(hds.close)
+	}
+	if opts.AdminAddr != "" {
+		has, err := MakeHotStuffAdminServer(opts.AdminAddr, adminCh, hotStuff, wg)
+		if err != nil {
+			log.Fatal("admin listen error:", err)
+			return nil
+		}
+		has.setOnKill(stopOnKill(hotStuff.Stop))
+		hotStuff.life.onStop(has.close)
 	}
 
-	rpc.Register(hotStuff)
-	rpc.HandleHTTP()
-	l, err := net.Listen("tcp", serverAddrs[id])
+	err = serveRPC(hotStuff.life, "HotStuff", hotStuff, serverAddrs[id], tlsConfig)
 	if err != nil {
 		log.Fatal("listen error:", err)
 		return nil
 	}
 
-	go http.Serve(l, nil)
 	return hotStuff
 }
 
-func RunClient(id int, clientAddr string, hotStuffAddrs []string, debug bool, debugAddr string, wg *sync.WaitGroup) *Client {
-	debugCh := make(chan interface{}, 1024)
-	peers := createPeers(hotStuffAddrs)
-	client := MakeClient(id, peers, debugCh)
+func RunClient(id int, clientAddr string, hotStuffAddrs []string, opts *Options, debug bool, debugAddr string, wg *sync.WaitGroup) *Client {
+	if opts == nil {
+		opts = &Options{}
+	}
+	tlsConfig, err := loadTLSConfig(opts.TLS)
+	if err != nil {
+		log.Fatal(err)
+		return nil
+	}
+
+	keys, err := opts.loadKeys(peerIdentity{true, id})
+	if err != nil {
+		log.Fatal(err)
+		return nil
+	}
+
+	var debugCh, adminCh chan interface{}
+	if debug {
+		debugCh = make(chan interface{}, 1024)
+	}
+	if opts.AdminAddr != "" {
+		adminCh = make(chan interface{}, 1024)
+	}
+	logger := opts.makeLogger(debugCh, adminCh).with("client", id)
+	peers := createPeers(hotStuffAddrs, false, tlsConfig)
+	client := makeClient(id, peers, keys, logger)
+	if len(opts.Members) > 0 || len(opts.Weights) > 0 {
+		members := opts.Members
+		if len(members) == 0 {
+			members = client.validators.members
+		}
+		client.validators = makeValidatorSet(0, 0, members, opts.Weights, false)
+	}
+	client.tracer, err = opts.makeTracer("service.name", "hotstuff-client", "hotstuff.client", id)
+	if err != nil {
+		log.Fatal(err)
+		return nil
+	}
+	client.Start()
+	if opts.MetricsAddr != "" {
+		if err := serveMetrics(client.life, opts.MetricsAddr, client.metrics); err != nil {
+			log.Fatal("metrics listen error:", err)
+			return nil
+		}
+	}
 
 	if debug {
-		MakeClientDebugServer(debugAddr, debugCh, client, wg)
+		cds := MakeClientDebugServer(debugAddr, debugCh, client, wg)
+		cds.setOnKill(stopOnKill(client.Stop))
+		client.life.onStop(cds.close)
+	}
+	if opts.AdminAddr != "" {
+		cas, err := MakeClientAdminServer(opts.AdminAddr, adminCh, client, wg)
+		if err != nil {
+			log.Fatal("admin listen error:", err)
+			return nil
+		}
+		cas.setOnKill(stopOnKill(client.Stop))
+		client.life.onStop(cas.close)
 	}
 
-	rpc.Register(client)
-	rpc.HandleHTTP()
-	l, err := net.Listen("tcp", clientAddr)
+	err = serveRPC(client.life, "Client", client, clientAddr, tlsConfig)
 	if err != nil {
 		log.Fatal("listen error:", err)
 		return nil
 	}
 
-	go http.Serve(l, nil)
 	return client
 }
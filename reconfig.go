@@ -0,0 +1,286 @@
+package hotstuff
+
+import (
+	"crypto/ed25519"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ReconfigPrefix starts the operation of a request that changes the
+// replica set. The commands are
+//
+//	reconfig add <id> <address> <weight> [public key]
+//	reconfig remove <id>
+//	reconfig key <id> <public key>
+//
+// with public keys in hex. An added replica takes the next free id, the
+// others name a member. Only operator clients may send them, and only
+// to a cluster with signing keys. They are ordered like any other request
+// and take effect in a new epoch once the node carrying them commits.
+const ReconfigPrefix = "reconfig "
+
+type reconfigCommand struct {
+	op      string
+	id      int
+	address string
+	weight  int
+	key     ed25519.PublicKey
+}
+
+func isReconfig(op interface{}) bool {
+	s, ok := op.(string)
+	return ok && strings.HasPrefix(s, ReconfigPrefix)
+}
+
+func parseReconfig(op string) (*reconfigCommand, error) {
+	args := strings.Fields(strings.TrimPrefix(op, ReconfigPrefix))
+	if len(args) < 2 {
+		return nil, errors.New("reconfig: missing arguments")
+	}
+
+	cmd := &reconfigCommand{}
+	cmd.op = args[0]
+	id, err := strconv.Atoi(args[1])
+	if err != nil || id < 0 {
+		return nil, fmt.Errorf("reconfig: invalid replica %s", args[1])
+	}
+	cmd.id = id
+
+	var hexKey string
+	switch {
+	case cmd.op == "add" && (len(args) == 4 || len(args) == 5):
+		cmd.address = args[2]
+		weight, err := strconv.Atoi(args[3])
+		if err != nil || weight < 1 || weight > MaxWeight {
+			return nil, fmt.Errorf("reconfig: invalid weight %s", args[3])
+		}
+		cmd.weight = weight
+		if len(args) == 5 {
+			hexKey = args[4]
+		}
+	case cmd.op == "remove" && len(args) == 2:
+	case cmd.op == "key" && len(args) == 3:
+		hexKey = args[2]
+	default:
+		return nil, fmt.Errorf("reconfig: invalid command %s", op)
+	}
+
+	if hexKey != "" {
+		key, err := hex.DecodeString(hexKey)
+		if err != nil || len(key) != ed25519.PublicKeySize {
+			return nil, errors.New("reconfig: invalid public key")
+		}
+		cmd.key = key
+	}
+	return cmd, nil
+}
+
+// apply returns the validator set of the epoch after vs, out of replicas
+// known so far.
+func (cmd *reconfigCommand) apply(vs *validatorSet, replicas, startView int) (*validatorSet, error) {
+	var members []int
+	weights := vs.weights
+	switch cmd.op {
+	case "add":
+		if cmd.id != replicas {
+			return nil, fmt.Errorf("reconfig: new replica must take id %d, not %d", replicas, cmd.id)
+		}
+		members = append(append(members, vs.members...), cmd.id)
+		if cmd.weight != 1 || len(weights) > 0 {
+			weights = append([]int{}, vs.weights...)
+			for len(weights) <= cmd.id {
+				weights = append(weights, 0)
+			}
+			weights[cmd.id] = cmd.weight
+		}
+	case "remove":
+		if !vs.contains(cmd.id) {
+			return nil, fmt.Errorf("reconfig: replica[%d] is not a member", cmd.id)
+		}
+		if vs.n() == 1 {
+			return nil, errors.New("reconfig: cannot remove the last replica")
+		}
+		for _, member := range vs.members {
+			if member != cmd.id {
+				members = append(members, member)
+			}
+		}
+	case "key":
+		if !vs.contains(cmd.id) {
+			return nil, fmt.Errorf("reconfig: replica[%d] is not a member", cmd.id)
+		}
+		members = vs.members
+	}
+	return makeValidatorSet(vs.epoch+1, startView, members, weights, vs.weighted), nil
+}
+
+// EpochChangeArgs announces that the sender committed Root, a
+// reconfiguration, and entered Epoch at StartView. A replica that missed
+// the commit follows once members holding more than a third of the weight
+// of its epoch agree.
+type EpochChangeArgs struct {
+	RepId     int
+	Epoch     int
+	StartView int
+	Root      LogNode
+	Sig       []byte
+}
+
+func (args *EpochChangeArgs) digest() []byte {
+	d := newDigest("epochchange")
+	d.int(args.RepId)
+	d.int(args.Epoch)
+	d.int(args.StartView)
+	d.node(&args.Root)
+	return d.sum()
+}
+
+func (args *EpochChangeArgs) signer() peerIdentity    { return peerIdentity{false, args.RepId} }
+func (args *EpochChangeArgs) signature() []byte       { return args.Sig }
+func (args *EpochChangeArgs) setSignature(sig []byte) { args.Sig = sig }
+
+func (args *EpochChangeArgs) key() string {
+	return fmt.Sprintf("%d/%d/%s", args.Epoch, args.StartView, args.Root.Id)
+}
+
+type epochChangeEvent struct {
+	msg *EpochChangeArgs
+}
+
+// reconfigAction tells the driver to reach and trust the replicas of a
+// new epoch.
+type reconfigAction struct {
+	cmd *reconfigCommand
+}
+
+// reconfigInFlight reports whether the chain we would extend holds a
+// reconfiguration that has not committed yet. Until it does, leaders only
+// propose noops: everything after it is abandoned at the epoch change.
+func (hc *hotStuffCore) reconfigInFlight() bool {
+	node := hc.getNode(hc.genericQC.NodeId)
+	for node != nil && node.ViewId > hc.lastExecutedView {
+		if isReconfig(node.Request.Operation) {
+			return true
+		}
+		node = hc.getNode(node.Parent)
+	}
+	return false
+}
+
+// getNode looks a node up in the chain of the current epoch: the root of
+// the epoch and everything before it are out of reach.
+func (hc *hotStuffCore) getNode(id string) *LogNode {
+	node, ok := hc.nodeMap[id]
+	if !ok || node.Epoch != hc.validators.epoch {
+		return nil
+	}
+	return node
+}
+
+// checkEpoch accepts messages of the current epoch only. Members of an
+// earlier epoch may no longer be members, and their quorums no longer
+// count.
+func (hc *hotStuffCore) checkEpoch(kind string, repId, epoch int) bool {
+	if epoch == hc.validators.epoch {
+		return true
+	}
+	if epoch < hc.validators.epoch {
+		hc.log(WarnLevel, "stale_epoch", kind+" of old epoch", "from", repId, "epoch", epoch, "members", hc.epochs[epoch].members)
+	} else {
+		hc.log(WarnLevel, "unknown_epoch", kind+" of unknown epoch", "from", repId, "epoch", epoch)
+	}
+	return false
+}
+
+// reconfigure starts the next epoch after root, a reconfiguration node,
+// has committed. The new chain grows from root, which every proposal of
+// the epoch extends.
+func (hc *hotStuffCore) reconfigure(root *LogNode, startView int) {
+	cmd, err := parseReconfig(root.Request.Operation.(string))
+	var next *validatorSet
+	if err == nil {
+		next, err = cmd.apply(hc.validators, hc.replicas, startView)
+	}
+	if err != nil {
+		hc.log(WarnLevel, "reconfig_rejected", "Reconfiguration rejected", "node", root.Id, "error", err.Error())
+		return
+	}
+
+	hc.validators = next
+	hc.epochs = append(hc.epochs, next)
+	if cmd.op == "add" {
+		hc.replicas++
+	}
+	hc.emit(reconfigAction{cmd})
+	hc.log(InfoLevel, "epoch_change", "Epoch change", "node", root.Id, "validators", next.String())
+
+	genesis := QC{}
+	genesis.Epoch = next.epoch
+	genesis.ViewId = startView - 1
+	genesis.NodeId = root.Id
+	hc.genesis = genesis
+	hc.genericQC = genesis
+	hc.lockedQC = genesis
+	hc.highTC = TC{}
+	hc.highAggQC = AggQC{}
+	hc.lastVotedView = genesis.ViewId
+	hc.timeoutMsgs = make(map[int]map[int]*NewViewArgs)
+	hc.savedNewViews = make(map[int]*NewViewArgs)
+	hc.epochChanges = make(map[string]map[int]*EpochChangeArgs)
+	hc.votes = makeVoteCollector(next)
+	hc.votes.reset(hc.viewId)
+
+	announce := &EpochChangeArgs{}
+	announce.RepId = hc.me
+	announce.Epoch = next.epoch
+	announce.StartView = startView
+	announce.Root = *root
+	hc.keys.sign(announce)
+	for id := 0; id < hc.replicas; id++ {
+		if id != hc.me {
+			hc.sendMsg(id, "EpochChange", announce)
+		}
+	}
+
+	hc.newView(startView)
+}
+
+// onEpochChange lets a replica that missed the commit of a reconfiguration
+// catch up with the members that did not.
+func (hc *hotStuffCore) onEpochChange(args *EpochChangeArgs) {
+	if args.Epoch != hc.validators.epoch+1 || args.Root.Epoch != hc.validators.epoch {
+		return
+	}
+	if !hc.validators.contains(args.RepId) {
+		return
+	}
+	root := args.Root
+	if !isReconfig(root.Request.Operation) || root.Request.Timestamp == 0 || !hc.keys.isOperator(root.Request.ClientId) {
+		return
+	}
+
+	key := args.key()
+	if hc.epochChanges[key] == nil {
+		hc.epochChanges[key] = make(map[int]*EpochChangeArgs)
+	}
+	hc.epochChanges[key][args.RepId] = args
+	var agreed []int
+	for repId := range hc.epochChanges[key] {
+		agreed = append(agreed, repId)
+	}
+	if !hc.validators.hasSupport(agreed) {
+		return
+	}
+
+	hc.nodeMap[root.Id] = &root
+	hc.committed = append(hc.committed, &root)
+	hc.lastExecutedView = root.ViewId
+	startView := args.StartView
+	if startView <= hc.viewId {
+		startView = hc.viewId + 1
+	}
+	hc.reconfigure(&root, startView)
+}
@@ -0,0 +1,143 @@
+package hotstuff
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+// Only operators reconfigure: their requests pass authentication and
+// their committed reconfigurations start an epoch, nobody else's do.
+func TestReconfigOperators(t *testing.T) {
+	keys, clientKeys, err := GenerateSigningKeys(4, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, k := range keys {
+		k.Operators = []int{0}
+	}
+
+	tests := []struct {
+		name    string
+		keys    *SigningKeys
+		client  int
+		op      string
+		allowed bool
+	}{
+		{"operator", keys[1], 0, "reconfig remove 3", true},
+		{"other client", keys[1], 1, "reconfig remove 3", false},
+		{"other client, plain request", keys[1], 1, "x", true},
+		{"cluster without keys", nil, 0, "reconfig remove 3", false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			request := RequestArgs{Operation: test.op, Timestamp: 100, ClientId: test.client}
+			clientKeys[test.client].sign(&request)
+
+			hs := makeHotStuff(1, make([]caller, 4), make([]caller, 2), ThreeChainMode, test.keys, makeLogger(ErrorLevel+1))
+			if err := hs.authenticateRequest(&request); (err == nil) != test.allowed {
+				t.Errorf("authenticated %v, want %v", err == nil, test.allowed)
+			}
+
+			hc := makeHotStuffCore(1, 4, ThreeChainMode, test.keys)
+			hc.start()
+			hc.execute(&LogNode{Id: getLogNodeId(1, &request), ViewId: 1, Request: request})
+			reconfigured := hc.validators.epoch == 1
+			if want := test.allowed && isReconfig(test.op); reconfigured != want {
+				t.Errorf("reconfigured %v, want %v", reconfigured, want)
+			}
+		})
+	}
+}
+
+func TestParseReconfig(t *testing.T) {
+	keys, _, err := GenerateSigningKeys(1, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hexKey := fmt.Sprintf("%x", keys[0].Replicas[0])
+
+	tests := []struct {
+		op     string
+		weight int
+		key    bool
+		ok     bool
+	}{
+		{"reconfig add 4 127.0.0.1:10014 2", 2, false, true},
+		{"reconfig add 4 127.0.0.1:10014 1 " + hexKey, 1, true, true},
+		{"reconfig add 4 127.0.0.1:10014", 0, false, false},
+		{"reconfig add 4 127.0.0.1:10014 0", 0, false, false},
+		{"reconfig add 4 127.0.0.1:10014 x", 0, false, false},
+		{"reconfig add -1 127.0.0.1:10014 1", 0, false, false},
+		{"reconfig add 4 127.0.0.1:10014 1 00", 0, false, false},
+		{"reconfig remove 3", 0, false, true},
+		{"reconfig remove x", 0, false, false},
+		{"reconfig remove 3 4", 0, false, false},
+		{"reconfig key 1 " + hexKey, 0, true, true},
+		{"reconfig key 1", 0, false, false},
+		{"reconfig move 1", 0, false, false},
+		{"reconfig ", 0, false, false},
+	}
+	for _, test := range tests {
+		cmd, err := parseReconfig(test.op)
+		if (err == nil) != test.ok {
+			t.Errorf("%q: error %v, want ok %v", test.op, err, test.ok)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if cmd.weight != test.weight || (cmd.key != nil) != test.key {
+			t.Errorf("%q: weight %d key %v, want weight %d key %v", test.op, cmd.weight, cmd.key != nil, test.weight, test.key)
+		}
+	}
+}
+
+// A committed reconfiguration starts an epoch only when it adds the next
+// replica or names a member.
+func TestReconfigure(t *testing.T) {
+	keys, _, err := GenerateSigningKeys(4, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys[0].Operators = []int{0}
+	hexKey := fmt.Sprintf("%x", keys[3].Replicas[3])
+
+	tests := []struct {
+		op       string
+		members  []int
+		weight   int
+		replicas int
+	}{
+		{"reconfig add 4 127.0.0.1:10014 3", []int{0, 1, 2, 3, 4}, 3, 5},
+		{"reconfig add 5 127.0.0.1:10015 1", nil, 0, 4},
+		{"reconfig add 100000000 127.0.0.1:10015 1", nil, 0, 4},
+		{"reconfig add 2 127.0.0.1:10012 1", nil, 0, 4},
+		{"reconfig remove 3", []int{0, 1, 2}, 0, 4},
+		{"reconfig remove 7", nil, 0, 4},
+		{"reconfig key 1 " + hexKey, []int{0, 1, 2, 3}, 0, 4},
+		{"reconfig key 9 " + hexKey, nil, 0, 4},
+	}
+	for _, test := range tests {
+		t.Run(test.op, func(t *testing.T) {
+			hc := makeHotStuffCore(0, 4, ThreeChainMode, keys[0])
+			hc.start()
+			request := RequestArgs{Operation: test.op, Timestamp: 100, ClientId: 0}
+			hc.execute(&LogNode{Id: getLogNodeId(1, &request), ViewId: 1, Request: request})
+
+			if test.members == nil {
+				if hc.validators.epoch != 0 {
+					t.Errorf("reconfigured to %s", hc.validators)
+				}
+			} else if hc.validators.epoch != 1 || !reflect.DeepEqual(hc.validators.members, test.members) {
+				t.Errorf("reconfigured to %s, want members %v", hc.validators, test.members)
+			}
+			if test.weight > 0 && hc.validators.weight(4) != test.weight {
+				t.Errorf("new replica weighs %d, want %d", hc.validators.weight(4), test.weight)
+			}
+			if hc.replicas != test.replicas {
+				t.Errorf("%d replicas, want %d", hc.replicas, test.replicas)
+			}
+		})
+	}
+}
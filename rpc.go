@@ -1,72 +1,173 @@
 package hotstuff
 
-import "fmt"
+import (
+	"fmt"
+	"sync/atomic"
+)
 
-func (hs *HotStuff) Request(args *RequestArgs, reply *DefaultReply) error {
-	hs.mu.Lock()
-	defer hs.mu.Unlock()
-
-	// TODO: only one client request should be serviced
-	msg := fmt.Sprintf("Recieve Request: id[%d] op[%s] time[%d]\n", args.ClientId, args.Operation.(string), args.Timestamp)
-	hs.debugPrint(msg)
-	if hs.isLeader() {
-		hs.processClientRequest(args)
-		if hs.noopTimer != nil {
-			hs.noopTimer.Cancel()
-			hs.noopTimer = nil
+// authenticate checks the sender's signature before the message gets
+// anywhere near the core, counting every failure.
+func (hs *HotStuff) authenticate(msg signable) error {
+	if err := hs.getKeys().verify(msg); err != nil {
+		atomic.AddInt64(&hs.authFailures, 1)
+		return err
+	}
+	return nil
+}
+
+// authenticateRequest admits only requests signed by a registered client,
+// and reconfigurations only from an operator.
+func (hs *HotStuff) authenticateRequest(args *RequestArgs) error {
+	if args.Timestamp == 0 {
+		atomic.AddInt64(&hs.authFailures, 1)
+		return fmt.Errorf("auth: request from client[%d] without timestamp", args.ClientId)
+	}
+	if args.ClientId < 0 || args.ClientId >= len(hs.clients) {
+		atomic.AddInt64(&hs.authFailures, 1)
+		return fmt.Errorf("auth: unknown client[%d]", args.ClientId)
+	}
+	if isReconfig(args.Operation) {
+		if !hs.getKeys().isOperator(args.ClientId) {
+			atomic.AddInt64(&hs.authFailures, 1)
+			return fmt.Errorf("auth: client[%d] may not reconfigure", args.ClientId)
 		}
+		if _, err := parseReconfig(args.Operation.(string)); err != nil {
+			return err
+		}
+	}
+	return hs.authenticate(args)
+}
+
+func (hs *HotStuff) Request(args *RequestArgs, reply *DefaultReply) error {
+	if err := hs.authenticateRequest(args); err != nil {
+		reply.Err = err.Error()
+		return nil
 	}
+	hs.received("Request", peerIdentity{true, args.ClientId})
 
+	hs.post(requestEvent{args})
 	return nil
 }
 
-func (hs *HotStuff) Msg(args *MsgArgs, reply *DefaultReply) error {
-	hs.mu.Lock()
-	defer hs.mu.Unlock()
-
-	if !args.ParSig {
-		// From Leader
-		msg := fmt.Sprintf("\033[1;36mReceive Msg From Leader:\033[0m rid[%d] viewId[%d] nodeId[%s]\n", args.RepId, args.ViewId, args.Node.Id)
-		hs.debugPrint(msg)
-		if args.ViewId%hs.n != args.RepId {
-			reply.Err = fmt.Sprintf("Generic msg from invalid leader[%d].\n", args.RepId)
+func (hs *HotStuff) Propose(args *ProposalArgs, reply *DefaultReply) error {
+	if err := hs.authenticate(args); err != nil {
+		reply.Err = err.Error()
+		return nil
+	}
+	hs.received("Propose", args.signer())
+	// the leader must not slip in a request no client signed
+	if args.Node.Request.Timestamp != 0 {
+		if err := hs.authenticateRequest(&args.Node.Request); err != nil {
+			reply.Err = err.Error()
 			return nil
 		}
+	}
+	if err := args.validate(hs.replicaCount()); err != nil {
+		reply.Err = err.Error()
+		return nil
+	}
 
-		if args.ViewId > hs.viewId {
-			// TODO: check threshold signature
-			hs.newView(args.ViewId)
-		}
+	hs.post(proposalEvent{args})
+	return nil
+}
 
-		if args.ViewId != hs.viewId {
-			reply.Err = fmt.Sprintf("Generic msg from invalid viewId[%d].\n", args.ViewId)
-			return nil
-		}
+func (hs *HotStuff) Vote(args *VoteArgs, reply *DefaultReply) error {
+	if err := hs.authenticate(args); err != nil {
+		reply.Err = err.Error()
+		return nil
+	}
+	hs.received("Vote", args.signer())
+	hs.metrics.add("hotstuff_votes_received_total", 1)
+	if err := args.validate(hs.replicaCount()); err != nil {
+		reply.Err = err.Error()
+		return nil
+	}
 
-		hs.update(&args.Node)
-	} else {
-		// To Leader
-		msg := fmt.Sprintf("\033[1;36mReceive Msg to Leader:\033[0m rid[%d] viewId[%d] nodeId[%s] qcId[%s]\n", args.RepId, args.ViewId, args.Node.Id, args.QC.NodeId)
-		hs.debugPrint(msg)
-		// if args.ViewId != hs.viewId {
-		// 	reply.Err = fmt.Sprintf("Vote msg from invalid viewId[%d].\n", args.ViewId)
-		// 	return nil
-		// }
-
-		if hs.isNextLeader() {
-			hs.savedMsgs[args.RepId] = args
-			hs.processSavedMsgs()
-		}
+	hs.post(voteEvent{args})
+	return nil
+}
+
+func (hs *HotStuff) NewView(args *NewViewArgs, reply *DefaultReply) error {
+	if err := hs.authenticate(args); err != nil {
+		reply.Err = err.Error()
+		return nil
+	}
+	hs.received("NewView", args.signer())
+	if err := args.validate(hs.replicaCount()); err != nil {
+		reply.Err = err.Error()
+		return nil
+	}
+
+	hs.post(newViewEvent{args})
+	return nil
+}
+
+func (hs *HotStuff) Evidence(args *Evidence, reply *DefaultReply) error {
+	if err := args.verify(hs.replicaCount(), hs.getKeys()); err != nil {
+		atomic.AddInt64(&hs.authFailures, 1)
+		reply.Err = err.Error()
+		return nil
+	}
+
+	hs.post(evidenceEvent{args})
+	return nil
+}
+
+func (hs *HotStuff) EpochChange(args *EpochChangeArgs, reply *DefaultReply) error {
+	if err := hs.authenticate(args); err != nil {
+		reply.Err = err.Error()
+		return nil
 	}
+	hs.received("EpochChange", args.signer())
 
+	hs.post(epochChangeEvent{args})
+	return nil
+}
+
+func (hs *HotStuff) DKG(args *DKGArgs, reply *DefaultReply) error {
+	if err := hs.authenticate(args); err != nil {
+		reply.Err = err.Error()
+		return nil
+	}
+	hs.received("DKG", args.signer())
+	if args.RepId < 0 || args.RepId >= hs.replicaCount() {
+		reply.Err = fmt.Sprintf("dkg: invalid replica[%d]", args.RepId)
+		return nil
+	}
+
+	session, err := hs.joinDKG(args.Session)
+	if err != nil {
+		reply.Err = err.Error()
+		return nil
+	}
+	session.receive(args)
 	return nil
 }
 
 func (c *Client) Reply(args *ReplyArgs, reply *DefaultReply) error {
 	c.mu.Lock()
 	defer c.mu.Unlock()
-	c.debugPrint(fmt.Sprintf("Received Reply[%d, %s, %d] from ReplicaId[%d]\n", args.Timestamp, args.Result, args.ViewId, args.ReplicaId))
+	err := c.keys.verify(args)
+	if err == nil && args.ClientId != c.me {
+		err = fmt.Errorf("auth: reply for client[%d]", args.ClientId)
+	}
+	if err != nil {
+		c.authFailures++
+		c.logger.log(WarnLevel, "reply_rejected", "Reply rejected", "error", err.Error())
+		reply.Err = err.Error()
+		return nil
+	}
+	c.logger.log(DebugLevel, "reply_received", "Received Reply", "from", args.ReplicaId, "time", args.Timestamp, "result", args.Result, "msgView", args.ViewId)
+	c.metrics.add("hotstuff_client_replies_received_total", 1, "peer", peerLabel(false, args.ReplicaId, len(c.peers)))
+	span := c.tracer.start("Client.Reply", SpanKindServer, args.Trace.child("Client.Reply", c.me), args.Trace, "from", args.ReplicaId)
 	c.saveReply(args)
-	c.processReplies(args.Timestamp)
+	if c.learnEpoch(args) {
+		for timestamp := range c.replies {
+			c.processReplies(timestamp)
+		}
+	} else {
+		c.processReplies(args.Timestamp)
+	}
+	span.end()
 	return nil
 }
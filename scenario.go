@@ -0,0 +1,434 @@
+package hotstuff
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Scenario is a fault-injection timeline run against an in-process
+// cluster. It is read from a JSON file such as:
+//
+//	{
+//	    "name": "partition then heal",
+//	    "replicas": 4,
+//	    "clients": 1,
+//	    "protocol": "three-chain",
+//	    "viewTimeout": 2000,
+//	    "noopTimeout": 200,
+//	    "duration": 20000,
+//	    "events": [
+//	        {"at": 1000, "action": "malicious", "replica": 2, "args": ["equivocate"]},
+//	        {"at": 3000, "action": "partition", "groups": [[0, 1], [2, 3]]},
+//	        {"at": 5000, "action": "crash", "replica": 3},
+//	        {"at": 8000, "action": "heal"},
+//	        {"at": 8000, "action": "recover", "replica": 3},
+//	        {"at": 9000, "action": "request", "client": 0, "op": "x"}
+//	    ],
+//	    "expect": {"minCommits": 2, "exactlyOnce": true}
+//	}
+//
+// All times are milliseconds from the start of the run.
+type Scenario struct {
+	Name        string          `json:"name"`
+	Replicas    int             `json:"replicas"`
+	Clients     int             `json:"clients"`
+	Protocol    string          `json:"protocol"`
+	ViewTimeout int             `json:"viewTimeout"`
+	NoopTimeout int             `json:"noopTimeout"`
+	Duration    int             `json:"duration"`
+	Events      []ScenarioEvent `json:"events"`
+	Expect      ScenarioExpect  `json:"expect"`
+}
+
+type ScenarioEvent struct {
+	At      int      `json:"at"`
+	Action  string   `json:"action"`
+	Replica int      `json:"replica"`
+	Client  int      `json:"client"`
+	Args    []string `json:"args"`
+	Groups  [][]int  `json:"groups"`
+	Op      string   `json:"op"`
+}
+
+// ScenarioExpect is the liveness requirement: every replica that ends the
+// run honest and reachable must commit at least MinCommits nodes after the
+// last fault was lifted, and with ExactlyOnce the request of every request
+// event too. Safety is always checked: honest replicas commit one sequence
+// of nodes and no request twice.
+type ScenarioExpect struct {
+	MinCommits  int  `json:"minCommits"`
+	ExactlyOnce bool `json:"exactlyOnce"`
+}
+
+type ScenarioReport struct {
+	Name       string
+	Safe       bool
+	Live       bool
+	Violations []string
+	Commits    map[int]int
+	Views      map[int]int
+}
+
+func (r *ScenarioReport) Passed() bool {
+	return r.Safe && r.Live
+}
+
+func (r *ScenarioReport) String() string {
+	result := "PASS"
+	if !r.Passed() {
+		result = "FAIL"
+	}
+	msg := fmt.Sprintf("Scenario [%s]: %s\n", r.Name, result)
+	msg += fmt.Sprintf("    safety:   %v\n", r.Safe)
+	msg += fmt.Sprintf("    liveness: %v\n", r.Live)
+	ids := make([]int, 0, len(r.Commits))
+	for id := range r.Commits {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	for _, id := range ids {
+		msg += fmt.Sprintf("    replica[%d] view[%d] commits[%d]\n", id, r.Views[id], r.Commits[id])
+	}
+	for _, v := range r.Violations {
+		msg += fmt.Sprintf("    violation: %s\n", v)
+	}
+	return msg
+}
+
+func LoadScenario(path string) (*Scenario, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Scenario{}
+	if err := json.Unmarshal(data, s); err != nil {
+		return nil, fmt.Errorf("scenario %s: %s", path, err)
+	}
+	if err := s.validate(); err != nil {
+		return nil, fmt.Errorf("scenario %s: %s", path, err)
+	}
+	return s, nil
+}
+
+func (s *Scenario) validate() error {
+	if s.Replicas < 1 {
+		return errors.New("replicas must be positive")
+	}
+	if s.Duration <= 0 {
+		return errors.New("duration must be positive")
+	}
+	if _, err := ParseProtocolMode(s.Protocol); err != nil {
+		return err
+	}
+	for i, e := range s.Events {
+		switch e.Action {
+		case "malicious":
+			if _, err := parseAdversary(e.Args); err != nil {
+				return fmt.Errorf("event %d: %s", i, err)
+			}
+			fallthrough
+		case "crash", "recover":
+			if e.Replica < 0 || e.Replica >= s.Replicas {
+				return fmt.Errorf("event %d: invalid replica %d", i, e.Replica)
+			}
+		case "partition":
+			for _, group := range e.Groups {
+				for _, id := range group {
+					if id < 0 || id >= s.Replicas {
+						return fmt.Errorf("event %d: invalid replica %d", i, id)
+					}
+				}
+			}
+		case "heal":
+		case "request":
+			if e.Client < 0 || e.Client >= s.Clients {
+				return fmt.Errorf("event %d: invalid client %d", i, e.Client)
+			}
+		default:
+			return fmt.Errorf("event %d: unknown action %s", i, e.Action)
+		}
+	}
+	return nil
+}
+
+// localCluster is a set of replicas and clients wired through a memNetwork.
+type localCluster struct {
+	net     *memNetwork
+	servers []*HotStuff
+	clients []*Client
+}
+
+func makeLocalCluster(replicas, clients int, protocol ProtocolMode, viewTimeout, noopTimeout time.Duration, logs io.Writer) (*localCluster, error) {
+	lc := &localCluster{}
+	lc.net = makeMemNetwork()
+	keys, clientKeys, err := GenerateSigningKeys(replicas, clients)
+	if err != nil {
+		return nil, err
+	}
+	logMu := &sync.Mutex{}
+	for i := 0; i < replicas; i++ {
+		from := memEndpoint{false, i}
+		logger := makeScenarioLogger(fmt.Sprintf("[r%d] ", i), logs, logMu).with("replica", i)
+		hs := makeHotStuff(i, lc.net.peers(from, false, replicas), lc.net.peers(from, true, clients), protocol, keys[i], logger)
+		if viewTimeout > 0 {
+			hs.core.viewTimeout = viewTimeout
+		}
+		if noopTimeout > 0 {
+			hs.core.noopTimeout = noopTimeout
+		}
+		hs.dial = func(id int, address string) caller {
+			return &memPeer{lc.net, from, memEndpoint{false, id}}
+		}
+		lc.servers = append(lc.servers, hs)
+	}
+	for i := 0; i < clients; i++ {
+		from := memEndpoint{true, i}
+		logger := makeScenarioLogger(fmt.Sprintf("[c%d] ", i), logs, logMu).with("client", i)
+		lc.clients = append(lc.clients, makeClient(i, lc.net.peers(from, false, replicas), clientKeys[i], logger))
+	}
+	lc.net.servers = lc.servers
+	lc.net.clients = lc.clients
+	for _, hs := range lc.servers {
+		hs.Start()
+	}
+	for _, c := range lc.clients {
+		c.Start()
+	}
+	return lc, nil
+}
+
+// makeScenarioLogger writes colored entries to w with every line
+// prefixed, or drops them all when w is nil.
+func makeScenarioLogger(prefix string, w io.Writer, mu *sync.Mutex) *Logger {
+	if w == nil {
+		return makeLogger(ErrorLevel + 1)
+	}
+
+	ch := make(chan interface{}, 1024)
+	go func() {
+		format := &TextFormatter{true}
+		for msg := range ch {
+			mu.Lock()
+			for _, line := range strings.SplitAfter(formatLog(msg, format), "\n") {
+				if line != "" {
+					io.WriteString(w, prefix+line)
+				}
+			}
+			mu.Unlock()
+		}
+	}()
+	return makeLogger(DebugLevel, ch)
+}
+
+// stop stops every replica and client of the cluster.
+func (lc *localCluster) stop() {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for _, hs := range lc.servers {
+		hs.Stop(ctx)
+	}
+	for _, c := range lc.clients {
+		c.Stop(ctx)
+	}
+}
+
+// divergence returns the index of the first node of seq that breaks from
+// ref, or -1 when seq is a prefix of ref. With gaps seq only has to appear
+// in ref in the same order.
+func divergence(seq, ref []string, gaps bool) int {
+	j := 0
+	for i, id := range seq {
+		if !gaps {
+			if i >= len(ref) || ref[i] != id {
+				return i
+			}
+			continue
+		}
+		for j < len(ref) && ref[j] != id {
+			j++
+		}
+		if j == len(ref) {
+			return i
+		}
+		j++
+	}
+	return -1
+}
+
+func (lc *localCluster) committed(id int) []*LogNode {
+	var nodes []*LogNode
+	hs := lc.servers[id]
+	hs.exec(func() {
+		nodes = append(nodes, hs.core.committed...)
+	})
+	return nodes
+}
+
+func (lc *localCluster) viewId(id int) int {
+	var viewId int
+	hs := lc.servers[id]
+	hs.exec(func() {
+		viewId = hs.core.viewId
+	})
+	return viewId
+}
+
+// RunScenario plays the timeline of s against a fresh in-process cluster
+// and checks safety and liveness. Debug output of every node is written to
+// logs with a replica prefix when logs is not nil.
+func RunScenario(s *Scenario, logs io.Writer) (*ScenarioReport, error) {
+	if err := s.validate(); err != nil {
+		return nil, err
+	}
+	protocol, _ := ParseProtocolMode(s.Protocol)
+	viewTimeout := time.Duration(s.ViewTimeout) * time.Millisecond
+	noopTimeout := time.Duration(s.NoopTimeout) * time.Millisecond
+	lc, err := makeLocalCluster(s.Replicas, s.Clients, protocol, viewTimeout, noopTimeout, logs)
+	if err != nil {
+		return nil, err
+	}
+	defer lc.stop()
+
+	events := make([]ScenarioEvent, len(s.Events))
+	copy(events, s.Events)
+	sort.SliceStable(events, func(i, j int) bool {
+		return events[i].At < events[j].At
+	})
+
+	faulty := make(map[int]bool)
+	crashed := make(map[int]bool)
+	// a replica that was crashed misses the nodes committed meanwhile
+	everCrashed := make(map[int]bool)
+	type scriptedRequest struct {
+		client int
+		op     string
+	}
+	requested := make(map[scriptedRequest]int)
+	partitioned := false
+	lastFault := 0
+	baseline := make(map[int]int)
+	start := time.Now()
+	for _, e := range events {
+		time.Sleep(time.Until(start.Add(time.Duration(e.At) * time.Millisecond)))
+		switch e.Action {
+		case "malicious":
+			lc.servers[e.Replica].setAdversary(e.Args)
+			faulty[e.Replica] = e.Args[0] != "honest" && e.Args[0] != "normal" && e.Args[0] != "0"
+		case "crash":
+			lc.net.setCrashed(e.Replica, true)
+			crashed[e.Replica] = true
+			everCrashed[e.Replica] = true
+		case "recover":
+			lc.net.setCrashed(e.Replica, false)
+			crashed[e.Replica] = false
+		case "partition":
+			lc.net.partition(e.Groups)
+			partitioned = true
+		case "heal":
+			lc.net.heal()
+			partitioned = false
+		case "request":
+			lc.clients[e.Client].newRequest(e.Op)
+			requested[scriptedRequest{e.Client, e.Op}]++
+		}
+		if e.Action != "request" {
+			lastFault = e.At
+			for id := range lc.servers {
+				baseline[id] = len(lc.committed(id))
+			}
+		}
+	}
+	time.Sleep(time.Until(start.Add(time.Duration(s.Duration) * time.Millisecond)))
+
+	report := &ScenarioReport{}
+	report.Name = s.Name
+	report.Safe = true
+	report.Live = true
+	report.Commits = make(map[int]int)
+	report.Views = make(map[int]int)
+
+	// safety: the sequences committed by honest replicas are prefixes of
+	// the longest one, and no request is committed twice
+	sequences := make(map[int][]string)
+	executed := make(map[int]map[scriptedRequest]int)
+	ref := -1
+	for id := range lc.servers {
+		nodes := lc.committed(id)
+		report.Commits[id] = len(nodes)
+		report.Views[id] = lc.viewId(id)
+		executed[id] = make(map[scriptedRequest]int)
+		for _, node := range nodes {
+			sequences[id] = append(sequences[id], node.Id)
+			if node.Request.Timestamp != 0 {
+				executed[id][scriptedRequest{node.Request.ClientId, fmt.Sprint(node.Request.Operation)}]++
+			}
+		}
+		if faulty[id] {
+			continue
+		}
+		// the reference is the longest sequence, of a replica that was
+		// never crashed if there is one
+		if ref < 0 || everCrashed[ref] && !everCrashed[id] {
+			ref = id
+		} else if everCrashed[ref] == everCrashed[id] && len(sequences[id]) > len(sequences[ref]) {
+			ref = id
+		}
+	}
+	for id := range lc.servers {
+		if faulty[id] || id == ref {
+			continue
+		}
+		if i := divergence(sequences[id], sequences[ref], everCrashed[id]); i >= 0 {
+			report.Safe = false
+			report.Violations = append(report.Violations, fmt.Sprintf("replica[%d] committed node[%s] as commit %d, not on the sequence of replica[%d]", id, sequences[id][i], i+1, ref))
+		}
+	}
+	for id := range lc.servers {
+		if faulty[id] {
+			continue
+		}
+		for r, n := range executed[id] {
+			if n > requested[r] {
+				report.Safe = false
+				report.Violations = append(report.Violations, fmt.Sprintf("replica[%d] committed request[%s] of client[%d] %d times, sent %d", id, r.op, r.client, n, requested[r]))
+			}
+		}
+	}
+
+	// liveness: honest, reachable replicas kept committing after the last fault
+	if !partitioned {
+		for id := range lc.servers {
+			if faulty[id] || crashed[id] {
+				continue
+			}
+			progress := report.Commits[id] - baseline[id]
+			if progress < s.Expect.MinCommits {
+				report.Live = false
+				report.Violations = append(report.Violations, fmt.Sprintf("replica[%d] committed %d nodes after %dms, expected %d", id, progress, lastFault, s.Expect.MinCommits))
+			}
+			if !s.Expect.ExactlyOnce {
+				continue
+			}
+			for r, n := range requested {
+				if executed[id][r] < n {
+					report.Live = false
+					report.Violations = append(report.Violations, fmt.Sprintf("replica[%d] committed request[%s] of client[%d] %d times, sent %d", id, r.op, r.client, executed[id][r], n))
+				}
+			}
+		}
+	} else if s.Expect.MinCommits > 0 || s.Expect.ExactlyOnce && len(requested) > 0 {
+		report.Live = false
+		report.Violations = append(report.Violations, "network still partitioned at the end of the run")
+	}
+
+	return report, nil
+}
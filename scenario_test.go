@@ -0,0 +1,38 @@
+package hotstuff
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+// The scenario files shipped with the command must load and pass. Each
+// runs for its full duration, so they are skipped with -short.
+func TestScenarioFiles(t *testing.T) {
+	if testing.Short() {
+		t.Skip("scenarios run in real time")
+	}
+	paths, err := filepath.Glob(filepath.Join("main", "scenarios", "*.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(paths) == 0 {
+		t.Fatal("no scenario files")
+	}
+	for _, path := range paths {
+		path := path
+		t.Run(filepath.Base(path), func(t *testing.T) {
+			t.Parallel()
+			s, err := LoadScenario(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			report, err := RunScenario(s, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !report.Passed() {
+				t.Error(report)
+			}
+		})
+	}
+}
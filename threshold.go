@@ -0,0 +1,168 @@
+package hotstuff
+
+import (
+	"crypto/elliptic"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"math/big"
+)
+
+// ThresholdKey is one replica's share of a group key on P-256. Any
+// Threshold shares determine the group secret; fewer reveal nothing about
+// it. Replica i holds the value of the sharing polynomial at i+1, and
+// ShareKeys lists the public share of every replica.
+//
+// This is scaffolding for threshold-signed QCs: a replica only gets a key
+// from a DKG run, keeps it in memory and reports it in its status, but
+// nothing signs or verifies votes or QCs with it yet.
+type ThresholdKey struct {
+	Threshold int
+	Index     int
+	Share     *big.Int
+	GroupKey  []byte
+	ShareKeys [][]byte
+}
+
+var thresholdCurve = elliptic.P256()
+
+func scalarBaseMult(k *big.Int) []byte {
+	x, y := thresholdCurve.ScalarBaseMult(k.Bytes())
+	return elliptic.Marshal(thresholdCurve, x, y)
+}
+
+// polynomial is a random polynomial of the given degree over the scalar
+// field, with secret as its constant term.
+type polynomial []*big.Int
+
+func randomPolynomial(secret *big.Int, degree int) (polynomial, error) {
+	order := thresholdCurve.Params().N
+	p := polynomial{secret}
+	for i := 0; i < degree; i++ {
+		c, err := rand.Int(rand.Reader, order)
+		if err != nil {
+			return nil, err
+		}
+		p = append(p, c)
+	}
+	return p, nil
+}
+
+func (p polynomial) eval(x int) *big.Int {
+	order := thresholdCurve.Params().N
+	bx := big.NewInt(int64(x))
+	y := new(big.Int)
+	for i := len(p) - 1; i >= 0; i-- {
+		y.Mul(y, bx)
+		y.Add(y, p[i])
+		y.Mod(y, order)
+	}
+	return y
+}
+
+// commitments are the public coefficients of p, so anyone can check a
+// share against them without learning the polynomial.
+func (p polynomial) commitments() [][]byte {
+	commits := make([][]byte, len(p))
+	for i, c := range p {
+		commits[i] = scalarBaseMult(c)
+	}
+	return commits
+}
+
+func addPoints(a, b []byte) ([]byte, error) {
+	ax, ay := elliptic.Unmarshal(thresholdCurve, a)
+	bx, by := elliptic.Unmarshal(thresholdCurve, b)
+	if ax == nil || bx == nil {
+		return nil, errors.New("threshold: invalid point")
+	}
+	x, y := thresholdCurve.Add(ax, ay, bx, by)
+	return elliptic.Marshal(thresholdCurve, x, y), nil
+}
+
+// evalCommitments computes p(x)*G from the commitments of p.
+func evalCommitments(commits [][]byte, x int) ([]byte, error) {
+	if len(commits) == 0 {
+		return nil, errors.New("threshold: no commitments")
+	}
+
+	order := thresholdCurve.Params().N
+	var result []byte
+	power := big.NewInt(1)
+	bx := big.NewInt(int64(x))
+	for _, commit := range commits {
+		cx, cy := elliptic.Unmarshal(thresholdCurve, commit)
+		if cx == nil {
+			return nil, errors.New("threshold: invalid commitment")
+		}
+		tx, ty := thresholdCurve.ScalarMult(cx, cy, power.Bytes())
+		term := elliptic.Marshal(thresholdCurve, tx, ty)
+		if result != nil {
+			var err error
+			if term, err = addPoints(result, term); err != nil {
+				return nil, err
+			}
+		}
+		result = term
+		power.Mul(power, bx)
+		power.Mod(power, order)
+	}
+	return result, nil
+}
+
+// interpolate recovers the group key from the public shares of the first
+// Threshold replicas by Lagrange interpolation at zero.
+func (k *ThresholdKey) interpolate() ([]byte, error) {
+	order := thresholdCurve.Params().N
+	var sx, sy *big.Int
+	for i := 0; i < k.Threshold; i++ {
+		num := big.NewInt(1)
+		den := big.NewInt(1)
+		for j := 0; j < k.Threshold; j++ {
+			if j == i {
+				continue
+			}
+			num.Mul(num, big.NewInt(int64(j+1)))
+			num.Mod(num, order)
+			den.Mul(den, big.NewInt(int64(j-i)))
+			den.Mod(den, order)
+		}
+		lambda := num.Mul(num, den.ModInverse(den, order))
+		lambda.Mod(lambda, order)
+
+		px, py := elliptic.Unmarshal(thresholdCurve, k.ShareKeys[i])
+		if px == nil {
+			return nil, fmt.Errorf("threshold: invalid share key of replica[%d]", i)
+		}
+		tx, ty := thresholdCurve.ScalarMult(px, py, lambda.Bytes())
+		if sx == nil {
+			sx, sy = tx, ty
+		} else {
+			sx, sy = thresholdCurve.Add(sx, sy, tx, ty)
+		}
+	}
+	return elliptic.Marshal(thresholdCurve, sx, sy), nil
+}
+
+// check makes sure the share belongs to the public share key of the
+// replica and that the public shares agree with the group key.
+func (k *ThresholdKey) check() error {
+	n := len(k.ShareKeys)
+	if k.Threshold < 1 || k.Threshold > n {
+		return fmt.Errorf("threshold: invalid threshold %d of %d", k.Threshold, n)
+	}
+	if k.Index < 0 || k.Index >= n {
+		return fmt.Errorf("threshold: no share key for replica[%d]", k.Index)
+	}
+	if k.Share == nil || string(scalarBaseMult(k.Share)) != string(k.ShareKeys[k.Index]) {
+		return fmt.Errorf("threshold: share of replica[%d] does not match its share key", k.Index)
+	}
+	groupKey, err := k.interpolate()
+	if err != nil {
+		return err
+	}
+	if string(groupKey) != string(k.GroupKey) {
+		return errors.New("threshold: share keys do not match the group key")
+	}
+	return nil
+}
@@ -0,0 +1,231 @@
+package hotstuff
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/rpc"
+	"strconv"
+	"strings"
+)
+
+// TLSFiles names the PEM files a node needs for mutual TLS: the cluster CA
+// and the node's own certificate and key. A node certificate must carry
+// its identity, "replica-<id>" or "client-<id>", as a DNS name.
+type TLSFiles struct {
+	CA   string
+	Cert string
+	Key  string
+}
+
+func loadTLSConfig(files *TLSFiles) (*tls.Config, error) {
+	if files == nil {
+		return nil, nil
+	}
+
+	caPEM, err := ioutil.ReadFile(files.CA)
+	if err != nil {
+		return nil, fmt.Errorf("tls: read ca: %s", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caPEM) {
+		return nil, fmt.Errorf("tls: no certificate found in %s", files.CA)
+	}
+
+	cert, err := tls.LoadX509KeyPair(files.Cert, files.Key)
+	if err != nil {
+		return nil, fmt.Errorf("tls: load key pair: %s", err)
+	}
+
+	config := &tls.Config{}
+	config.Certificates = []tls.Certificate{cert}
+	config.RootCAs = pool
+	config.ClientCAs = pool
+	config.ClientAuth = tls.RequireAndVerifyClientCert
+	config.MinVersion = tls.VersionTLS12
+	return config, nil
+}
+
+type peerIdentity struct {
+	client bool
+	id     int
+}
+
+func identityName(client bool, id int) string {
+	if client {
+		return "client-" + strconv.Itoa(id)
+	}
+	return "replica-" + strconv.Itoa(id)
+}
+
+func parseIdentity(cert *x509.Certificate) (peerIdentity, error) {
+	names := append([]string{}, cert.DNSNames...)
+	names = append(names, cert.Subject.CommonName)
+	for _, name := range names {
+		var prefix string
+		var client bool
+		if strings.HasPrefix(name, "replica-") {
+			prefix = "replica-"
+		} else if strings.HasPrefix(name, "client-") {
+			prefix = "client-"
+			client = true
+		} else {
+			continue
+		}
+
+		id, err := strconv.Atoi(name[len(prefix):])
+		if err == nil && id >= 0 {
+			return peerIdentity{client, id}, nil
+		}
+	}
+	return peerIdentity{}, errors.New("tls: certificate carries no replica or client identity")
+}
+
+// checkSender rejects a message whose claimed sender is not the peer that
+// authenticated the connection.
+func checkSender(identity peerIdentity, body interface{}) error {
+	claimed := peerIdentity{}
+	switch args := body.(type) {
+	case *ProposalArgs:
+		claimed.id = args.RepId
+	case *VoteArgs:
+		claimed.id = args.RepId
+	case *NewViewArgs:
+		claimed.id = args.RepId
+	case *ReplyArgs:
+		claimed.id = args.ReplicaId
+	case *DKGArgs:
+		claimed.id = args.RepId
+	case *EpochChangeArgs:
+		claimed.id = args.RepId
+	case *RequestArgs:
+		claimed = peerIdentity{true, args.ClientId}
+	case *Evidence:
+		// evidence is gossiped by any replica, not only by the accused
+		if identity.client {
+			return errors.New("tls: evidence from a client connection")
+		}
+		return nil
+	default:
+		return nil
+	}
+
+	if claimed != identity {
+		return fmt.Errorf("tls: %s may not send as %s", identityName(identity.client, identity.id), identityName(claimed.client, claimed.id))
+	}
+	return nil
+}
+
+// identityCodec is the gob codec of net/rpc with every request body checked
+// against the identity of the TLS peer.
+type identityCodec struct {
+	rwc      io.ReadWriteCloser
+	dec      *gob.Decoder
+	enc      *gob.Encoder
+	encBuf   *bufio.Writer
+	identity peerIdentity
+	closed   bool
+}
+
+func (c *identityCodec) ReadRequestHeader(r *rpc.Request) error {
+	return c.dec.Decode(r)
+}
+
+func (c *identityCodec) ReadRequestBody(body interface{}) error {
+	if err := c.dec.Decode(body); err != nil {
+		return err
+	}
+	return checkSender(c.identity, body)
+}
+
+func (c *identityCodec) WriteResponse(r *rpc.Response, body interface{}) error {
+	if err := c.enc.Encode(r); err != nil {
+		if c.encBuf.Flush() == nil {
+			c.Close()
+		}
+		return err
+	}
+	if err := c.enc.Encode(body); err != nil {
+		if c.encBuf.Flush() == nil {
+			c.Close()
+		}
+		return err
+	}
+	return c.encBuf.Flush()
+}
+
+func (c *identityCodec) Close() error {
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+	return c.rwc.Close()
+}
+
+// tlsRPCHandler serves net/rpc over HTTP CONNECT like rpc.Server does,
+// binding the connection to the identity in the client certificate.
+type tlsRPCHandler struct {
+	server *rpc.Server
+}
+
+func (h *tlsRPCHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "CONNECT" {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		io.WriteString(w, "405 must CONNECT\n")
+		return
+	}
+	if req.TLS == nil || len(req.TLS.PeerCertificates) == 0 {
+		http.Error(w, "client certificate required", http.StatusForbidden)
+		return
+	}
+	identity, err := parseIdentity(req.TLS.PeerCertificates[0])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	conn, _, err := w.(http.Hijacker).Hijack()
+	if err != nil {
+		return
+	}
+	io.WriteString(conn, "HTTP/1.0 200 Connected to Go RPC\n\n")
+
+	buf := bufio.NewWriter(conn)
+	codec := &identityCodec{}
+	codec.rwc = conn
+	codec.dec = gob.NewDecoder(conn)
+	codec.enc = gob.NewEncoder(buf)
+	codec.encBuf = buf
+	codec.identity = identity
+	h.server.ServeCodec(codec)
+}
+
+// dialHTTPTLS is rpc.DialHTTP over TLS, expecting the server to present
+// the certificate of the named node.
+func dialHTTPTLS(address, name string, config *tls.Config) (*rpc.Client, error) {
+	peerConfig := config.Clone()
+	peerConfig.ServerName = name
+	conn, err := tls.Dial("tcp", address, peerConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	io.WriteString(conn, "CONNECT "+rpc.DefaultRPCPath+" HTTP/1.0\n\n")
+	resp, err := http.ReadResponse(bufio.NewReader(conn), &http.Request{Method: "CONNECT"})
+	if err == nil && resp.Status == "200 Connected to Go RPC" {
+		return rpc.NewClient(conn), nil
+	}
+	if err == nil {
+		err = errors.New("unexpected HTTP response: " + resp.Status)
+	}
+	conn.Close()
+	return nil, &net.OpError{Op: "dial-http", Net: "tcp " + address, Addr: nil, Err: err}
+}
@@ -0,0 +1,69 @@
+package hotstuff
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"testing"
+)
+
+func TestParseIdentity(t *testing.T) {
+	tests := []struct {
+		name     string
+		dnsNames []string
+		cn       string
+		identity peerIdentity
+		ok       bool
+	}{
+		{"replica", []string{"replica-2"}, "", peerIdentity{false, 2}, true},
+		{"client in the common name", nil, "client-1", peerIdentity{true, 1}, true},
+		{"first valid name", []string{"replica-x", "client-3"}, "replica-0", peerIdentity{true, 3}, true},
+		{"other name", []string{"node-1"}, "localhost", peerIdentity{}, false},
+		{"negative id", []string{"replica--1"}, "", peerIdentity{}, false},
+		{"no name", nil, "", peerIdentity{}, false},
+	}
+	for _, test := range tests {
+		cert := &x509.Certificate{DNSNames: test.dnsNames, Subject: pkix.Name{CommonName: test.cn}}
+		identity, err := parseIdentity(cert)
+		if (err == nil) != test.ok {
+			t.Errorf("%s: error %v, want ok %v", test.name, err, test.ok)
+			continue
+		}
+		if identity != test.identity {
+			t.Errorf("%s: identity %v, want %v", test.name, identity, test.identity)
+		}
+	}
+}
+
+// A connection authenticated as one node may only carry messages that
+// node signs.
+func TestCheckSender(t *testing.T) {
+	replica1 := peerIdentity{false, 1}
+	client1 := peerIdentity{true, 1}
+
+	tests := []struct {
+		name     string
+		identity peerIdentity
+		body     interface{}
+		ok       bool
+	}{
+		{"own vote", replica1, &VoteArgs{RepId: 1}, true},
+		{"vote of another replica", replica1, &VoteArgs{RepId: 2}, false},
+		{"proposal of another replica", replica1, &ProposalArgs{RepId: 0}, false},
+		{"new view of another replica", replica1, &NewViewArgs{RepId: 3}, false},
+		{"reply of another replica", replica1, &ReplyArgs{ReplicaId: 2}, false},
+		{"epoch change of another replica", replica1, &EpochChangeArgs{RepId: 2}, false},
+		{"dkg message of another replica", replica1, &DKGArgs{RepId: 2}, false},
+		{"own request", client1, &RequestArgs{ClientId: 1}, true},
+		{"request of another client", client1, &RequestArgs{ClientId: 0}, false},
+		{"replica sending as the client of its id", replica1, &RequestArgs{ClientId: 1}, false},
+		{"client sending as the replica of its id", client1, &VoteArgs{RepId: 1}, false},
+		{"evidence from a replica", replica1, &Evidence{RepId: 2}, true},
+		{"evidence from a client", client1, &Evidence{RepId: 2}, false},
+		{"message without a sender", client1, &DefaultReply{}, true},
+	}
+	for _, test := range tests {
+		if err := checkSender(test.identity, test.body); (err == nil) != test.ok {
+			t.Errorf("%s: error %v, want ok %v", test.name, err, test.ok)
+		}
+	}
+}
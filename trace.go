@@ -0,0 +1,339 @@
+package hotstuff
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// SpanContext identifies a span of a trace, as in W3C trace context. It
+// travels unsigned in the messages of a request: it only links spans and
+// never decides anything.
+type SpanContext struct {
+	TraceId [16]byte
+	SpanId  [8]byte
+}
+
+func (sc SpanContext) valid() bool {
+	return sc.TraceId != [16]byte{}
+}
+
+// String is the traceparent header of sc.
+func (sc SpanContext) String() string {
+	return fmt.Sprintf("00-%x-%x-01", sc.TraceId, sc.SpanId)
+}
+
+// child derives the context of a span below sc from what names it. Every
+// replica derives the same context, so the core can put the context of a
+// span in a message before the driver opens the span.
+func (sc SpanContext) child(key ...interface{}) SpanContext {
+	if !sc.valid() {
+		return SpanContext{}
+	}
+	h := sha256.New()
+	h.Write(sc.TraceId[:])
+	h.Write(sc.SpanId[:])
+	fmt.Fprintf(h, "%#v", key)
+	child := SpanContext{}
+	child.TraceId = sc.TraceId
+	copy(child.SpanId[:], h.Sum(nil))
+	return child
+}
+
+func newTraceContext() SpanContext {
+	sc := SpanContext{}
+	rand.Read(sc.TraceId[:])
+	rand.Read(sc.SpanId[:])
+	return sc
+}
+
+// phaseContext is the context of the span of node in phase at replica
+// repId, a child of the span of the client request.
+func phaseContext(node *LogNode, phase string, repId int) SpanContext {
+	return node.Request.Trace.child(phase, repId, node.Id)
+}
+
+// SpanKind numbers the kinds as OTLP does.
+type SpanKind int
+
+const (
+	SpanKindInternal SpanKind = 1
+	SpanKindServer   SpanKind = 2
+	SpanKindClient   SpanKind = 3
+)
+
+// Span is one timed step of a traced request on one replica or client.
+type Span struct {
+	Context SpanContext
+	Parent  SpanContext
+	Name    string
+	Kind    SpanKind
+	Start   time.Time
+	End     time.Time
+	Fields  []LogField
+
+	tracer *Tracer
+}
+
+func (s *Span) set(key string, value interface{}) {
+	if s != nil {
+		s.Fields = append(s.Fields, LogField{key, value})
+	}
+}
+
+func (s *Span) end() {
+	if s == nil {
+		return
+	}
+	s.End = time.Now()
+	s.tracer.exporter.ExportSpan(s)
+}
+
+type SpanExporter interface {
+	ExportSpan(s *Span)
+}
+
+// Tracer opens the spans of one replica or client. A nil Tracer opens
+// none, and so does any tracer for a request that is not traced.
+type Tracer struct {
+	resource []LogField
+	exporter SpanExporter
+	// closer is the exporter when the tracer opened it itself
+	closer io.Closer
+}
+
+func (t *Tracer) start(name string, kind SpanKind, sc, parent SpanContext, kv ...interface{}) *Span {
+	if t == nil || !sc.valid() {
+		return nil
+	}
+	s := &Span{}
+	s.Context = sc
+	s.Parent = parent
+	s.Name = name
+	s.Kind = kind
+	s.Start = time.Now()
+	s.Fields = makeLogEntry(DebugLevel, "", "", kv).Fields
+	s.tracer = t
+	return s
+}
+
+func (t *Tracer) close() error {
+	if t == nil || t.closer == nil {
+		return nil
+	}
+	return t.closer.Close()
+}
+
+// makeTracer returns a tracer whose spans carry kv as the attributes of
+// their resource.
+func makeTracer(exporter SpanExporter, kv ...interface{}) *Tracer {
+	t := &Tracer{}
+	t.resource = makeLogEntry(DebugLevel, "", "", kv).Fields
+	t.exporter = exporter
+	return t
+}
+
+// FileExporter writes spans to a file in the OTLP JSON encoding, one
+// export request per line, as the OpenTelemetry collector's file exporter
+// does: its otlpjsonfile receiver, or any tool reading that format, can
+// pick them up. Spans are batched and written at least once a second.
+type FileExporter struct {
+	w       io.Writer
+	spans   chan *Span
+	done    chan bool
+	dropped int64
+	once    *sync.Once
+	// spans ended after Close are dropped
+	mu     *sync.RWMutex
+	closed bool
+}
+
+func (e *FileExporter) ExportSpan(s *Span) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	if e.closed {
+		atomic.AddInt64(&e.dropped, 1)
+		return
+	}
+	select {
+	case e.spans <- s:
+	default:
+		atomic.AddInt64(&e.dropped, 1)
+	}
+}
+
+func (e *FileExporter) Dropped() int64 {
+	return atomic.LoadInt64(&e.dropped)
+}
+
+func (e *FileExporter) run() {
+	var batch []*Span
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	defer close(e.done)
+	for {
+		select {
+		case s, ok := <-e.spans:
+			if !ok {
+				e.write(batch)
+				return
+			}
+			batch = append(batch, s)
+			if len(batch) < 512 {
+				continue
+			}
+		case <-ticker.C:
+		}
+		e.write(batch)
+		batch = nil
+	}
+}
+
+// write encodes batch as one line, so writers sharing a file opened for
+// appending do not interleave.
+func (e *FileExporter) write(batch []*Span) {
+	if len(batch) == 0 {
+		return
+	}
+	data, err := json.Marshal(otlpRequest(batch))
+	if err != nil {
+		return
+	}
+	e.w.Write(append(data, '\n'))
+}
+
+// Close writes the spans still queued and closes the file.
+func (e *FileExporter) Close() error {
+	var err error
+	e.once.Do(func() {
+		e.mu.Lock()
+		e.closed = true
+		close(e.spans)
+		e.mu.Unlock()
+		<-e.done
+		if c, ok := e.w.(io.Closer); ok {
+			err = c.Close()
+		}
+	})
+	return err
+}
+
+func NewFileExporter(w io.Writer) *FileExporter {
+	e := &FileExporter{}
+	e.w = w
+	e.spans = make(chan *Span, 4096)
+	e.done = make(chan bool)
+	e.once = &sync.Once{}
+	e.mu = &sync.RWMutex{}
+	go e.run()
+	return e
+}
+
+// OpenTraceFile appends spans to the file at path.
+func OpenTraceFile(path string) (*FileExporter, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return NewFileExporter(f), nil
+}
+
+// The OTLP JSON encoding of spans, grouped by the tracer (resource) that
+// opened them.
+type otlpExport struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpAttribute `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpSpan struct {
+	TraceId           string          `json:"traceId"`
+	SpanId            string          `json:"spanId"`
+	ParentSpanId      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              SpanKind        `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+}
+
+type otlpAttribute struct {
+	Key   string                 `json:"key"`
+	Value map[string]interface{} `json:"value"`
+}
+
+func otlpAttributes(fields []LogField) []otlpAttribute {
+	var attrs []otlpAttribute
+	for _, field := range fields {
+		value := make(map[string]interface{})
+		switch v := field.Value.(type) {
+		case int:
+			value["intValue"] = strconv.Itoa(v)
+		case int64:
+			value["intValue"] = strconv.FormatInt(v, 10)
+		case bool:
+			value["boolValue"] = v
+		case float64:
+			value["doubleValue"] = v
+		default:
+			value["stringValue"] = fmt.Sprint(v)
+		}
+		attrs = append(attrs, otlpAttribute{field.Key, value})
+	}
+	return attrs
+}
+
+func otlpRequest(batch []*Span) *otlpExport {
+	export := &otlpExport{}
+	byTracer := make(map[*Tracer]int)
+	for _, s := range batch {
+		i, ok := byTracer[s.tracer]
+		if !ok {
+			i = len(export.ResourceSpans)
+			byTracer[s.tracer] = i
+			rs := otlpResourceSpans{}
+			rs.Resource.Attributes = otlpAttributes(s.tracer.resource)
+			rs.ScopeSpans = []otlpScopeSpans{{Scope: otlpScope{"hotstuff-go"}}}
+			export.ResourceSpans = append(export.ResourceSpans, rs)
+		}
+
+		span := otlpSpan{}
+		span.TraceId = hex.EncodeToString(s.Context.TraceId[:])
+		span.SpanId = hex.EncodeToString(s.Context.SpanId[:])
+		if s.Parent.valid() {
+			span.ParentSpanId = hex.EncodeToString(s.Parent.SpanId[:])
+		}
+		span.Name = s.Name
+		span.Kind = s.Kind
+		span.StartTimeUnixNano = strconv.FormatInt(s.Start.UnixNano(), 10)
+		span.EndTimeUnixNano = strconv.FormatInt(s.End.UnixNano(), 10)
+		span.Attributes = otlpAttributes(s.Fields)
+		scope := &export.ResourceSpans[i].ScopeSpans[0]
+		scope.Spans = append(scope.Spans, span)
+	}
+	return export
+}
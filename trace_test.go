@@ -0,0 +1,74 @@
+package hotstuff
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"testing"
+)
+
+// Every replica derives the same child context from the same names, so
+// spans of one request link up across replicas.
+func TestSpanContextChild(t *testing.T) {
+	sc := newTraceContext()
+	a := sc.child("vote", 1, "n")
+	if a != sc.child("vote", 1, "n") {
+		t.Errorf("child context differs between derivations")
+	}
+	if a.TraceId != sc.TraceId || a.SpanId == sc.SpanId {
+		t.Errorf("child %s of %s", a, sc)
+	}
+	if a == sc.child("vote", 2, "n") {
+		t.Errorf("children of different replicas share a context")
+	}
+	if (SpanContext{}).child("vote").valid() {
+		t.Errorf("untraced request got a child context")
+	}
+}
+
+// Spans end up in the file as OTLP JSON, linked to their parent and
+// grouped by the tracer that opened them; untraced requests open none.
+func TestFileExporter(t *testing.T) {
+	buf := &bytes.Buffer{}
+	exporter := NewFileExporter(buf)
+	tracer := makeTracer(exporter, "service.name", "replica-1")
+
+	request := newTraceContext()
+	if s := tracer.start("request", SpanKindServer, SpanContext{}, SpanContext{}); s != nil {
+		t.Errorf("span opened for an untraced request")
+	}
+	var nilTracer *Tracer
+	if s := nilTracer.start("request", SpanKindServer, request, SpanContext{}); s != nil {
+		t.Errorf("span opened without a tracer")
+	}
+	s := tracer.start("vote", SpanKindInternal, request.child("vote"), request, "view", 3)
+	s.set("node", "n")
+	s.end()
+	if err := exporter.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	export := &otlpExport{}
+	if err := json.Unmarshal(buf.Bytes(), export); err != nil {
+		t.Fatalf("%s: %v", buf.String(), err)
+	}
+	if len(export.ResourceSpans) != 1 || len(export.ResourceSpans[0].ScopeSpans[0].Spans) != 1 {
+		t.Fatalf("exported %s", buf.String())
+	}
+	if attrs := export.ResourceSpans[0].Resource.Attributes; len(attrs) != 1 || attrs[0].Value["stringValue"] != "replica-1" {
+		t.Errorf("resource attributes %v", attrs)
+	}
+	span := export.ResourceSpans[0].ScopeSpans[0].Spans[0]
+	if span.Name != "vote" || span.TraceId != hex.EncodeToString(request.TraceId[:]) || span.ParentSpanId != hex.EncodeToString(request.SpanId[:]) {
+		t.Errorf("span %+v", span)
+	}
+	if len(span.Attributes) != 2 || span.Attributes[0].Value["intValue"] != "3" || span.Attributes[1].Value["stringValue"] != "n" {
+		t.Errorf("span attributes %v", span.Attributes)
+	}
+
+	// spans ending after the exporter closed are dropped
+	tracer.start("vote", SpanKindInternal, request.child("late"), request).end()
+	if exporter.Dropped() != 1 {
+		t.Errorf("%d spans dropped, want 1", exporter.Dropped())
+	}
+}
@@ -0,0 +1,159 @@
+package hotstuff
+
+import (
+	"fmt"
+	"sort"
+)
+
+// MaxWeight bounds the voting weight of a replica, and with it the length
+// of the weighted leader schedule: at most MaxWeight turns per member.
+const MaxWeight = 1000
+
+// validatorSet is the membership of one epoch: the replicas that vote and
+// take turns leading from view startView on. Every replica carries a
+// voting weight; a quorum holds more than two thirds of the total weight
+// of the members, so the faulty replicas together must hold less than a
+// third of it.
+type validatorSet struct {
+	epoch     int
+	startView int
+	members   []int
+	// weights by replica id, replicas without a positive weight count 1
+	// and none counts more than MaxWeight
+	weights []int
+	// weighted leaders lead in proportion to their weight
+	weighted bool
+	schedule []int
+}
+
+func (vs *validatorSet) n() int {
+	return len(vs.members)
+}
+
+// f is the largest faulty weight the set tolerates.
+func (vs *validatorSet) f() int {
+	return (vs.totalWeight() - 1) / 3
+}
+
+func (vs *validatorSet) weight(id int) int {
+	if id < 0 || id >= len(vs.weights) || vs.weights[id] <= 0 {
+		return 1
+	}
+	if vs.weights[id] > MaxWeight {
+		return MaxWeight
+	}
+	return vs.weights[id]
+}
+
+func (vs *validatorSet) totalWeight() int {
+	total := 0
+	for _, member := range vs.members {
+		total += vs.weight(member)
+	}
+	return total
+}
+
+// weightOf sums the weight of the distinct members among ids.
+func (vs *validatorSet) weightOf(ids []int) int {
+	seen := make(map[int]bool)
+	total := 0
+	for _, id := range ids {
+		if seen[id] || !vs.contains(id) {
+			continue
+		}
+		seen[id] = true
+		total += vs.weight(id)
+	}
+	return total
+}
+
+// hasQuorum reports whether ids hold more than two thirds of the weight.
+func (vs *validatorSet) hasQuorum(ids []int) bool {
+	return 3*vs.weightOf(ids) > 2*vs.totalWeight()
+}
+
+// hasSupport reports whether ids hold more than a third of the weight, so
+// at least one of them is honest.
+func (vs *validatorSet) hasSupport(ids []int) bool {
+	return 3*vs.weightOf(ids) > vs.totalWeight()
+}
+
+func (vs *validatorSet) leader(viewId int) int {
+	if vs.weighted {
+		return vs.schedule[viewId%len(vs.schedule)]
+	}
+	return vs.members[viewId%vs.n()]
+}
+
+func (vs *validatorSet) contains(id int) bool {
+	for _, member := range vs.members {
+		if member == id {
+			return true
+		}
+	}
+	return false
+}
+
+// memberWeights lists the weights of the members, in their order.
+func (vs *validatorSet) memberWeights() []int {
+	weights := make([]int, vs.n())
+	for i, member := range vs.members {
+		weights[i] = vs.weight(member)
+	}
+	return weights
+}
+
+func (vs *validatorSet) String() string {
+	msg := fmt.Sprintf("epoch[%d] start[%d] members%v", vs.epoch, vs.startView, vs.members)
+	if len(vs.weights) > 0 {
+		msg += fmt.Sprintf(" weights%v", vs.memberWeights())
+	}
+	return msg
+}
+
+func gcd(a, b int) int {
+	for b != 0 {
+		a, b = b, a%b
+	}
+	return a
+}
+
+// makeSchedule spreads the turns of the members over one round of the
+// weighted leader rotation, each member leading in proportion to its
+// weight (smooth weighted round robin).
+func (vs *validatorSet) makeSchedule() []int {
+	unit := 0
+	for _, member := range vs.members {
+		unit = gcd(unit, vs.weight(member))
+	}
+	total := vs.totalWeight() / unit
+
+	var schedule []int
+	current := make([]int, vs.n())
+	for len(schedule) < total {
+		best := 0
+		for i, member := range vs.members {
+			current[i] += vs.weight(member) / unit
+			if current[i] > current[best] {
+				best = i
+			}
+		}
+		current[best] -= total
+		schedule = append(schedule, vs.members[best])
+	}
+	return schedule
+}
+
+func makeValidatorSet(epoch, startView int, members, weights []int, weighted bool) *validatorSet {
+	vs := &validatorSet{}
+	vs.epoch = epoch
+	vs.startView = startView
+	vs.members = append([]int{}, members...)
+	sort.Ints(vs.members)
+	vs.weights = append([]int{}, weights...)
+	vs.weighted = weighted
+	if weighted {
+		vs.schedule = vs.makeSchedule()
+	}
+	return vs
+}
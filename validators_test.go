@@ -0,0 +1,72 @@
+package hotstuff
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestValidatorQuorum(t *testing.T) {
+	tests := []struct {
+		name    string
+		members []int
+		weights []int
+		ids     []int
+		quorum  bool
+		support bool
+	}{
+		{"three of four", []int{0, 1, 2, 3}, nil, []int{0, 1, 2}, true, true},
+		{"two of four", []int{0, 1, 2, 3}, nil, []int{0, 1}, false, true},
+		{"one of four", []int{0, 1, 2, 3}, nil, []int{0}, false, false},
+		{"heavy replica and one other", []int{0, 1, 2, 3}, []int{5, 1, 1, 1}, []int{0, 1}, true, true},
+		{"heavy replica alone", []int{0, 1, 2, 3}, []int{5, 1, 1, 1}, []int{0}, false, true},
+		{"all light replicas", []int{0, 1, 2, 3}, []int{5, 1, 1, 1}, []int{1, 2, 3}, false, true},
+		{"repeated id", []int{0, 1, 2, 3}, nil, []int{1, 1, 1}, false, false},
+		{"id outside the set", []int{0, 1, 2}, nil, []int{0, 1, 5}, false, true},
+		{"weight above the cap", []int{0, 1}, []int{3 * MaxWeight, MaxWeight}, []int{0}, false, true},
+	}
+	for _, test := range tests {
+		vs := makeValidatorSet(0, 0, test.members, test.weights, false)
+		if got := vs.hasQuorum(test.ids); got != test.quorum {
+			t.Errorf("%s: quorum %v, want %v", test.name, got, test.quorum)
+		}
+		if got := vs.hasSupport(test.ids); got != test.support {
+			t.Errorf("%s: support %v, want %v", test.name, got, test.support)
+		}
+	}
+}
+
+func TestValidatorLeaders(t *testing.T) {
+	tests := []struct {
+		name     string
+		members  []int
+		weights  []int
+		weighted bool
+		leaders  []int
+	}{
+		{"round robin", []int{1, 3, 5}, nil, false, []int{1, 3, 5, 1, 3, 5}},
+		{"round robin ignores weights", []int{0, 1, 2}, []int{3, 1, 1}, false, []int{0, 1, 2, 0}},
+		{"weighted", []int{0, 1, 2}, []int{3, 1, 1}, true, []int{0, 1, 0, 2, 0, 0, 1}},
+		{"weighted by common factor", []int{0, 1, 2}, []int{2, 2, 4}, true, []int{2, 0, 1, 2, 2}},
+	}
+	for _, test := range tests {
+		vs := makeValidatorSet(0, 0, test.members, test.weights, test.weighted)
+		var leaders []int
+		for v := range test.leaders {
+			leaders = append(leaders, vs.leader(v))
+		}
+		if !reflect.DeepEqual(leaders, test.leaders) {
+			t.Errorf("%s: leaders %v, want %v", test.name, leaders, test.leaders)
+		}
+	}
+}
+
+// Coprime weights, however large, give a schedule of at most MaxWeight
+// turns per member.
+func TestValidatorScheduleBound(t *testing.T) {
+	members := []int{0, 1, 2}
+	weights := []int{1000003, 999983, 7}
+	vs := makeValidatorSet(0, 0, members, weights, true)
+	if len(vs.schedule) > len(members)*MaxWeight {
+		t.Errorf("schedule of %d turns", len(vs.schedule))
+	}
+}
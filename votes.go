@@ -0,0 +1,117 @@
+package hotstuff
+
+import (
+	"fmt"
+	"sort"
+)
+
+// voteKey is what a vote certifies. Votes only add up when they agree on
+// all of it, so no single voter picks the view or epoch of the QC.
+type voteKey struct {
+	viewId   int
+	epoch    int
+	nodeView int
+	nodeId   string
+	nodeHash string
+}
+
+func keyOf(vote *VoteArgs) voteKey {
+	return voteKey{vote.ViewId, vote.Epoch, vote.NodeView, vote.NodeId, string(vote.NodeHash)}
+}
+
+// voteCollector gathers the votes sent to the next leader and forms a QC
+// once replicas holding a quorum of the weight voted for the same node in
+// the same view.
+// Votes are kept for the current view and the one after it, since a vote
+// can overtake the proposal that moves the leader into its view.
+type voteCollector struct {
+	validators *validatorSet
+	viewId     int
+	votes      map[voteKey]map[int]*VoteArgs
+	voted      map[int]map[int]*VoteArgs
+	qcs        map[int]QC
+}
+
+func (vc *voteCollector) add(vote *VoteArgs) (QC, bool, error) {
+	if vote.ViewId < vc.viewId || vote.ViewId > vc.viewId+1 {
+		return QC{}, false, fmt.Errorf("Vote from rep[%d] for stale view[%d]", vote.RepId, vote.ViewId)
+	}
+
+	voted := vc.voted[vote.ViewId]
+	if voted == nil {
+		voted = make(map[int]*VoteArgs)
+		vc.voted[vote.ViewId] = voted
+	}
+	key := keyOf(vote)
+	if prev, ok := voted[vote.RepId]; ok {
+		if keyOf(prev) == key {
+			return QC{}, false, fmt.Errorf("Duplicate vote from rep[%d] view[%d]", vote.RepId, vote.ViewId)
+		}
+		return QC{}, false, &equivocationError{prev, vote}
+	}
+	voted[vote.RepId] = vote
+
+	votes := vc.votes[key]
+	if votes == nil {
+		votes = make(map[int]*VoteArgs)
+		vc.votes[key] = votes
+	}
+	votes[vote.RepId] = vote
+
+	voters := make([]int, 0, len(votes))
+	for repId := range votes {
+		voters = append(voters, repId)
+	}
+	if _, ok := vc.qcs[vote.ViewId]; ok || !vc.validators.hasQuorum(voters) {
+		return QC{}, false, nil
+	}
+
+	qc := QC{}
+	qc.Epoch = key.epoch
+	qc.ViewId = key.nodeView
+	qc.NodeId = key.nodeId
+	qc.NodeHash = vote.NodeHash
+	sort.Ints(voters)
+	for _, repId := range voters {
+		v := *votes[repId]
+		v.Trace = SpanContext{}
+		qc.Votes = append(qc.Votes, v)
+	}
+	vc.qcs[vote.ViewId] = qc
+	return qc, true, nil
+}
+
+// certified returns the QC already formed from the votes of viewId.
+func (vc *voteCollector) certified(viewId int) (QC, bool) {
+	qc, ok := vc.qcs[viewId]
+	return qc, ok
+}
+
+// reset drops every vote cast before viewId.
+func (vc *voteCollector) reset(viewId int) {
+	vc.viewId = viewId
+	for key := range vc.votes {
+		if key.viewId < viewId {
+			delete(vc.votes, key)
+		}
+	}
+	for v := range vc.voted {
+		if v < viewId {
+			delete(vc.voted, v)
+		}
+	}
+	for v := range vc.qcs {
+		if v < viewId {
+			delete(vc.qcs, v)
+		}
+	}
+}
+
+func makeVoteCollector(validators *validatorSet) *voteCollector {
+	vc := &voteCollector{}
+	vc.validators = validators
+	vc.votes = make(map[voteKey]map[int]*VoteArgs)
+	vc.voted = make(map[int]map[int]*VoteArgs)
+	vc.qcs = make(map[int]QC)
+	return vc
+}
@@ -0,0 +1,90 @@
+package hotstuff
+
+import (
+	"testing"
+)
+
+func TestVoteCollector(t *testing.T) {
+	hashA, hashB := []byte("a"), []byte("b")
+	ballot := func(repId, nodeView int, hash []byte) *VoteArgs {
+		args := vote(repId, 5, "5_x").msg
+		args.NodeView = nodeView
+		args.NodeHash = hash
+		return args
+	}
+
+	tests := []struct {
+		name    string
+		weights []int
+		votes   []*VoteArgs
+		// index of the vote that completes the QC, -1 for none
+		qcAt int
+		// index of the vote rejected as an equivocation, -1 for none
+		equivocation int
+	}{
+		{
+			name:         "quorum of four equal replicas",
+			votes:        []*VoteArgs{ballot(0, 5, hashA), ballot(1, 5, hashA), ballot(2, 5, hashA)},
+			qcAt:         2,
+			equivocation: -1,
+		},
+		{
+			name:         "heavy replica reaches the quorum alone with one other",
+			weights:      []int{5, 1, 1, 1},
+			votes:        []*VoteArgs{ballot(1, 5, hashA), ballot(0, 5, hashA)},
+			qcAt:         1,
+			equivocation: -1,
+		},
+		{
+			name:         "light replicas fall short of a heavy one",
+			weights:      []int{5, 1, 1, 1},
+			votes:        []*VoteArgs{ballot(1, 5, hashA), ballot(2, 5, hashA), ballot(3, 5, hashA)},
+			qcAt:         -1,
+			equivocation: -1,
+		},
+		{
+			name:         "duplicate voter counts once",
+			votes:        []*VoteArgs{ballot(0, 5, hashA), ballot(0, 5, hashA), ballot(1, 5, hashA)},
+			qcAt:         -1,
+			equivocation: -1,
+		},
+		{
+			name:         "same node id with another digest",
+			votes:        []*VoteArgs{ballot(0, 5, hashA), ballot(1, 5, hashA), ballot(2, 5, hashB), ballot(2, 5, hashA)},
+			qcAt:         -1,
+			equivocation: 3,
+		},
+		{
+			name:         "mismatched node view",
+			votes:        []*VoteArgs{ballot(0, 5, hashA), ballot(1, 5, hashA), ballot(2, 4, hashA)},
+			qcAt:         -1,
+			equivocation: -1,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			vc := makeVoteCollector(makeValidatorSet(0, 0, []int{0, 1, 2, 3}, test.weights, false))
+			vc.reset(5)
+			qcAt, equivocation := -1, -1
+			for i, v := range test.votes {
+				qc, ok, err := vc.add(v)
+				if _, isEq := err.(*equivocationError); isEq && equivocation < 0 {
+					equivocation = i
+				}
+				if ok {
+					qcAt = i
+					if qc.ViewId != 5 || qc.NodeId != "5_x" {
+						t.Errorf("QC for node[%s] view[%d]", qc.NodeId, qc.ViewId)
+					}
+				}
+			}
+			if qcAt != test.qcAt {
+				t.Errorf("QC at vote %d, want %d", qcAt, test.qcAt)
+			}
+			if equivocation != test.equivocation {
+				t.Errorf("equivocation at vote %d, want %d", equivocation, test.equivocation)
+			}
+		})
+	}
+}